@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/totemtang/cc-testbed"
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var nKeys = flag.Int64("nkeys", 1000000, "number of keys")
+var tracePath = flag.String("trace", "", "Trace to advise on, as benchmarks/single -trace records it; generated if empty")
+var gen = flag.String("gen", "range", "Partitioner whose locality a generated trace follows: hash or range")
+var nTrain = flag.Int("ntrain", 10000, "Generated queries of each worker to advise on")
+var nTest = flag.Int("ntest", 10000, "Generated queries of each worker to check the advice on")
+var train = flag.Float64("train", 0.5, "Share of a loaded trace to advise on; the rest checks the advice")
+var rr = flag.Float64("rr", 0, "percentage of read operations")
+var contention = flag.Float64("contention", 1, "theta factor of Zipf, 1 for uniform")
+var txnlen = flag.Int("txnlen", 16, "number of operations for each transaction")
+var mp = flag.Int("mp", 1, "Max partitions cross-partition transactions will touch")
+var imbalance = flag.Float64("imbalance", 0.05, "Share of accesses a partition may take above an even share")
+var lookupPath = flag.String("lookup", "", "Write the advised lookup table to this path")
+var out = flag.String("out", "advisor.out", "output file path")
+
+// Advises a placement of keys on part of a trace and checks it on the
+// rest: the share of cross-partition transactions predicted on the
+// part advised on, and the one observed replaying the rest in
+// partition mode, against hashing.
+// A generated trace follows the locality of -gen, e.g. transactions
+// of contiguous keys for range, which hashing does not keep local.
+func main() {
+	flag.Parse()
+
+	if *testbed.SysType != testbed.PARTITION {
+		clog.Error("Advisor Needs Partition Mode")
+	}
+	nParts := *testbed.NumPart
+
+	var trainTrace, testTrace *testbed.Trace
+	if *tracePath != "" {
+		tr := testbed.LoadTrace(*tracePath)
+		trainTrace, testTrace = tr.Split(int(float64(len(tr.Txns)) * *train))
+	} else {
+		var p testbed.Partitioner
+		switch *gen {
+		case "hash":
+			p = &testbed.HashPartitioner{
+				NParts: int64(nParts),
+				NKeys:  *nKeys,
+			}
+		case "range":
+			p = testbed.NewRangePartitioner(nParts, *nKeys, nil)
+		default:
+			clog.Error("Not Supported %s Partitioner", *gen)
+		}
+		pKeysArray := make([]int64, nParts)
+		for i := int64(0); i < *nKeys; i++ {
+			pKeysArray[p.GetPartition(testbed.CKey(i))]++
+		}
+		gens := make([]*testbed.TxnGen, nParts)
+		for i := range gens {
+			zk := testbed.NewZipfKey(i, *nKeys, nParts, pKeysArray, *contention, p)
+			gens[i] = testbed.NewTxnGen(i, testbed.ADD_ONE, *rr, *txnlen, *mp, zk)
+		}
+		trainTrace = testbed.RecordTrace(gens, *nTrain)
+		testTrace = testbed.RecordTrace(gens, *nTest)
+	}
+	clog.Info("Advising on %v transactions; checking on %v\n", len(trainTrace.Txns), len(testTrace.Txns))
+
+	tm := time.Now()
+	a := testbed.Advise(trainTrace, nParts, *nKeys, *imbalance)
+	adviseTime := time.Since(tm)
+	lp := a.Partitioner()
+	if *lookupPath != "" {
+		lp.Save(*lookupPath)
+	}
+	hp := &testbed.HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  *nKeys,
+	}
+
+	f, err := os.OpenFile(*out, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		clog.Error("Open File Error %s\n", err.Error())
+	}
+	defer f.Close()
+	f.WriteString(fmt.Sprintf("Advice Spends %v secs\n", adviseTime.Seconds()))
+	// Keys the trace misses go by hash, which a short trace shows
+	f.WriteString(fmt.Sprintf("Advice Places %v of %v Keys\n", a.NTraced, *nKeys))
+	f.WriteString(fmt.Sprintf("Advice Moves %v Keys in Refinement\n", a.NMoves))
+	f.WriteString(fmt.Sprintf("Advice Cuts %v Co-Access Edges\n", a.NCut))
+	for _, c := range []struct {
+		name string
+		p    testbed.Partitioner
+	}{{"Hash", hp}, {"Advised", lp}} {
+		predicted := testbed.CrossRatio(trainTrace, c.p)
+		s := testbed.NewStore()
+		table := s.CreateTable(testbed.RECORDS, testbed.SchemaOf(testbed.SINGLEINT), c.p, "")
+		testbed.LoadTable(table, *nKeys, 1, 0)
+		coord := testbed.NewCoordinator(1, s)
+		w := coord.Workers[0]
+		tm := time.Now()
+		testbed.ReplayTrace(w, testTrace, testbed.ADD_ONE, c.p)
+		elapsed := time.Since(tm)
+		coord.Close()
+		observed := float64(w.NStats[testbed.NCROSSTXN]) / float64(w.NStats[testbed.NTXN])
+		f.WriteString(fmt.Sprintf("%s Predicted Cross Partition Ratio %.4f\n", c.name, predicted))
+		f.WriteString(fmt.Sprintf("%s Observed Cross Partition Ratio %.4f\n", c.name, observed))
+		f.WriteString(fmt.Sprintf("%s Replay Throughput %.f\n", c.name, float64(w.NStats[testbed.NTXN])/elapsed.Seconds()))
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/totemtang/cc-testbed"
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var nKeys = flag.Int64("nkeys", 1000000, "number of keys")
+var txntype = flag.String("tt", "addone", "set transaction type")
+var seed = flag.Int64("seed", 1, "Seed of the generated dataset")
+var out = flag.String("out", "backup.out", "output file path")
+var partitioner = flag.String("partitioner", "hash", "Partitioner of keys: hash, range or lookup")
+var lookupPath = flag.String("lookup", "", "Lookup table of keys and partitions with -partitioner lookup")
+var splitPoints = flag.String("splits", "", "Comma separated first keys of partitions 1 and on with -partitioner range; even if empty")
+
+// The backup of benchmarks/single. Start it first with the same
+// -replica, -sys, -p, -ncores, -nkeys, -tt, -seed, -partitioner and
+// -splits as the primary, so that both load the same dataset in the
+// same partitions. It applies what the primary ships until the
+// primary closes.
+func main() {
+	flag.Parse()
+
+	if *testbed.Replica == "" {
+		clog.Error("Backup Needs -replica")
+	}
+
+	s := testbed.NewStore()
+	var hp testbed.Partitioner
+	if *testbed.SysType == testbed.PARTITION || *testbed.PhyPart {
+		hp = newPartitioner(*testbed.NumPart)
+	}
+	var dt testbed.RecType = testbed.SINGLEINT
+	if *txntype == "updatestring" || *txntype == "lookupstring" {
+		dt = testbed.STRINGLIST
+	}
+	table := s.CreateTable(testbed.RECORDS, testbed.SchemaOf(dt), hp, "")
+
+	tm := time.Now()
+	testbed.LoadTable(table, *nKeys, *seed, time.Second)
+	clog.Info("Loaded %v keys in %v\n", *nKeys, time.Since(tm))
+
+	backup := testbed.NewBackup(s, *testbed.Replica)
+	clog.Info("Waiting for the primary on %s\n", *testbed.Replica)
+	tm = time.Now()
+	backup.Serve()
+	clog.Info("Primary closed after %v\n", time.Since(tm))
+
+	f, err := os.OpenFile(*out, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		clog.Error("Open File Error %s\n", err.Error())
+	}
+	defer f.Close()
+	f.WriteString(fmt.Sprintf("Backup Applies %v Frames\n", backup.NFrames))
+	f.WriteString(fmt.Sprintf("Backup Applies %v Commit Records\n", backup.NRecords))
+	f.WriteString(fmt.Sprintf("Backup Applies %v Writes\n", backup.NEntries))
+	f.WriteString(fmt.Sprintf("Backup Applying Spends %v secs\n", backup.NApply.Seconds()))
+	f.WriteString(fmt.Sprintf("Backup Has %v Keys\n", table.NKeys()))
+}
+
+// A partitioner of -partitioner; range splits come from -splits or
+// are even, and a lookup table from -lookup
+func newPartitioner(nParts int) testbed.Partitioner {
+	switch *partitioner {
+	case "hash":
+		return &testbed.HashPartitioner{
+			NParts: int64(nParts),
+			NKeys:  int64(*nKeys),
+		}
+	case "range":
+		var splits []int64
+		for _, str := range strings.Split(*splitPoints, ",") {
+			if str = strings.TrimSpace(str); str == "" {
+				continue
+			}
+			x, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				clog.Error("Invalid Split Point %s", str)
+			}
+			splits = append(splits, x)
+		}
+		return testbed.NewRangePartitioner(nParts, *nKeys, splits)
+	case "lookup":
+		if *lookupPath == "" {
+			clog.Error("Lookup Partitioner Needs -lookup")
+		}
+		return testbed.LoadLookupPartitioner(*lookupPath, nParts, *nKeys)
+	default:
+		clog.Error("Not Supported %s Partitioner", *partitioner)
+		return nil
+	}
+}
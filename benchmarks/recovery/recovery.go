@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/totemtang/cc-testbed"
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var nsec = flag.Int("nsec", 2, "number of seconds to run before the crash")
+var sizes = flag.String("sizes", "100000,1000000", "comma separated numbers of keys")
+var txnlen = flag.Int("txnlen", 16, "number of operations for each transaction")
+var out = flag.String("out", "recovery.out", "output file path")
+
+// For each size, checkpoints a fresh store and runs addone with
+// logging, then recovers another store from them and checks it
+// against the first. With -ckptinterval, later checkpoints are taken
+// while transactions run too; command logging cannot use those.
+func main() {
+	flag.Parse()
+
+	runtime.GOMAXPROCS(*testbed.NumPart)
+	nworkers := *testbed.NumPart
+
+	f, err := os.OpenFile(*out, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		clog.Error("Open File Error %s\n", err.Error())
+	}
+	defer f.Close()
+	logBase, ckptBase := *testbed.LogDir, *testbed.CkptDir
+	if *testbed.CmdLog {
+		clog.Info("Logging commands")
+	}
+	f.WriteString("Keys\tCheckpoint Records\tLog Records\tLog Bytes per Record\tLoad secs\tReplay secs\tReplayed Records per sec\tRecovery secs\n")
+
+	for _, str := range strings.Split(*sizes, ",") {
+		nKeys, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+		if err != nil || nKeys <= 0 {
+			clog.Error("Invalid Size %s", str)
+		}
+
+		logDir := tempDir(logBase, "cclog")
+		ckptDir := tempDir(ckptBase, "ccckpt")
+		*testbed.LogDir = logDir
+		*testbed.CkptDir = ""
+		if isSet("ckptinterval") {
+			*testbed.CkptDir = ckptDir
+		}
+
+		s, hp := createStore(nKeys)
+		testbed.NewCheckpointer(s, ckptDir, nil, nil).Checkpoint()
+		run(s, hp, nKeys, nworkers)
+
+		tm := time.Now()
+		recovered, _ := createStore(0)
+		rs := testbed.Recover(recovered, ckptDir, logDir)
+		total := time.Since(tm)
+		verify(s, recovered, hp, nKeys)
+
+		var perRecord, perSec float64
+		if rs.NLogRecords != 0 {
+			perRecord = float64(logBytes(logDir)) / float64(rs.NLogRecords)
+			perSec = float64(rs.NLogRecords) / rs.ReplayTime.Seconds()
+		}
+		clog.Info("Recovered %v keys in %v", nKeys, total)
+		f.WriteString(fmt.Sprintf("%v\t%v\t%v\t%.1f\t%.6f\t%.6f\t%.f\t%.6f\n", nKeys, rs.NCkptRecords, rs.NLogRecords,
+			perRecord, rs.LoadTime.Seconds(), rs.ReplayTime.Seconds(), perSec, total.Seconds()))
+
+		os.RemoveAll(logDir)
+		os.RemoveAll(ckptDir)
+	}
+}
+
+// Creates a directory under base; under the default one if empty
+func tempDir(base string, prefix string) string {
+	dir, err := ioutil.TempDir(base, prefix)
+	if err != nil {
+		clog.Error("Create Temp Dir Error %s\n", err.Error())
+	}
+	return dir
+}
+
+// Total size of the worker logs; a run may leave a torn record
+func logBytes(dir string) int64 {
+	names, _ := filepath.Glob(filepath.Join(dir, "worker-*.log"))
+	var n int64
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil {
+			n += fi.Size()
+		}
+	}
+	return n
+}
+
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func createStore(nKeys int64) (*testbed.Store, *testbed.HashPartitioner) {
+	s := testbed.NewStore()
+	nParts := 1
+	if *testbed.SysType == testbed.PARTITION || *testbed.PhyPart {
+		nParts = *testbed.NumPart
+	}
+	hp := &testbed.HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+	}
+	table := s.CreateTable(testbed.RECORDS, testbed.SchemaOf(testbed.SINGLEINT), hp, "")
+	testbed.LoadTable(table, nKeys, 1, 0)
+	return s, hp
+}
+
+func run(s *testbed.Store, hp *testbed.HashPartitioner, nKeys int64, nworkers int) {
+	nParts := int(hp.NParts)
+	pKeysArray := make([]int64, nParts)
+	for i := int64(0); i < nKeys; i++ {
+		pKeysArray[hp.GetPartition(testbed.CKey(i))]++
+	}
+
+	coord := testbed.NewCoordinator(nworkers, s)
+	var wg sync.WaitGroup
+	for i := 0; i < nworkers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			w := coord.Workers[n]
+			zk := testbed.NewZipfKey(n, nKeys, nParts, pKeysArray, 1, hp)
+			gen := testbed.NewTxnGen(n, testbed.ADD_ONE, 0, *txnlen, 1, zk)
+			end_time := time.Now().Add(time.Duration(*nsec) * time.Second)
+			for time.Now().Before(end_time) {
+				w.One(gen.GenOneQuery())
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	coord.Close()
+}
+
+func verify(s *testbed.Store, recovered *testbed.Store, hp *testbed.HashPartitioner, nKeys int64) {
+	t, rt := s.Table(testbed.RECORDS), recovered.Table(testbed.RECORDS)
+	if rt.NKeys() != nKeys {
+		clog.Error("Recovered %v Keys; Expected %v", rt.NKeys(), nKeys)
+	}
+	for i := int64(0); i < nKeys; i++ {
+		k := testbed.CKey(i)
+		partNum := hp.GetPartition(k)
+		v := t.GetRecord(k, partNum).Tuple().GetInt64(0)
+		r := rt.GetRecord(k, partNum)
+		if r == nil || r.Tuple().GetInt64(0) != v {
+			clog.Error("Key %v Not Recovered as %v", i, v)
+		}
+	}
+}
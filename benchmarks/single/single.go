@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/totemtang/cc-testbed"
@@ -19,13 +21,28 @@ var contention = flag.Float64("contention", 1, "theta factor of Zipf, 1 for unif
 var txnlen = flag.Int("txnlen", 16, "number of operations for each transaction")
 var nKeys = flag.Int64("nkeys", 1000000, "number of keys")
 var out = flag.String("out", "data.out", "output file path")
-var skew = flag.Float64("skew", 0, "skew factor for partition-based concurrency control (Zipf)")
+var skew = flag.Float64("skew", 0, "skew factor for partition-based concurrency control (Zipf over partitions, > 1; 0 for none)")
 var mp = flag.Int("mp", 1, "Max partitions cross-partition transactions will touch")
 var benchStat = flag.String("bs", "", "Output file for benchmark statistics")
 var txntype = flag.String("tt", "addone", "set transaction type")
+var importPath = flag.String("import", "", "Load the dataset at this path instead of generating one")
+var exportPath = flag.String("export", "", "Write the loaded dataset to this path before running")
+var seed = flag.Int64("seed", 1, "Seed of the generated dataset")
+var exportFormat = flag.String("exportfmt", testbed.DSBINARY, "Format of the exported dataset: binary or csv")
+var hotKeys = flag.String("hotkeys", "", "Comma separated int keys replicated into every partition")
+var nHot = flag.Int("nhot", 0, "Replicate the keys read most often by a sample of the workload into every partition")
+var partitioner = flag.String("partitioner", "hash", "Partitioner of keys: hash, range or lookup")
+var lookupPath = flag.String("lookup", "", "Lookup table of keys and partitions with -partitioner lookup")
+var splitPoints = flag.String("splits", "", "Comma separated first keys of partitions 1 and on with -partitioner range; even if empty")
+var tracePath = flag.String("trace", "", "Record a trace of queries of the workload to this path for benchmarks/advisor")
+var nTrace = flag.Int("ntrace", 10000, "Queries of each worker in the trace")
+var migrate = flag.String("migrate", "", "Move the int keys lo to hi from partition a to partition b while running, as lo:hi:a:b")
+var schedule = flag.String("schedule", "", "Schedule of lines \"<duration> <workers>\" to run up to -ncores workers by")
+var migrateAfter = flag.Duration("migrateafter", time.Second, "Time from the start of the run to the migration")
 
 const (
-	TRIAL = 5
+	TRIAL     = 5
+	HOTSAMPLE = 10000 // Queries per worker sampled for -nhot
 )
 
 func main() {
@@ -39,6 +56,10 @@ func main() {
 	if *contention < 1 {
 		clog.Error("Contention factor should be between no less than 1")
 	}
+	// Hash indexes do not keep keys in order
+	if *txntype == "scanint" && *testbed.IndexType != "btree" {
+		clog.Error("-tt scanint Needs -index btree; -index %s Cannot Scan", *testbed.IndexType)
+	}
 
 	clog.Info("Number of clients %v, Number of workers %v \n", clients, nworkers)
 	if *testbed.SysType == testbed.PARTITION {
@@ -49,10 +70,42 @@ func main() {
 		} else {
 			clog.Info("Using OCC\n")
 		}
+	} else if *testbed.SysType == testbed.LOCKING {
+		if *testbed.PhyPart {
+			clog.Info("Using 2PL with partition\n")
+		} else {
+			clog.Info("Using 2PL\n")
+		}
+		if *testbed.EarlyRelease {
+			clog.Info("Using early lock release\n")
+		}
 	} else {
 		clog.Error("Not supported type %v CC\n", *testbed.SysType)
 	}
 
+	if *testbed.LogDir != "" {
+		if *testbed.LogEpoch > 0 {
+			clog.Info("Logging to %s with group commit every %v\n", *testbed.LogDir, *testbed.LogEpoch)
+		} else {
+			clog.Info("Logging to %s with a sync at every commit\n", *testbed.LogDir)
+		}
+		if *testbed.CmdLog {
+			clog.Info("Logging transaction commands instead of values\n")
+		}
+	}
+
+	if *testbed.Replica != "" {
+		if *testbed.SyncRep {
+			clog.Info("Replicating to %s with synchronous acknowledgement\n", *testbed.Replica)
+		} else {
+			clog.Info("Replicating to %s with asynchronous acknowledgement\n", *testbed.Replica)
+		}
+	}
+
+	if *testbed.AntiCacheDir != "" {
+		clog.Info("Evicting cold records to %s beyond %v per partition\n", *testbed.AntiCacheDir, *testbed.CacheSize)
+	}
+
 	tt, dt := getTxn(*txntype)
 
 	// create store
@@ -60,58 +113,193 @@ func main() {
 	var nParts int
 	var hp testbed.Partitioner = nil
 	var pKeysArray []int64
-	var value interface{}
 
 	if *testbed.SysType == testbed.PARTITION || *testbed.PhyPart {
 		nParts = *testbed.NumPart
-		pKeysArray = make([]int64, nParts)
+		hp = newPartitioner(nParts)
+	} else {
+		nParts = 1
+	}
+	pKeysArray = make([]int64, nParts)
+	table := createTable(s, tt, dt, hp)
 
-		hp = &testbed.HashPartitioner{
-			NParts: int64(nParts),
-			NKeys:  int64(*nKeys),
+	tm := time.Now()
+	if *importPath != "" {
+		testbed.ImportStore(s, *importPath, datasetFormat(*importPath))
+		if table.NKeys() != *nKeys {
+			clog.Error("Dataset Has %v Keys; Expected %v", table.NKeys(), *nKeys)
 		}
-
-		var partNum int
+		clog.Info("Imported %v keys from %s in %v\n", table.NKeys(), *importPath, time.Since(tm))
 		for i := int64(0); i < *nKeys; i++ {
-			k := testbed.Key(i)
-			partNum = hp.GetPartition(k)
-			pKeysArray[partNum]++
-			if dt == testbed.SINGLEINT {
-				value = int64(0)
-			} else if dt == testbed.STRINGLIST {
-				value = testbed.GenStringList()
+			if hp != nil {
+				pKeysArray[hp.GetPartition(testbed.CKey(i))]++
+			} else {
+				pKeysArray[0]++
 			}
-			s.CreateKV(k, value, dt, partNum)
 		}
-
 	} else {
-		nParts = 1
-		for i := int64(0); i < *nKeys; i++ {
-			k := testbed.Key(i)
-			if dt == testbed.SINGLEINT {
-				value = int64(0)
-			} else if dt == testbed.STRINGLIST {
-				value = testbed.GenStringList()
-			}
-			s.CreateKV(k, value, dt, 0)
-		}
+		pKeysArray = testbed.LoadTable(table, *nKeys, *seed, time.Second)
+		clog.Info("Loaded %v keys in %v\n", *nKeys, time.Since(tm))
+	}
+
+	if *exportPath != "" {
+		n := testbed.ExportStore(s, *exportPath, *exportFormat)
+		clog.Info("Exported %v records to %s\n", n, *exportPath)
 	}
 
 	generators := make([]*testbed.TxnGen, nworkers)
 
+	var mig []int64
+	if *migrate != "" {
+		if *testbed.SysType != testbed.PARTITION || *partitioner != "hash" {
+			clog.Error("Migration Needs Partition Mode and Hash Partitioning")
+		}
+		for _, str := range strings.Split(*migrate, ":") {
+			x, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				clog.Error("Invalid Migration %s", *migrate)
+			}
+			mig = append(mig, x)
+		}
+		if len(mig) != 4 {
+			clog.Error("Invalid Migration %s", *migrate)
+		}
+	}
+
 	for i := 0; i < nworkers; i++ {
-		p := &testbed.HashPartitioner{
+		var p testbed.Partitioner = &testbed.HashPartitioner{
 			NParts: int64(nParts),
 			NKeys:  int64(*nKeys),
 		}
+		if hp != nil && (*partitioner != "hash" || mig != nil || *schedule != "") {
+			// Tables are shared, and so is the mapping a migration
+			// changes
+			p = hp
+		}
 		zk := testbed.NewZipfKey(i, *nKeys, nParts, pKeysArray, *contention, p)
 		generators[i] = testbed.NewTxnGen(i, tt, *rr, *txnlen, *mp, zk)
+		generators[i].SetSkew(*skew)
+	}
+	if *skew > 0 {
+		// Hot partitions show in the waits of the workers
+		*testbed.WaitStats = true
+	}
+
+	if *tracePath != "" {
+		testbed.RecordTrace(generators, *nTrace).Save(*tracePath)
+		clog.Info("Recorded %v queries of each worker to %s\n", *nTrace, *tracePath)
+	}
+
+	if *hotKeys != "" || *nHot > 0 {
+		var keys []testbed.Key
+		for _, str := range strings.Split(*hotKeys, ",") {
+			if str = strings.TrimSpace(str); str == "" {
+				continue
+			}
+			k, err := strconv.ParseInt(str, 10, 64)
+			if err != nil || k < 0 || k >= *nKeys {
+				clog.Error("Invalid Hot Key %s", str)
+			}
+			keys = append(keys, testbed.CKey(k))
+		}
+		if *nHot > 0 {
+			keys = append(keys, testbed.HotKeys(generators, HOTSAMPLE, *nHot)...)
+		}
+		table.ReplicateKeys(keys)
+		for _, g := range generators {
+			g.SetReplicated(table)
+		}
+		clog.Info("Replicated %v keys into every partition\n", len(table.Replicated()))
 	}
 
 	coord := testbed.NewCoordinator(nworkers, s)
 
+	// Workers from active on wait; in partition mode, so do their
+	// partitions, whose keys the others hold
+	active := int64(nworkers)
+	var steps []testbed.Step
+	if *schedule != "" {
+		steps = testbed.LoadSchedule(*schedule)
+		for _, step := range steps {
+			if step.N > nworkers {
+				clog.Error("Schedule Runs %v Workers; -ncores Is %v", step.N, nworkers)
+			}
+		}
+		if *testbed.SysType == testbed.PARTITION && *partitioner != "hash" {
+			clog.Error("Schedules Need Hash Partitioning in Partition Mode")
+		}
+		active = int64(steps[0].N)
+		if *testbed.SysType == testbed.PARTITION {
+			coord.Rebalance(hp.(*testbed.HashPartitioner), steps[0].N)
+			for i, g := range generators {
+				g.SetBases(coord.Owned(i))
+			}
+		}
+		runtime.GOMAXPROCS(steps[0].N)
+	}
+
 	clog.Info("Done with Initialization")
 
+	// Transactions committed, counted only to measure a migration or
+	// the steps of a schedule
+	count := mig != nil || steps != nil
+	var committed int64
+	var m *testbed.Migration
+	var mStart, mEnd time.Time
+	var mCommitted [2]int64
+	migrated := make(chan bool)
+	start := time.Now()
+	if mig != nil {
+		go func() {
+			time.Sleep(*migrateAfter)
+			clog.Info("Migrating keys %v to %v from partition %v to %v\n", mig[0], mig[1], mig[2], mig[3])
+			mStart = time.Now()
+			mCommitted[0] = atomic.LoadInt64(&committed)
+			m = s.Migrate(hp.(*testbed.HashPartitioner), mig[0], mig[1], int(mig[2]), int(mig[3]))
+			mCommitted[1] = atomic.LoadInt64(&committed)
+			mEnd = time.Now()
+			close(migrated)
+		}()
+	}
+
+	// When each step starts, with the transactions committed by then
+	// and the records rebalanced
+	stepStart := make([]time.Time, len(steps))
+	stepCommitted := make([]int64, len(steps))
+	stepMoved := make([]int64, len(steps))
+	stepRebalance := make([]time.Duration, len(steps))
+	var layout int64 // Bumped when partitions hold other keys
+	scheduled := make(chan bool)
+	if steps != nil {
+		stepStart[0] = start
+		go func() {
+			for i := 1; i < len(steps); i++ {
+				step := steps[i]
+				if step.At >= time.Duration(*nsec)*time.Second {
+					break
+				}
+				time.Sleep(time.Until(start.Add(step.At)))
+				clog.Info("Running %v workers\n", step.N)
+				stepStart[i] = time.Now()
+				stepCommitted[i] = atomic.LoadInt64(&committed)
+				if int64(step.N) < active {
+					atomic.StoreInt64(&active, int64(step.N))
+				}
+				if *testbed.SysType == testbed.PARTITION {
+					tm := time.Now()
+					for _, m := range coord.Rebalance(hp.(*testbed.HashPartitioner), step.N) {
+						stepMoved[i] += m.NMoved
+					}
+					stepRebalance[i] = time.Since(tm)
+					atomic.AddInt64(&layout, 1)
+				}
+				atomic.StoreInt64(&active, int64(step.N))
+				runtime.GOMAXPROCS(step.N)
+			}
+			close(scheduled)
+		}()
+	}
+
 	var wg sync.WaitGroup
 	for i := 0; i < clients; i++ {
 		wg.Add(1)
@@ -120,11 +308,20 @@ func main() {
 			//var count int
 			w := coord.Workers[n]
 			end_time := time.Now().Add(time.Duration(*nsec) * time.Second)
+			var seen int64
 			for {
 				tm := time.Now()
 				if !end_time.After(tm) {
 					break
 				}
+				if int64(n) >= atomic.LoadInt64(&active) {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if v := atomic.LoadInt64(&layout); v != seen {
+					generators[n].SetBases(coord.Owned(n))
+					seen = v
+				}
 
 				q := generators[n].GenOneQuery()
 
@@ -136,6 +333,9 @@ func main() {
 					_, err := w.One(q)
 
 					if err == nil {
+						if count {
+							atomic.AddInt64(&committed, 1)
+						}
 						break
 					} else if err == testbed.ENOKEY {
 						clog.Error("No Key Error")
@@ -156,14 +356,53 @@ func main() {
 		}(i)
 	}
 	wg.Wait()
+	end := time.Now()
+	if mig != nil {
+		<-migrated
+	}
+	if steps != nil {
+		<-scheduled
+	}
 
 	f, err := os.OpenFile(*out, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
 		clog.Error("Open File Error %s\n", err.Error())
 	}
 	defer f.Close()
+	coord.Close()
 	coord.PrintStats(f)
 
+	if m != nil {
+		// Throughput before, during and after the migration shows its dip
+		rate := func(n int64, d time.Duration) float64 {
+			if d <= 0 {
+				return 0
+			}
+			return float64(n) / d.Seconds()
+		}
+		f.WriteString(fmt.Sprintf("Migration Spends %v secs\n", m.Time.Seconds()))
+		f.WriteString(fmt.Sprintf("Migration Moves %v Records in %v Batches\n", m.NMoved, m.NBatches))
+		f.WriteString(fmt.Sprintf("Throughput Before Migration %.f\n", rate(mCommitted[0], mStart.Sub(start))))
+		f.WriteString(fmt.Sprintf("Throughput During Migration %.f\n", rate(mCommitted[1]-mCommitted[0], mEnd.Sub(mStart))))
+		f.WriteString(fmt.Sprintf("Throughput After Migration %.f\n", rate(committed-mCommitted[1], end.Sub(mEnd))))
+	}
+
+	for i, step := range steps {
+		if i > 0 && stepStart[i].IsZero() {
+			break
+		}
+		stepEnd, endCommitted := end, committed
+		if i+1 < len(steps) && !stepStart[i+1].IsZero() {
+			stepEnd, endCommitted = stepStart[i+1], stepCommitted[i+1]
+		}
+		d := stepEnd.Sub(stepStart[i])
+		f.WriteString(fmt.Sprintf("Step %v Runs %v Workers for %v secs\n", i, step.N, d.Seconds()))
+		f.WriteString(fmt.Sprintf("Step %v Throughput %.f\n", i, float64(endCommitted-stepCommitted[i])/d.Seconds()))
+		if i > 0 && *testbed.SysType == testbed.PARTITION {
+			f.WriteString(fmt.Sprintf("Step %v Rebalances %v Records in %v secs\n", i, stepMoved[i], stepRebalance[i].Seconds()))
+		}
+	}
+
 	if *benchStat != "" {
 		bs, err := os.OpenFile(*benchStat, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 		if err != nil {
@@ -177,6 +416,59 @@ func main() {
 
 }
 
+// A partitioner of -partitioner; range splits come from -splits or
+// are even, and a lookup table from -lookup
+func newPartitioner(nParts int) testbed.Partitioner {
+	switch *partitioner {
+	case "hash":
+		return &testbed.HashPartitioner{
+			NParts: int64(nParts),
+			NKeys:  int64(*nKeys),
+		}
+	case "range":
+		var splits []int64
+		for _, str := range strings.Split(*splitPoints, ",") {
+			if str = strings.TrimSpace(str); str == "" {
+				continue
+			}
+			x, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				clog.Error("Invalid Split Point %s", str)
+			}
+			splits = append(splits, x)
+		}
+		return testbed.NewRangePartitioner(nParts, *nKeys, splits)
+	case "lookup":
+		if *lookupPath == "" {
+			clog.Error("Lookup Partitioner Needs -lookup")
+		}
+		return testbed.LoadLookupPartitioner(*lookupPath, nParts, *nKeys)
+	default:
+		clog.Error("Not Supported %s Partitioner", *partitioner)
+		return nil
+	}
+}
+
+// A CSV dataset is a directory, a binary one a file
+func datasetFormat(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		clog.Error("Dataset Error %s\n", err.Error())
+	}
+	if fi.IsDir() {
+		return testbed.DSCSV
+	}
+	return testbed.DSBINARY
+}
+
+func createTable(s *testbed.Store, tt int, dt testbed.RecType, p testbed.Partitioner) *testbed.Table {
+	table := s.CreateTable(testbed.RECORDS, testbed.SchemaOf(dt), p, "")
+	if tt == testbed.LOOKUP_STRING {
+		table.CreateSecIndex(0)
+	}
+	return table
+}
+
 func getTxn(txntype string) (int, testbed.RecType) {
 	if strings.Compare(txntype, "addone") == 0 {
 		return testbed.ADD_ONE, testbed.SINGLEINT
@@ -184,6 +476,12 @@ func getTxn(txntype string) (int, testbed.RecType) {
 		return testbed.RANDOM_UPDATE_INT, testbed.SINGLEINT
 	} else if strings.Compare(txntype, "updatestring") == 0 {
 		return testbed.RANDOM_UPDATE_STRING, testbed.STRINGLIST
+	} else if strings.Compare(txntype, "scanint") == 0 {
+		return testbed.SCAN_INT, testbed.SINGLEINT
+	} else if strings.Compare(txntype, "insdel") == 0 {
+		return testbed.INSERT_DELETE_INT, testbed.SINGLEINT
+	} else if strings.Compare(txntype, "lookupstring") == 0 {
+		return testbed.LOOKUP_STRING, testbed.STRINGLIST
 	} else {
 		clog.Error("Not Supported %s Transaction", txntype)
 		return -1, -1
@@ -14,16 +14,18 @@ type ZipfKey struct {
 	pKeysArray   []int64
 	isZipf       bool
 	isPartition  bool
-	hp           *HashPartitioner
+	hp           Partitioner
 	wholeZipf    *rand.Zipf
 	partZipf     []*rand.Zipf
 	wholeUniform *rand.Rand
 	partUniform  []*rand.Rand
+	roKeys       int64   // Keys below ROKeys, which only reads get
+	roRanks      []int64 // Of them, the lowest ranks of each partition
 }
 
 // Index of partition starts from 0
 // Integer Key starts from 0 also
-func NewZipfKey(partIndex int, nKeys int64, nParts int, pKeysArray []int64, s float64, hp *HashPartitioner) *ZipfKey {
+func NewZipfKey(partIndex int, nKeys int64, nParts int, pKeysArray []int64, s float64, hp Partitioner) *ZipfKey {
 
 	zk := &ZipfKey{
 		partIndex:  partIndex,
@@ -62,30 +64,85 @@ func NewZipfKey(partIndex int, nKeys int64, nParts int, pKeysArray []int64, s fl
 		}
 	}
 
+	if *ROKeys > 0 {
+		zk.setReadOnly(*ROKeys)
+	}
+
 	return zk
 }
 
+// Keys below n go to reads only, and the rest keep their distribution
+// shifted past them. Partitioners have to rank the keys of a partition
+// in order, as they all do.
+func (zk *ZipfKey) setReadOnly(n int64) {
+	if n >= zk.nKeys {
+		clog.Error("Read-Only Keys %v Leave None of %v Keys to Write", n, zk.nKeys)
+	}
+	zk.roKeys = n
+	if !zk.isPartition {
+		return
+	}
+	zk.roRanks = make([]int64, zk.nParts)
+	for k := int64(0); k < n; k++ {
+		zk.roRanks[zk.hp.GetPartition(CKey(k))]++
+	}
+	for i, ro := range zk.roRanks {
+		if ro >= zk.pKeysArray[i] {
+			clog.Error("Read-Only Keys Leave None of Partition %v to Write", i)
+		}
+	}
+}
+
 func (zk *ZipfKey) GetKey() Key {
 	if zk.isZipf {
-		return Key(zk.wholeZipf.Uint64())
+		for {
+			if x := int64(zk.wholeZipf.Uint64()); x < zk.nKeys-zk.roKeys {
+				return CKey(x + zk.roKeys)
+			}
+		}
 	} else {
-		return Key(zk.wholeUniform.Int63n(zk.nKeys))
+		return CKey(zk.wholeUniform.Int63n(zk.nKeys-zk.roKeys) + zk.roKeys)
 	}
 }
 
-func (zk *ZipfKey) GetSelfKey() Key {
+// GetReadKey returns a key for a read in the partition of k; one below
+// ROKeys if there are any
+func (zk *ZipfKey) GetReadKey(k Key) Key {
+	if zk.roKeys == 0 {
+		return k
+	}
 	if !zk.isPartition {
-		clog.Error("Should not be invoked for non-partition CC")
+		return CKey(zk.wholeUniform.Int63n(zk.roKeys))
+	}
+	pi := zk.hp.GetPartition(k)
+	if zk.roRanks[pi] == 0 {
+		return k
 	}
+	return zk.hp.GetKey(pi, zk.partUniform[pi].Int63n(zk.roRanks[pi]))
+}
 
-	pi := zk.partIndex
+// A rank of partition pi past those of read-only keys
+func (zk *ZipfKey) partRank(pi int) int64 {
+	var ro int64
+	if zk.roRanks != nil {
+		ro = zk.roRanks[pi]
+	}
+	if !zk.isZipf {
+		return zk.partUniform[pi].Int63n(zk.pKeysArray[pi]-ro) + ro
+	}
+	for {
+		if rank := int64(zk.partZipf[pi].Uint64()); rank < zk.pKeysArray[pi]-ro {
+			return rank + ro
+		}
+	}
+}
 
-	if zk.isZipf {
-		rank := int64(zk.partZipf[pi].Uint64())
-		return zk.hp.GetKey(pi, int64(rank))
-	} else {
-		return zk.hp.GetKey(pi, zk.partUniform[pi].Int63n(zk.pKeysArray[pi]))
+func (zk *ZipfKey) GetSelfKey() Key {
+	if !zk.isPartition {
+		clog.Error("Should not be invoked for non-partition CC")
 	}
+
+	return zk.hp.GetKey(zk.partIndex, zk.partRank(zk.partIndex))
 }
 
 func (zk *ZipfKey) GetOtherKey(pi int) Key {
@@ -93,10 +150,5 @@ func (zk *ZipfKey) GetOtherKey(pi int) Key {
 		clog.Error("Should not be invoked for non-partition CC")
 	}
 
-	if zk.isZipf {
-		rank := int64(zk.partZipf[pi].Uint64())
-		return zk.hp.GetKey(pi, int64(rank))
-	} else {
-		return zk.hp.GetKey(pi, zk.partUniform[pi].Int63n(zk.pKeysArray[pi]))
-	}
+	return zk.hp.GetKey(pi, zk.partRank(pi))
 }
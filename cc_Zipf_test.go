@@ -26,7 +26,7 @@ func TestZipf(t *testing.T) {
 
 	// Test 1000 times
 	for i := 0; i < 1000; i++ {
-		statics[zk.GetKey()]++
+		statics[ParseKey(zk.GetKey())]++
 	}
 
 	// Output Statistics
@@ -52,7 +52,7 @@ func TestZipf(t *testing.T) {
 	}
 
 	// Only Test Partition 0
-	zk = NewZipfKey(0, nKeys, nParts, pKeysArray, s, p)
+	zk = NewZipfKey(0, nKeys, nParts, pKeysArray, s, p.(*HashPartitioner))
 
 	// Try to get key from partition 0
 	statics = make([]int, pKeysArray[0])
@@ -0,0 +1,364 @@
+package testbed
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// A partitioning advisor after Schism: keys which transactions of a
+// trace access together become the vertices of a graph, with an edge
+// for each pair weighted by the transactions sharing it. Partitioning
+// it under a balance constraint keeps transactions in one partition,
+// and gives a lookup table for LookupPartitioner.
+
+const ADVISEPASSES = 16 // Refinement passes at most
+
+// TraceTxn holds the int keys a transaction reads and writes
+type TraceTxn struct {
+	R []int64
+	W []int64
+}
+
+type Trace struct {
+	Txns []TraceTxn
+}
+
+// RecordTrace takes nQueries queries of each generator
+func RecordTrace(gens []*TxnGen, nQueries int) *Trace {
+	tr := &Trace{}
+	for _, tg := range gens {
+		for i := 0; i < nQueries; i++ {
+			tr.Add(tg.GenOneQuery())
+		}
+	}
+	return tr
+}
+
+// Add keeps the keys of q, which must be int keys
+func (tr *Trace) Add(q *Query) {
+	var txn TraceTxn
+	for _, k := range q.rKeys {
+		txn.R = append(txn.R, ParseKey(k))
+	}
+	for _, k := range q.wKeys {
+		txn.W = append(txn.W, ParseKey(k))
+	}
+	tr.Txns = append(tr.Txns, txn)
+}
+
+// Save writes a line of each transaction: the keys read, a "|" and
+// the keys written
+func (tr *Trace) Save(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		clog.Error("Create Trace Error %s\n", err.Error())
+	}
+	w := bufio.NewWriter(f)
+	for _, txn := range tr.Txns {
+		for _, k := range txn.R {
+			fmt.Fprintf(w, "%d ", k)
+		}
+		w.WriteString("|")
+		for _, k := range txn.W {
+			fmt.Fprintf(w, " %d", k)
+		}
+		w.WriteString("\n")
+	}
+	if err := w.Flush(); err != nil {
+		clog.Error("Write Trace Error %s\n", err.Error())
+	}
+	if err := f.Close(); err != nil {
+		clog.Error("Write Trace Error %s\n", err.Error())
+	}
+}
+
+func LoadTrace(path string) *Trace {
+	f, err := os.Open(path)
+	if err != nil {
+		clog.Error("Open Trace Error %s\n", err.Error())
+	}
+	defer f.Close()
+
+	tr := &Trace{}
+	sc := bufio.NewScanner(f)
+	line := 0
+	for sc.Scan() {
+		line++
+		fields := strings.Split(sc.Text(), "|")
+		if len(fields) != 2 {
+			clog.Error("Trace %s Line %v: Expected Reads | Writes", path, line)
+		}
+		var txn TraceTxn
+		for i, dst := range []*[]int64{&txn.R, &txn.W} {
+			for _, str := range strings.Fields(fields[i]) {
+				k, err := strconv.ParseInt(str, 10, 64)
+				if err != nil {
+					clog.Error("Trace %s Line %v: Invalid Key %s", path, line, str)
+				}
+				*dst = append(*dst, k)
+			}
+		}
+		tr.Txns = append(tr.Txns, txn)
+	}
+	if err := sc.Err(); err != nil {
+		clog.Error("Read Trace Error %s\n", err.Error())
+	}
+	return tr
+}
+
+// Split returns the first n transactions and the rest
+func (tr *Trace) Split(n int) (*Trace, *Trace) {
+	if n > len(tr.Txns) {
+		n = len(tr.Txns)
+	}
+	return &Trace{Txns: tr.Txns[:n]}, &Trace{Txns: tr.Txns[n:]}
+}
+
+// CrossRatio is the share of transactions of tr which p puts in more
+// than one partition
+func CrossRatio(tr *Trace, p Partitioner) float64 {
+	if len(tr.Txns) == 0 {
+		return 0
+	}
+	var cross int
+	for _, txn := range tr.Txns {
+		if spans(txn, p) {
+			cross++
+		}
+	}
+	return float64(cross) / float64(len(tr.Txns))
+}
+
+func spans(txn TraceTxn, p Partitioner) bool {
+	part := -1
+	for _, keys := range [][]int64{txn.R, txn.W} {
+		for _, k := range keys {
+			x := p.GetPartition(CKey(k))
+			if part >= 0 && x != part {
+				return true
+			}
+			part = x
+		}
+	}
+	return false
+}
+
+// ReplayTrace runs the transactions of tr as queries of type txn on
+// w, routed by p, as a generator would route them
+func ReplayTrace(w *Worker, tr *Trace, txn int, p Partitioner) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, t := range tr.Txns {
+		q := &Query{
+			TXN:         txn,
+			txnLen:      len(t.R) + len(t.W),
+			isPartition: *SysType == PARTITION,
+			partitioner: p,
+		}
+		for _, k := range t.R {
+			q.rKeys = append(q.rKeys, CKey(k))
+		}
+		for _, k := range t.W {
+			q.wKeys = append(q.wKeys, CKey(k))
+		}
+		q.route(-1)
+		q.GenValue(rnd)
+		if _, err := w.One(q); err != nil && err != EABORT {
+			clog.Error("Replaying Trace Fails with %v", err)
+		}
+	}
+}
+
+// Advice places the keys of a trace
+type Advice struct {
+	NParts  int
+	NKeys   int64
+	Parts   []uint8 // Partition of each key below NKeys; NOPART if not traced
+	NTraced int     // Keys placed
+	NMoves  int     // Keys refinement moved
+	NCut    int64   // Weight of edges across partitions
+}
+
+// Partitioner returns a lookup table with the advice; keys not in the
+// trace go by hash
+func (a *Advice) Partitioner() *LookupPartitioner {
+	return NewLookupPartitioner(a.NParts, a.NKeys, a.Parts)
+}
+
+type keyGain struct {
+	v    int32
+	gain int64
+}
+
+// A max-heap of keys by their connection to a growing partition
+type gainHeap []keyGain
+
+func (h gainHeap) Len() int            { return len(h) }
+func (h gainHeap) Less(i, j int) bool  { return h[i].gain > h[j].gain }
+func (h gainHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *gainHeap) Push(x interface{}) { *h = append(*h, x.(keyGain)) }
+func (h *gainHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Advise partitions the co-access graph of tr into nParts, keeping the
+// accesses of each partition within imbalance, e.g. 0.05, above an
+// even share. Partitions are grown greedily over the graph, then keys
+// move between them while that cuts fewer edges.
+func Advise(tr *Trace, nParts int, nKeys int64, imbalance float64) *Advice {
+	if nParts <= 0 || nParts >= NOPART {
+		clog.Error("Advice for 1 to %v Partitions; Got %v", NOPART-1, nParts)
+	}
+
+	ids := make(map[int64]int32)
+	var keys []int64
+	var weight []int64
+	var adj []map[int32]int32
+	var vs []int32
+	var total int64
+	for _, txn := range tr.Txns {
+		vs = vs[:0]
+		for _, set := range [][]int64{txn.R, txn.W} {
+			for _, k := range set {
+				if k < 0 || k >= nKeys {
+					continue
+				}
+				v, ok := ids[k]
+				if !ok {
+					v = int32(len(keys))
+					ids[k] = v
+					keys = append(keys, k)
+					weight = append(weight, 0)
+					adj = append(adj, make(map[int32]int32))
+				}
+				weight[v]++
+				total++
+				dup := false
+				for _, x := range vs {
+					dup = dup || x == v
+				}
+				if !dup {
+					vs = append(vs, v)
+				}
+			}
+		}
+		for i, x := range vs {
+			for _, y := range vs[i+1:] {
+				adj[x][y]++
+				adj[y][x]++
+			}
+		}
+	}
+
+	limit := float64(total) * (1 + imbalance) / float64(nParts)
+	load := make([]float64, nParts)
+	part := make([]int, len(keys))
+	conn := make([]float64, nParts)
+	// Sums the edges of v to each partition, skipping unplaced keys
+	connect := func(v int) {
+		for p := range conn {
+			conn[p] = 0
+		}
+		for x, n := range adj[v] {
+			if p := part[x]; p >= 0 {
+				conn[p] += float64(n)
+			}
+		}
+	}
+
+	for v := range part {
+		part[v] = -1
+	}
+	// Partitions grow one at a time, each from the first key accessed
+	// not yet placed, taking the key most connected to them until they
+	// hold their share of the accesses left. The last takes the rest.
+	gain := make([]int64, len(keys))
+	seed := 0
+	var placed float64
+	for p := 0; p < nParts; p++ {
+		share := (float64(total) - placed) / float64(nParts-p)
+		h := &gainHeap{}
+		for {
+			v := -1
+			for h.Len() > 0 {
+				g := heap.Pop(h).(keyGain)
+				if part[g.v] < 0 && gain[g.v] == g.gain {
+					v = int(g.v)
+					break
+				}
+			}
+			if v < 0 {
+				for seed < len(keys) && part[seed] >= 0 {
+					seed++
+				}
+				if seed == len(keys) {
+					break
+				}
+				v = seed
+			}
+			if p < nParts-1 && load[p] > 0 && load[p]+float64(weight[v]) > share {
+				break
+			}
+			part[v] = p
+			load[p] += float64(weight[v])
+			for x, n := range adj[v] {
+				if part[x] < 0 {
+					gain[x] += int64(n)
+					heap.Push(h, keyGain{v: x, gain: gain[x]})
+				}
+			}
+		}
+		placed += load[p]
+		for v := range gain {
+			gain[v] = 0
+		}
+	}
+
+	a := &Advice{NParts: nParts, NKeys: nKeys, NTraced: len(keys)}
+	for pass := 0; pass < ADVISEPASSES; pass++ {
+		moved := 0
+		for v := range keys {
+			connect(v)
+			cur := part[v]
+			best := cur
+			for p := 0; p < nParts; p++ {
+				if p != cur && conn[p] > conn[best] && load[p]+float64(weight[v]) <= limit {
+					best = p
+				}
+			}
+			if best != cur {
+				load[cur] -= float64(weight[v])
+				load[best] += float64(weight[v])
+				part[v] = best
+				moved++
+			}
+		}
+		a.NMoves += moved
+		if moved == 0 {
+			break
+		}
+	}
+
+	a.Parts = make([]uint8, nKeys)
+	for i := range a.Parts {
+		a.Parts[i] = NOPART
+	}
+	for v, k := range keys {
+		a.Parts[k] = uint8(part[v])
+		for x, n := range adj[v] {
+			if int(x) > v && part[x] != part[v] {
+				a.NCut += int64(n)
+			}
+		}
+	}
+	return a
+}
@@ -0,0 +1,92 @@
+package testbed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAdvisor(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Advisor Begin")
+	fmt.Println("=======================")
+
+	*SysType = PARTITION
+	*NumPart = 4
+	nParts := 4
+	nKeys := int64(1024)
+	block := int64(8)
+
+	// Each transaction reads and writes keys of one block of keys in a
+	// row, which hashing spreads over all partitions
+	rnd := rand.New(rand.NewSource(1))
+	trace := &Trace{}
+	for i := 0; i < 4000; i++ {
+		b := rnd.Int63n(nKeys/block) * block
+		var txn TraceTxn
+		for j := 0; j < 2; j++ {
+			txn.R = append(txn.R, b+rnd.Int63n(block))
+			txn.W = append(txn.W, b+rnd.Int63n(block))
+		}
+		trace.Txns = append(trace.Txns, txn)
+	}
+
+	dir, err := ioutil.TempDir("", "ccadvisor")
+	if err != nil {
+		t.Fatalf("Create Temp Dir Error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace")
+	trace.Save(path)
+	if loaded := LoadTrace(path); !reflect.DeepEqual(loaded, trace) {
+		t.Errorf("Trace changes through a file")
+	}
+
+	train, test := trace.Split(3000)
+	a := Advise(train, nParts, nKeys, 0.05)
+	lp := a.Partitioner()
+	hp := &HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+	}
+	hashed, advised := CrossRatio(test, hp), CrossRatio(test, lp)
+	fmt.Printf("Cross ratio %.3f by hash, %.3f advised; %v edges cut\n", hashed, advised, a.NCut)
+	if hashed < 0.5 || advised > 0.05 {
+		t.Errorf("Cross ratio %v by hash, %v advised", hashed, advised)
+	}
+
+	// Accesses of each partition stay within the imbalance
+	load := make([]float64, nParts)
+	var total float64
+	for _, txn := range train.Txns {
+		for _, k := range append(append([]int64{}, txn.R...), txn.W...) {
+			load[lp.GetPartition(CKey(k))]++
+			total++
+		}
+	}
+	for p, l := range load {
+		if l > total*1.05/float64(nParts) {
+			t.Errorf("Partition %v takes %v of %v accesses", p, l, total)
+		}
+	}
+
+	// Running the trace crosses partitions as predicted
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), lp, "")
+	LoadTable(table, nKeys, 1, 0)
+	coord := NewCoordinator(1, store)
+	w := coord.Workers[0]
+	ReplayTrace(w, test, ADD_ONE, lp)
+	coord.Close()
+	if observed := float64(w.NStats[NCROSSTXN]) / float64(w.NStats[NTXN]); observed != advised {
+		t.Errorf("Observed cross ratio %v; predicted %v", observed, advised)
+	}
+
+	fmt.Println("=====================")
+	fmt.Println("Test Advisor End")
+	fmt.Println("=====================")
+}
@@ -0,0 +1,275 @@
+package testbed
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var AntiCacheDir = flag.String("anticache", "", "Directory of block files of evicted records; empty disables anti-caching")
+var CacheSize = flag.Int64("cachesize", 100000, "Records of each partition of a table kept in memory with anti-caching")
+
+const (
+	EVICTBLOCK = 64 // Most records written to the block file at once
+)
+
+// A transaction touched an evicted record; it is restarted once
+// the record is fetched
+var EEVICTED = errors.New("evicted")
+
+// Anti-caching of one partition of a table, in partition mode only.
+// Resident records form an LRU chain, most recent first. Once there
+// are more than CacheSize, the least recent are evicted: their values
+// are appended to the block file and the records stay in the index
+// as stubs without values. Fetching one back reads it from the file
+// without the partition lock; the record is installed again by merge
+// under the lock. Space of fetched records in the file is not reused.
+type antiCache struct {
+	padding1    [64]byte
+	mu          sync.Mutex // Guards all but the records, which the partition lock does
+	sch         *Schema
+	f           *os.File
+	end         int64
+	head        *PRecord
+	tail        *PRecord
+	nResident   int64
+	pending     map[*PRecord]chan bool
+	ready       []fetched
+	buf         []byte
+	NEvicted    int64
+	NUnevicted  int64
+	NEvictBytes int64
+	padding2    [64]byte
+}
+
+type fetched struct {
+	r   *PRecord
+	off int64
+	tup *Tuple
+}
+
+func newAntiCache(dir string, t *Table, partNum int) *antiCache {
+	if *SysType != PARTITION {
+		clog.Error("Anti-Caching Needs Partition Mode")
+	}
+	if *ChopTxn {
+		clog.Error("Anti-Caching Cannot Restart Chopped Transactions")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		clog.Error("Create Anti-Cache Directory Error %s\n", err.Error())
+	}
+	path := filepath.Join(dir, fmt.Sprintf("table-%d-part-%d.blocks", t.ID, partNum))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		clog.Error("Open Block File Error %s\n", err.Error())
+	}
+	return &antiCache{
+		sch:     t.Schema,
+		f:       f,
+		pending: make(map[*PRecord]chan bool),
+	}
+}
+
+// Puts r at the head of the chain, adding it if it is not there
+func (ac *antiCache) touch(r Record) {
+	pr := r.(*PRecord)
+	ac.mu.Lock()
+	if pr.cached {
+		ac.unchain(pr)
+	} else {
+		pr.cached = true
+		ac.nResident++
+	}
+	pr.prev = nil
+	pr.next = ac.head
+	if ac.head != nil {
+		ac.head.prev = pr
+	} else {
+		ac.tail = pr
+	}
+	ac.head = pr
+	ac.mu.Unlock()
+}
+
+func (ac *antiCache) unchain(pr *PRecord) {
+	if pr.prev != nil {
+		pr.prev.next = pr.next
+	} else {
+		ac.head = pr.next
+	}
+	if pr.next != nil {
+		pr.next.prev = pr.prev
+	} else {
+		ac.tail = pr.prev
+	}
+	pr.prev, pr.next = nil, nil
+}
+
+// Evicts the least recent records beyond CacheSize, EVICTBLOCK at a
+// time. Tombstones leave the chain without being written. The caller
+// holds the partition lock.
+func (ac *antiCache) evict() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for ac.nResident > *CacheSize {
+		var victims [EVICTBLOCK]*PRecord
+		n := 0
+		ac.buf = ac.buf[:0]
+		for n < EVICTBLOCK && ac.nResident > *CacheSize {
+			pr := ac.tail
+			ac.unchain(pr)
+			pr.cached = false
+			ac.nResident--
+			if pr.absent {
+				continue
+			}
+			pr.off = ac.end + int64(len(ac.buf))
+			ac.buf = appendTuple(ac.buf, &pr.tuple)
+			pr.size = int32(ac.end + int64(len(ac.buf)) - pr.off)
+			victims[n] = pr
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err := ac.f.WriteAt(ac.buf, ac.end); err != nil {
+			clog.Error("Write Block File Error %s\n", err.Error())
+		}
+		ac.end += int64(len(ac.buf))
+		ac.NEvictBytes += int64(len(ac.buf))
+		for _, pr := range victims[:n] {
+			pr.evicted = true
+			pr.tuple = Tuple{schema: ac.sch}
+		}
+		ac.NEvicted += int64(n)
+	}
+}
+
+// Returns the values written at off
+func (ac *antiCache) read(off int64, size int32) *Tuple {
+	b := make([]byte, size)
+	if _, err := ac.f.ReadAt(b, off); err != nil {
+		clog.Error("Read Block File Error %s\n", err.Error())
+	}
+	tup := (&logReader{b: b}).tuple(ac.sch)
+	if tup == nil {
+		clog.Error("Block File Has a Short Record at %v", off)
+	}
+	return tup
+}
+
+// Starts fetching an evicted record unless it is being fetched; the
+// returned channel is closed once merge can install it
+func (ac *antiCache) fetch(pr *PRecord) chan bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ch, ok := ac.pending[pr]; ok {
+		return ch
+	}
+	ch := make(chan bool)
+	ac.pending[pr] = ch
+	off, size := pr.off, pr.size
+	go func() {
+		tup := ac.read(off, size)
+		ac.mu.Lock()
+		ac.ready = append(ac.ready, fetched{r: pr, off: off, tup: tup})
+		delete(ac.pending, pr)
+		ac.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+// Installs the fetched records; the caller holds the partition lock.
+// A record fetched twice is installed once, and offsets are never
+// reused, so a fetch which is not of its current eviction is dropped.
+func (ac *antiCache) merge() {
+	ac.mu.Lock()
+	ready := ac.ready
+	ac.ready = nil
+	ac.mu.Unlock()
+	var n int64
+	for _, f := range ready {
+		if !f.r.evicted || f.r.off != f.off {
+			continue
+		}
+		f.r.tuple = *f.tup
+		f.r.evicted = false
+		ac.touch(f.r)
+		n++
+	}
+	if n > 0 {
+		ac.mu.Lock()
+		ac.NUnevicted += n
+		ac.mu.Unlock()
+	}
+}
+
+// Returns the values of r, read from the block file if it is evicted;
+// for readers which hold the partition lock but should not fetch
+func tupleOf(ac *antiCache, r Record) *Tuple {
+	if ac != nil {
+		if pr := r.(*PRecord); pr.evicted {
+			return ac.read(pr.off, pr.size)
+		}
+	}
+	return r.Tuple()
+}
+
+// Installs the records fetched for the partitions in parts, which
+// the caller has locked
+func (s *Store) mergeFetched(parts []int) {
+	for _, t := range s.tables {
+		for _, p := range parts {
+			if ac := t.parts[p].ac; ac != nil {
+				ac.merge()
+			}
+		}
+	}
+}
+
+// Evicts the cold records of the partitions in parts, which the
+// caller has locked
+func (s *Store) evictCold(parts []int) {
+	for _, t := range s.tables {
+		for _, p := range parts {
+			if ac := t.parts[p].ac; ac != nil {
+				ac.evict()
+			}
+		}
+	}
+}
+
+// Fetches the evicted records the transaction touched and waits
+// for them
+func (p *PTransaction) fetchEvicted() {
+	chans := make([]chan bool, len(p.evicted))
+	for i, e := range p.evicted {
+		chans[i] = e.ac.fetch(e.r)
+	}
+	for _, ch := range chans {
+		<-ch
+	}
+	p.evicted = p.evicted[:0]
+}
+
+// Sums the anti-caching counters of all partitions of all tables
+func (s *Store) AntiCacheStats() (evicted int64, unevicted int64, bytes int64) {
+	for _, t := range s.tables {
+		for _, part := range t.parts {
+			if ac := part.ac; ac != nil {
+				ac.mu.Lock()
+				evicted += ac.NEvicted
+				unevicted += ac.NUnevicted
+				bytes += ac.NEvictBytes
+				ac.mu.Unlock()
+			}
+		}
+	}
+	return
+}
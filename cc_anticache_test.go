@@ -0,0 +1,163 @@
+package testbed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestAntiCache(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Anti-Cache Begin")
+	fmt.Println("=======================")
+
+	defer func() {
+		*AntiCacheDir = ""
+		*CacheSize = 100000
+		*CrossPercent = 0
+	}()
+
+	*SysType = PARTITION
+	*CrossPercent = 50
+	*CacheSize = 16
+	nKeys := int64(256)
+	nParts := 2
+
+	hp := &HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+	}
+	pKeysArray := make([]int64, nParts)
+	for i := int64(0); i < nKeys; i++ {
+		pKeysArray[hp.GetPartition(CKey(i))]++
+	}
+
+	// The same queries run on a store with anti-caching and one without
+	for _, tt := range []int{ADD_ONE, INSERT_DELETE_INT, LOOKUP_STRING} {
+		*NumPart = nParts
+		dir, err := ioutil.TempDir("", "ccanti")
+		if err != nil {
+			t.Fatalf("Create Temp Dir Error %s", err.Error())
+		}
+		defer os.RemoveAll(dir)
+
+		var rt RecType = SINGLEINT
+		if tt == LOOKUP_STRING {
+			rt = STRINGLIST
+		}
+		create := func() (*Store, *Table) {
+			s := NewStore()
+			table := s.CreateTable(RECORDS, SchemaOf(rt), hp, "")
+			if tt == LOOKUP_STRING {
+				table.CreateSecIndex(0)
+			}
+			LoadTable(table, nKeys, 1, 0)
+			return s, table
+		}
+		*AntiCacheDir = ""
+		plainStore, plain := create()
+		*AntiCacheDir = dir
+		store, table := create()
+
+		wPlain, w := NewWorker(0, plainStore), NewWorker(0, store)
+		zk := NewZipfKey(0, nKeys, nParts, pKeysArray, 1, hp)
+		gen := NewTxnGen(0, tt, 0.5, 4, 2, zk)
+		for j := 0; j < 500; j++ {
+			q := gen.GenOneQuery()
+			_, err1 := wPlain.One(q)
+			_, err2 := w.One(q)
+			if err1 != err2 {
+				t.Errorf("Txn %v: query %v returns %v; %v without anti-caching", tt, j, err2, err1)
+			}
+		}
+
+		for i := int64(0); i < nKeys; i++ {
+			k := CKey(i)
+			p := hp.GetPartition(k)
+			r, rp := table.GetRecord(k, p), plain.GetRecord(k, p)
+			present := r != nil && !r.IsAbsent()
+			if (rp != nil && !rp.IsAbsent()) != present {
+				t.Errorf("Txn %v: key %v present %v with anti-caching", tt, i, present)
+				continue
+			}
+			if !present {
+				continue
+			}
+			tup := tupleOf(table.parts[p].ac, r)
+			if tup.String() != rp.Tuple().String() {
+				t.Errorf("Txn %v: key %v is %v; %v without anti-caching", tt, i, tup.String(), rp.Tuple().String())
+			}
+			if tt == LOOKUP_STRING {
+				found := false
+				for _, sk := range table.secIndexes[0].entry(tup.GetString(0), p).Keys() {
+					found = found || sk == k
+				}
+				if !found {
+					t.Errorf("Txn %v: key %v missing from secondary index", tt, i)
+				}
+			}
+		}
+
+		evicted, unevicted, _ := store.AntiCacheStats()
+		if evicted == 0 || unevicted == 0 || w.NStats[NEVICTRESTARTS] == 0 {
+			t.Errorf("Txn %v: evicted %v, unevicted %v, restarted %v", tt, evicted, unevicted, w.NStats[NEVICTRESTARTS])
+		}
+		if w.NStats[NTXN] != wPlain.NStats[NTXN] {
+			t.Errorf("Txn %v: counted %v transactions; %v without anti-caching", tt, w.NStats[NTXN], wPlain.NStats[NTXN])
+		}
+	}
+
+	// Concurrent workers fetch the same records
+	dir, err := ioutil.TempDir("", "ccanti")
+	if err != nil {
+		t.Fatalf("Create Temp Dir Error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	*AntiCacheDir = dir
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), hp, "")
+	for i := int64(0); i < nKeys; i++ {
+		k := CKey(i)
+		table.CreateKV(k, table.Schema.MakeTuple(int64(0)), hp.GetPartition(k))
+	}
+	nWorkers := 2
+	coord := NewCoordinator(nWorkers, store)
+	written := make([]int64, nWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			zk := NewZipfKey(n, nKeys, nParts, pKeysArray, 1, hp)
+			gen := NewTxnGen(n, ADD_ONE, 0, 4, 2, zk)
+			for j := 0; j < 500; j++ {
+				q := gen.GenOneQuery()
+				if _, err := coord.Workers[n].One(q); err == nil {
+					written[n] += int64(len(q.wKeys))
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	coord.Close()
+
+	var sum, total int64
+	for i := int64(0); i < nKeys; i++ {
+		k := CKey(i)
+		p := hp.GetPartition(k)
+		sum += tupleOf(table.parts[p].ac, table.GetRecord(k, p)).GetInt64(0)
+	}
+	for _, n := range written {
+		total += n
+	}
+	if sum != total {
+		t.Errorf("Sum of values %v; expected %v", sum, total)
+	}
+	coord.PrintStats(os.Stdout)
+
+	fmt.Println("=====================")
+	fmt.Println("Test Anti-Cache End")
+	fmt.Println("=====================")
+}
@@ -0,0 +1,341 @@
+package testbed
+
+import (
+	"sync/atomic"
+
+	"github.com/totemtang/cc-testbed/spinlock"
+)
+
+const (
+	BTREEORDER = 64 // max keys per node
+)
+
+// Inner nodes route k to children[i] with keys[i-1] <= k < keys[i].
+// Leaves hold records and are chained in key order by next.
+// Arrays have one spare slot so a node can overflow before splitting.
+// The version of a leaf is bumped by every insert, remove and split.
+type bnode struct {
+	lock     spinlock.RWSpinlock
+	leaf     bool
+	n        int
+	keys     [BTREEORDER + 1]Key
+	recs     [BTREEORDER + 1]Record
+	children [BTREEORDER + 2]*bnode
+	next     *bnode
+	version  uint64
+}
+
+func (n *bnode) Version() uint64 {
+	return atomic.LoadUint64(&n.version)
+}
+
+// First child which may hold k
+func (n *bnode) childIndex(k Key) int {
+	lo, hi := 0, n.n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if k < n.keys[mid] {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+// First slot with a key no smaller than k
+func (n *bnode) leafIndex(k Key) int {
+	lo, hi := 0, n.n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if n.keys[mid] < k {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+func (n *bnode) insertLeaf(i int, k Key, r Record) {
+	copy(n.keys[i+1:n.n+1], n.keys[i:n.n])
+	copy(n.recs[i+1:n.n+1], n.recs[i:n.n])
+	n.keys[i] = k
+	n.recs[i] = r
+	n.n++
+	atomic.AddUint64(&n.version, 1)
+}
+
+func (n *bnode) removeLeaf(i int) {
+	copy(n.keys[i:n.n-1], n.keys[i+1:n.n])
+	copy(n.recs[i:n.n-1], n.recs[i+1:n.n])
+	n.n--
+	n.keys[n.n] = ""
+	n.recs[n.n] = nil
+	atomic.AddUint64(&n.version, 1)
+}
+
+func (n *bnode) insertInner(k Key, right *bnode) {
+	i := n.childIndex(k)
+	copy(n.keys[i+1:n.n+1], n.keys[i:n.n])
+	copy(n.children[i+2:n.n+2], n.children[i+1:n.n+1])
+	n.keys[i] = k
+	n.children[i+1] = right
+	n.n++
+}
+
+// Move the upper half of n into a new right sibling; returns
+// the separator key and the sibling
+func (n *bnode) split() (Key, *bnode) {
+	right := &bnode{
+		leaf: n.leaf,
+	}
+	mid := n.n / 2
+	var sep Key
+	if n.leaf {
+		right.n = n.n - mid
+		copy(right.keys[:], n.keys[mid:n.n])
+		copy(right.recs[:], n.recs[mid:n.n])
+		for i := mid; i < n.n; i++ {
+			n.recs[i] = nil
+		}
+		right.next = n.next
+		n.next = right
+		sep = right.keys[0]
+		right.version = n.version
+		atomic.AddUint64(&n.version, 1)
+	} else {
+		sep = n.keys[mid]
+		right.n = n.n - mid - 1
+		copy(right.keys[:], n.keys[mid+1:n.n])
+		copy(right.children[:], n.children[mid+1:n.n+1])
+		for i := mid + 1; i <= n.n; i++ {
+			n.children[i] = nil
+		}
+	}
+	n.n = mid
+	return sep, right
+}
+
+// B+-tree with lock coupling. Readers hold at most two node locks,
+// a parent and a child, or a leaf and its successor during a scan.
+// Writers lock top-down and keep only ancestors a split may reach.
+type BTree struct {
+	padding1 [64]byte
+	lock     spinlock.RWSpinlock // guards root
+	root     *bnode
+	padding2 [64]byte
+}
+
+func NewBTree() *BTree {
+	return &BTree{
+		root: &bnode{leaf: true},
+	}
+}
+
+// Returns the leaf which may hold k, read locked
+func (t *BTree) findLeaf(k Key) *bnode {
+	t.lock.RLock()
+	n := t.root
+	n.lock.RLock()
+	t.lock.RUnlock()
+	for !n.leaf {
+		c := n.children[n.childIndex(k)]
+		c.lock.RLock()
+		n.lock.RUnlock()
+		n = c
+	}
+	return n
+}
+
+func (t *BTree) Get(k Key) Record {
+	n := t.findLeaf(k)
+	var r Record
+	i := n.leafIndex(k)
+	if i < n.n && n.keys[i] == k {
+		r = n.recs[i]
+	}
+	n.lock.RUnlock()
+	return r
+}
+
+func (t *BTree) Put(k Key, r Record) bool {
+	return t.PutNodes(k, r, nil)
+}
+
+func (t *BTree) PutNodes(k Key, r Record, nodeFn PutNodeFunc) bool {
+	var stack [16]*bnode
+	path := stack[:0]
+
+	t.lock.Lock()
+	rootLocked := true
+	n := t.root
+	n.lock.Lock()
+	path = append(path, n)
+	if n.n < BTREEORDER {
+		t.lock.Unlock()
+		rootLocked = false
+	}
+
+	for !n.leaf {
+		c := n.children[n.childIndex(k)]
+		c.lock.Lock()
+		if c.n < BTREEORDER {
+			// c absorbs a split below it
+			for _, a := range path {
+				a.lock.Unlock()
+			}
+			path = path[:0]
+			if rootLocked {
+				t.lock.Unlock()
+				rootLocked = false
+			}
+		}
+		path = append(path, c)
+		n = c
+	}
+
+	leaf := n
+	var before, after, sibVersion uint64
+	var sib *bnode
+
+	i := n.leafIndex(k)
+	ok := !(i < n.n && n.keys[i] == k)
+	if ok {
+		before = leaf.version
+		n.insertLeaf(i, k, r)
+
+		var sep Key
+		var right *bnode
+		for level := len(path) - 1; level >= 0; level-- {
+			p := path[level]
+			if right != nil {
+				p.insertInner(sep, right)
+				right = nil
+			}
+			if p.n <= BTREEORDER {
+				break
+			}
+			sep, right = p.split()
+			if p == leaf {
+				sib = right
+				sibVersion = right.version
+			}
+		}
+		after = leaf.version
+
+		// Only an unsafe root stays in path with the tree lock held
+		if right != nil {
+			root := &bnode{
+				n: 1,
+			}
+			root.keys[0] = sep
+			root.children[0] = path[0]
+			root.children[1] = right
+			t.root = root
+		}
+	}
+
+	for _, a := range path {
+		a.lock.Unlock()
+	}
+	if rootLocked {
+		t.lock.Unlock()
+	}
+
+	if ok && nodeFn != nil {
+		if sib != nil {
+			nodeFn(leaf, before, after, sib, sibVersion)
+		} else {
+			nodeFn(leaf, before, after, nil, 0)
+		}
+	}
+	return ok
+}
+
+// Nodes are not merged, so only the leaf is changed and
+// write locked; inner nodes are read locked on the way down
+func (t *BTree) Remove(k Key, r Record) bool {
+	t.lock.RLock()
+	n := t.root
+	if n.leaf {
+		n.lock.Lock()
+	} else {
+		n.lock.RLock()
+	}
+	t.lock.RUnlock()
+	for !n.leaf {
+		c := n.children[n.childIndex(k)]
+		if c.leaf {
+			c.lock.Lock()
+		} else {
+			c.lock.RLock()
+		}
+		n.lock.RUnlock()
+		n = c
+	}
+
+	i := n.leafIndex(k)
+	ok := i < n.n && n.keys[i] == k && n.recs[i] == r
+	if ok {
+		n.removeLeaf(i)
+	}
+	n.lock.Unlock()
+	return ok
+}
+
+// Each leaf is copied under its lock and visited after. Leaves are
+// never merged, so the next one stays reachable in between.
+func (t *BTree) ForEach(fn func(k Key, r Record) bool) {
+	var keys [BTREEORDER + 1]Key
+	var recs [BTREEORDER + 1]Record
+	n := t.findLeaf("")
+	for {
+		m := n.n
+		copy(keys[:m], n.keys[:m])
+		copy(recs[:m], n.recs[:m])
+		nx := n.next
+		n.lock.RUnlock()
+		for i := 0; i < m; i++ {
+			if !fn(keys[i], recs[i]) {
+				return
+			}
+		}
+		if nx == nil {
+			return
+		}
+		nx.lock.RLock()
+		n = nx
+	}
+}
+
+func (t *BTree) Scan(lo Key, hi Key, fn func(k Key, r Record) bool) {
+	t.ScanNodes(lo, hi, fn, nil)
+}
+
+// The leaves visited cover [lo, hi] unless fn stops the scan early:
+// the last one holds a key beyond hi or ends the chain
+func (t *BTree) ScanNodes(lo Key, hi Key, fn func(k Key, r Record) bool, nodeFn func(n IndexNode, version uint64)) {
+	n := t.findLeaf(lo)
+	i := n.leafIndex(lo)
+	for {
+		if nodeFn != nil {
+			nodeFn(n, n.version)
+		}
+		for ; i < n.n; i++ {
+			if n.keys[i] > hi || !fn(n.keys[i], n.recs[i]) {
+				n.lock.RUnlock()
+				return
+			}
+		}
+		nx := n.next
+		if nx == nil {
+			n.lock.RUnlock()
+			return
+		}
+		nx.lock.RLock()
+		n.lock.RUnlock()
+		n = nx
+		i = 0
+	}
+}
@@ -0,0 +1,218 @@
+package testbed
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestBTree(t *testing.T) {
+	fmt.Println("=================")
+	fmt.Println("Test BTree Begin")
+	fmt.Println("=================")
+
+	*SysType = PARTITION
+	bt := NewBTree()
+	nKeys := 20000
+
+	perm := rand.Perm(nKeys)
+	for _, i := range perm {
+		k := CKey(int64(i * 2))
+		if !bt.Put(k, MakeRecord(k, intSchema.MakeTuple(int64(i)))) {
+			t.Fatalf("Insert key %v fails", k)
+		}
+	}
+	if bt.Put(CKey(4), MakeRecord(CKey(4), intSchema.MakeTuple(int64(0)))) {
+		t.Errorf("Duplicate key 4 inserted")
+	}
+
+	for i := 0; i < nKeys; i++ {
+		r := bt.Get(CKey(int64(i * 2)))
+		if r == nil || r.Tuple().GetInt64(0) != int64(i) {
+			t.Fatalf("Get key %v fails", i*2)
+		}
+		if bt.Get(CKey(int64(i*2+1))) != nil {
+			t.Fatalf("Get absent key %v succeeds", i*2+1)
+		}
+	}
+
+	// Odd bounds fall between keys
+	var last Key = CKey(-1)
+	count := 0
+	bt.Scan(CKey(101), CKey(2001), func(k Key, r Record) bool {
+		if k <= last || k < CKey(101) || k > CKey(2001) {
+			t.Errorf("Scan returns key %v after %v", k, last)
+		}
+		last = k
+		count++
+		return true
+	})
+	if count != 950 {
+		t.Errorf("Scan returns %v keys; expected 950", count)
+	}
+
+	count = 0
+	bt.Scan(CKey(0), CKey(int64(2*nKeys)), func(k Key, r Record) bool {
+		count++
+		return count < 10
+	})
+	if count != 10 {
+		t.Errorf("Scan does not stop early")
+	}
+
+	fmt.Println("===============")
+	fmt.Println("Test BTree End")
+	fmt.Println("===============")
+}
+
+func TestBTreeConcurrent(t *testing.T) {
+	fmt.Println("===========================")
+	fmt.Println("Test BTree Concurrent Begin")
+	fmt.Println("===========================")
+
+	*SysType = PARTITION
+	bt := NewBTree()
+	nWorkers := 4
+	nKeys := 20000
+
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			for j := 0; j < nKeys; j++ {
+				k := CKey(int64(j*nWorkers + n))
+				bt.Put(k, MakeRecord(k, intSchema.MakeTuple(int64(n))))
+			}
+			wg.Done()
+		}(i)
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 100; j++ {
+				var last Key = CKey(-1)
+				bt.Scan(CKey(0), CKey(int64(nKeys*nWorkers)), func(k Key, r Record) bool {
+					if k <= last {
+						t.Errorf("Scan out of order %v after %v", k, last)
+					}
+					last = k
+					return true
+				})
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	bt.Scan(CKey(0), CKey(int64(nKeys*nWorkers)), func(k Key, r Record) bool {
+		if k != CKey(int64(count)) {
+			t.Fatalf("Scan returns %v; expected %v", k, count)
+		}
+		count++
+		return true
+	})
+	if count != nKeys*nWorkers {
+		t.Errorf("Tree holds %v keys; expected %v", count, nKeys*nWorkers)
+	}
+
+	fmt.Println("=========================")
+	fmt.Println("Test BTree Concurrent End")
+	fmt.Println("=========================")
+}
+
+func TestScanPhantom(t *testing.T) {
+	fmt.Println("=========================")
+	fmt.Println("Test Scan Phantom Begin")
+	fmt.Println("=========================")
+
+	*SysType = OCC
+	*PhyPart = false
+	*IndexType = "btree"
+	defer func() {
+		*IndexType = ""
+	}()
+
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+	for i := int64(0); i < 1000; i++ {
+		table.CreateKV(CKey(i*2), table.Schema.MakeTuple(int64(i)), 0)
+	}
+	w := NewWorker(0, store)
+	tx := w.E
+
+	// Insert into a leaf far from the scanned range
+	tx.Reset(nil)
+	recs, err := tx.Scan(table, CKey(10), CKey(20), 0)
+	if err != nil || len(recs) != 6 {
+		t.Fatalf("Scan returns %v records, error %v", len(recs), err)
+	}
+	table.CreateKV(CKey(1501), table.Schema.MakeTuple(int64(0)), 0)
+	if tx.Commit() == 0 {
+		t.Errorf("Commit fails without phantom")
+	}
+
+	// Insert into the scanned range
+	tx.Reset(nil)
+	tx.Scan(table, CKey(10), CKey(20), 0)
+	table.CreateKV(CKey(15), table.Schema.MakeTuple(int64(0)), 0)
+	if tx.Commit() != 0 {
+		t.Errorf("Commit succeeds with phantom")
+	}
+	if w.NStats[NPHANTOMABORTS] != 1 {
+		t.Errorf("Expect 1 phantom abort, got %v", w.NStats[NPHANTOMABORTS])
+	}
+
+	fmt.Println("=======================")
+	fmt.Println("Test Scan Phantom End")
+	fmt.Println("=======================")
+}
+
+func TestScanPartitions(t *testing.T) {
+	fmt.Println("===========================")
+	fmt.Println("Test Scan Partitions Begin")
+	fmt.Println("===========================")
+
+	*SysType = PARTITION
+	*IndexType = "btree"
+	defer func() {
+		*IndexType = ""
+	}()
+	nParts := 4
+	*NumPart = nParts
+	nKeys := int64(1000)
+
+	// Scans cover ScanLen keys however the keys are spread
+	for _, p := range []Partitioner{
+		&HashPartitioner{NParts: int64(nParts), NKeys: nKeys},
+		NewRangePartitioner(nParts, nKeys, nil),
+	} {
+		store := NewStore()
+		table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), p, "")
+		pKeysArray := LoadTable(table, nKeys, 1, 0)
+		w := NewWorker(0, store)
+		zk := NewZipfKey(0, nKeys, nParts, pKeysArray, 1, p)
+		g := NewTxnGen(0, SCAN_INT, 50, 8, 1, zk)
+		for i := 0; i < 200; i++ {
+			q := g.GenOneQuery()
+			var expected int64
+			for _, k := range q.rKeys {
+				n := nKeys - ParseKey(k)
+				if n > int64(*ScanLen) {
+					n = int64(*ScanLen)
+				}
+				expected += n
+			}
+			r, err := w.One(q)
+			if err != nil {
+				t.Fatalf("Scan fails with %v", err)
+			}
+			if n := len(r.V.(*RetIntValue).intVals); int64(n) != expected {
+				t.Errorf("Scans of %v return %v records; expected %v", q.rKeys, n, expected)
+			}
+		}
+	}
+
+	fmt.Println("=========================")
+	fmt.Println("Test Scan Partitions End")
+	fmt.Println("=========================")
+}
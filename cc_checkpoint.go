@@ -0,0 +1,578 @@
+package testbed
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var CkptDir = flag.String("ckptdir", "", "Directory of checkpoints; empty disables checkpointing")
+var CkptInterval = flag.Duration("ckptinterval", 10*time.Second, "Interval between checkpoints")
+
+const (
+	CKPTBATCH = 256 // Records copied per partition lock in partition mode
+)
+
+// A checkpoint is a directory ckpt-<n> with a file table-<id>-part-<p>
+// for each partition of each table, and a file meta written last.
+// A partition file holds records [keylen uint16][key][tid uint64]
+// [absent uint8], followed by the values of all columns unless
+// absent, encoded as in the commit log. meta is [start epoch uint64]
+// [end epoch uint64][nTables uint32] and [nParts uint32] per table;
+// with command logging, the epochs are the numbers of commands.
+//
+// Records are copied one by one while transactions run, each as of
+// its last commit. Replaying the log records from the start epoch
+// on, in TID order and over records older than them, then gives a
+// consistent state. The checkpoint is complete once all commits it
+// may hold are durable.
+type Checkpointer struct {
+	padding1     [64]byte
+	s            *Store
+	dir          string
+	logs         []*CommitLog
+	el           *EpochLogger
+	seq          int
+	stop         chan bool
+	done         chan bool
+	NCheckpoints int64
+	NRecords     int64
+	NBytes       int64
+	NTime        time.Duration
+	padding2     [64]byte
+}
+
+// logs and el may be nil without a commit log or the epoch logger
+func NewCheckpointer(s *Store, dir string, logs []*CommitLog, el *EpochLogger) *Checkpointer {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		clog.Error("Create Checkpoint Directory Error %s\n", err.Error())
+	}
+	return &Checkpointer{
+		s:    s,
+		dir:  dir,
+		logs: logs,
+		el:   el,
+		seq:  latestCheckpoint(dir),
+	}
+}
+
+// Start takes a checkpoint every interval until Stop
+func (c *Checkpointer) Start(interval time.Duration) {
+	c.stop = make(chan bool)
+	c.done = make(chan bool)
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-c.stop:
+				close(c.done)
+				return
+			case <-tick.C:
+				c.Checkpoint()
+			}
+		}
+	}()
+}
+
+// Stop waits for a running checkpoint to complete
+func (c *Checkpointer) Stop() {
+	if c.stop != nil {
+		c.stop <- true
+		<-c.done
+		c.stop = nil
+	}
+}
+
+// Checkpoint writes all partitions in parallel and removes the
+// previous checkpoint once done
+func (c *Checkpointer) Checkpoint() {
+	tm := time.Now()
+	start := c.epoch()
+	startSeq := atomic.LoadUint64(&c.s.cmdSeq)
+	c.seq++
+	path := filepath.Join(c.dir, fmt.Sprintf("ckpt-%d", c.seq))
+	if err := os.MkdirAll(path, 0700); err != nil {
+		clog.Error("Create Checkpoint Directory Error %s\n", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	var nRecords, nBytes int64
+	for _, t := range c.s.tables {
+		for p := range t.parts {
+			wg.Add(1)
+			go func(t *Table, p int) {
+				n, b := c.writePartition(path, t, p)
+				atomic.AddInt64(&nRecords, n)
+				atomic.AddInt64(&nBytes, b)
+				wg.Done()
+			}(t, p)
+		}
+	}
+	wg.Wait()
+
+	end := c.epoch()
+	c.waitDurable(end)
+	if *CmdLog {
+		// Commands replay from a checkpoint taken between transactions
+		start, end = startSeq, atomic.LoadUint64(&c.s.cmdSeq)
+	}
+
+	var meta []byte
+	meta = appendUint64(meta, start)
+	meta = appendUint64(meta, end)
+	meta = appendUint32(meta, uint32(len(c.s.tables)))
+	for _, t := range c.s.tables {
+		meta = appendUint32(meta, uint32(len(t.parts)))
+	}
+	writeFileSync(filepath.Join(path, "meta"), meta)
+	if c.seq > 1 {
+		os.RemoveAll(filepath.Join(c.dir, fmt.Sprintf("ckpt-%d", c.seq-1)))
+	}
+
+	c.NCheckpoints++
+	c.NRecords += nRecords
+	c.NBytes += nBytes
+	c.NTime += time.Since(tm)
+}
+
+func (c *Checkpointer) epoch() uint64 {
+	if c.el == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.el.epoch)
+}
+
+// Wait until the commits copied are durable: those of epochs up to
+// end with the epoch logger, or else all records ended so far
+func (c *Checkpointer) waitDurable(end uint64) {
+	if c.el != nil {
+		for c.el.Durable() < end {
+			time.Sleep(time.Millisecond)
+		}
+		return
+	}
+	for _, l := range c.logs {
+		l.mu.Lock()
+		lsn := l.lsn
+		l.mu.Unlock()
+		l.WaitDurable(lsn)
+	}
+}
+
+// Returns the number of records and bytes written
+func (c *Checkpointer) writePartition(path string, t *Table, p int) (int64, int64) {
+	name := filepath.Join(path, fmt.Sprintf("table-%d-part-%d", t.ID, p))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		clog.Error("Open Checkpoint File Error %s\n", err.Error())
+	}
+	bw := bufio.NewWriterSize(f, LOGBUFSIZE)
+
+	// Workers of partition mode change hash indexes under the
+	// partition lock
+	index := t.parts[p].index
+	var keys []Key
+	var recs []Record
+	if *SysType == PARTITION {
+		c.s.locks[p].Lock()
+	}
+	index.ForEach(func(k Key, r Record) bool {
+		keys = append(keys, k)
+		recs = append(recs, r)
+		return true
+	})
+	if *SysType == PARTITION {
+		c.s.locks[p].Unlock()
+	}
+
+	tup := t.Schema.NewTuple()
+	var b []byte
+	var n, size int64
+	for i := 0; i < len(keys); i += CKPTBATCH {
+		hi := i + CKPTBATCH
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		b = b[:0]
+		if *SysType == PARTITION {
+			c.s.locks[p].Lock()
+		}
+		for j := i; j < hi; j++ {
+			tid, absent, ok := snapshot(t.parts[p], keys[j], recs[j], tup)
+			if !ok {
+				continue
+			}
+			b = appendUint16(b, uint16(len(keys[j])))
+			b = append(b, keys[j]...)
+			b = appendUint64(b, uint64(tid))
+			if absent {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+				b = appendTuple(b, tup)
+			}
+			n++
+		}
+		if *SysType == PARTITION {
+			c.s.locks[p].Unlock()
+		}
+		if _, err := bw.Write(b); err != nil {
+			clog.Error("Write Checkpoint Error %s\n", err.Error())
+		}
+		size += int64(len(b))
+	}
+
+	if err := bw.Flush(); err != nil {
+		clog.Error("Write Checkpoint Error %s\n", err.Error())
+	}
+	if err := f.Sync(); err != nil {
+		clog.Error("Sync Checkpoint Error %s\n", err.Error())
+	}
+	f.Close()
+	return n, size
+}
+
+// Copies r into tup as of its last commit; returns its TID, whether
+// it is absent, and false if it was unlinked from index meanwhile.
+// In partition mode the caller holds the partition lock.
+func snapshot(part *Partition, k Key, r Record, tup *Tuple) (TID, bool, bool) {
+	index := part.index
+	switch *SysType {
+	case OCC:
+		// Copied under the record lock rather than validated by the
+		// TID afterwards: commits write the tuple in place, so an
+		// optimistic copy would race with them. Commits meeting the
+		// lock abort as on any other locked record.
+		for {
+			if ok, tid := r.Lock(); ok {
+				absent := r.IsAbsent()
+				if !absent {
+					tup.CopyFrom(r.Tuple())
+				}
+				r.Unlock(tid)
+				return tid, absent, true
+			} else if index.Get(k) != r {
+				return 0, false, false
+			}
+			runtime.Gosched()
+		}
+	case LOCKING:
+		lr := r.(*LRecord)
+		for !lr.RLock() {
+			if index.Get(k) != r {
+				return 0, false, false
+			}
+			runtime.Gosched()
+		}
+		absent := lr.absent
+		if !absent {
+			tup.CopyFrom(&lr.tuple)
+		}
+		tid := lr.last
+		lr.RUnlock()
+		return tid, absent, true
+	}
+	if index.Get(k) != r {
+		return 0, false, false
+	}
+	absent := r.IsAbsent()
+	if !absent {
+		tup.CopyFrom(tupleOf(part.ac, r))
+	}
+	return r.GetTID(), absent, true
+}
+
+// Returns the sequence number of the latest complete checkpoint
+// under dir; 0 if there is none
+func latestCheckpoint(dir string) int {
+	names, _ := filepath.Glob(filepath.Join(dir, "ckpt-*"))
+	latest := 0
+	for _, name := range names {
+		seq, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(name), "ckpt-"))
+		if err != nil || seq <= latest {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(name, "meta")); err == nil {
+			latest = seq
+		}
+	}
+	return latest
+}
+
+func writeFileSync(name string, b []byte) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		clog.Error("Open File Error %s\n", err.Error())
+	}
+	if _, err := f.Write(b); err != nil {
+		clog.Error("Write File Error %s\n", err.Error())
+	}
+	if err := f.Sync(); err != nil {
+		clog.Error("Sync File Error %s\n", err.Error())
+	}
+	f.Close()
+}
+
+type RecoveryStats struct {
+	NCkptRecords int64
+	NLogRecords  int64 // Commit records replayed
+	NLogEntries  int64
+	LoadTime     time.Duration
+	ReplayTime   time.Duration
+}
+
+type logEntry struct {
+	table int
+	part  int
+	k     Key
+	kind  byte
+	col   int
+	v     Value
+	tup   *Tuple
+}
+
+type logRecord struct {
+	tid     TID
+	entries []logEntry
+}
+
+// Recover fills s from the latest complete checkpoint under ckptDir
+// and the commit logs in logDir; either may be empty. The tables of
+// s must be created as when the checkpoint and logs were written,
+// and hold no records.
+func Recover(s *Store, ckptDir string, logDir string) *RecoveryStats {
+	rs := &RecoveryStats{}
+	tm := time.Now()
+	var start, end uint64
+	if ckptDir != "" {
+		if seq := latestCheckpoint(ckptDir); seq > 0 {
+			start, end = loadCheckpoint(s, filepath.Join(ckptDir, fmt.Sprintf("ckpt-%d", seq)), rs)
+		}
+	}
+	rs.LoadTime = time.Since(tm)
+
+	tm = time.Now()
+	if *CmdLog {
+		// Replayed transactions maintain secondary indexes
+		if start != end {
+			clog.Error("Command Replay Needs a Checkpoint Taken between Transactions")
+		}
+		scanTables(s, true)
+		if logDir != "" {
+			replayCommands(s, logDir, start, rs)
+		}
+		scanTables(s, false)
+	} else {
+		if logDir != "" {
+			recs := readLogs(s, logDir, start)
+			sort.Slice(recs, func(i, j int) bool {
+				return recs[i].tid < recs[j].tid
+			})
+			for i := range recs {
+				replay(s, &recs[i])
+				rs.NLogEntries += int64(len(recs[i].entries))
+			}
+			rs.NLogRecords = int64(len(recs))
+		}
+		scanTables(s, true)
+	}
+	rs.ReplayTime = time.Since(tm)
+	return rs
+}
+
+// Counts the keys present and, if sec, fills secondary indexes
+func scanTables(s *Store, sec bool) {
+	for _, t := range s.tables {
+		t.nKeys = 0
+		for p, part := range t.parts {
+			part.index.ForEach(func(k Key, r Record) bool {
+				if !r.IsAbsent() {
+					t.nKeys++
+					if sec && len(t.secIndexes) > 0 {
+						t.secChanges(k, p, -1, nil, attrOf(r.Tuple()), applySec)
+					}
+				}
+				return true
+			})
+		}
+	}
+}
+
+// Loads all partitions in parallel; returns the start and end in meta
+func loadCheckpoint(s *Store, path string, rs *RecoveryStats) (uint64, uint64) {
+	b, err := ioutil.ReadFile(filepath.Join(path, "meta"))
+	if err != nil {
+		clog.Error("Read Checkpoint Error %s\n", err.Error())
+	}
+	meta := &logReader{b: b}
+	start := meta.uint64()
+	end := meta.uint64()
+	if int(meta.uint32()) != len(s.tables) {
+		clog.Error("Checkpoint %s Has Other Tables", path)
+	}
+	for _, t := range s.tables {
+		if int(meta.uint32()) != len(t.parts) {
+			clog.Error("Checkpoint %s Has Other Partitions of Table %s", path, t.Name)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range s.tables {
+		for p := range t.parts {
+			wg.Add(1)
+			go func(t *Table, p int) {
+				n := loadPartition(path, t, p)
+				atomic.AddInt64(&rs.NCkptRecords, n)
+				wg.Done()
+			}(t, p)
+		}
+	}
+	wg.Wait()
+	return start, end
+}
+
+func loadPartition(path string, t *Table, p int) int64 {
+	name := filepath.Join(path, fmt.Sprintf("table-%d-part-%d", t.ID, p))
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		clog.Error("Read Checkpoint Error %s\n", err.Error())
+	}
+	index := t.parts[p].index
+	r := &logReader{b: b}
+	var n int64
+	for r.pos < len(b) {
+		k := r.key()
+		tid := TID(r.uint64())
+		absent := r.uint8() == 1
+		var tup *Tuple
+		if absent {
+			tup = t.Schema.NewTuple()
+		} else {
+			tup = r.tuple(t.Schema)
+		}
+		if r.short {
+			clog.Error("Checkpoint File %s Is Truncated", name)
+		}
+		rec := MakeRecord(k, tup)
+		rec.SetAbsent(absent)
+		rec.SetTID(tid)
+		if !index.Put(k, rec) {
+			clog.Error("Checkpoint File %s Has Key %v Twice", name, k)
+		}
+		n++
+	}
+	return n
+}
+
+// Reads the commit records of epochs from start on which are
+// durable. A record cut short by a crash ends a log.
+func readLogs(s *Store, logDir string, start uint64) []logRecord {
+	durable := uint64(math.MaxUint64)
+	if b, err := ioutil.ReadFile(filepath.Join(logDir, "epoch")); err == nil && len(b) == 8 {
+		durable = (&logReader{b: b}).uint64()
+	}
+
+	names, _ := filepath.Glob(filepath.Join(logDir, "worker-*.log"))
+	var recs []logRecord
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			clog.Error("Read Log Error %s\n", err.Error())
+		}
+		r := &logReader{b: b}
+		for r.pos < len(b) {
+			rec, epoch := r.record(s)
+			if r.short {
+				break
+			}
+			if epoch >= start && epoch <= durable {
+				recs = append(recs, rec)
+			}
+		}
+	}
+	return recs
+}
+
+// Decodes the next commit record and returns it with its epoch;
+// sets short if it is cut off
+func (r *logReader) record(s *Store) (logRecord, uint64) {
+	rec := logRecord{
+		tid: TID(r.uint64()),
+	}
+	epoch := r.uint64()
+	n := int(r.uint32())
+	rec.entries = make([]logEntry, n)
+	for i := 0; i < n && !r.short; i++ {
+		e := &rec.entries[i]
+		e.table = int(r.uint16())
+		e.part = int(r.uint16())
+		e.k = r.key()
+		e.kind = r.uint8()
+		if r.short || e.table >= len(s.tables) {
+			r.short = true
+			break
+		}
+		sch := s.tables[e.table].Schema
+		switch e.kind {
+		case LOGUPDATE:
+			e.col = int(r.uint16())
+			if e.col < sch.NCols() {
+				e.v = r.value(sch.Columns[e.col].Type)
+			}
+		case LOGINSERT:
+			e.tup = r.tuple(sch)
+		}
+	}
+	return rec, epoch
+}
+
+// Applies the entries of rec to records it is newer than; entries
+// of one record come in the order they were written
+func replay(s *Store, rec *logRecord) {
+	for i := range rec.entries {
+		e := &rec.entries[i]
+		t := s.tables[e.table]
+		index := t.parts[e.part].index
+		r := index.Get(e.k)
+		if r != nil && r.GetTID() > rec.tid {
+			continue
+		}
+		switch e.kind {
+		case LOGINSERT:
+			if r == nil {
+				r = MakeRecord(e.k, e.tup)
+				index.Put(e.k, r)
+			} else {
+				r.SetTuple(e.tup)
+				r.SetAbsent(false)
+			}
+		case LOGUPDATE:
+			if r == nil {
+				clog.Error("Log Updates Key %v of Table %s Never Inserted", e.k, t.Name)
+			}
+			r.SetColumn(e.col, e.v)
+		case LOGDELETE:
+			if r == nil {
+				continue
+			}
+			r.SetAbsent(true)
+		default:
+			clog.Error("Log Entry Kind %v Not Supported", e.kind)
+		}
+		r.SetTID(rec.tid)
+	}
+}
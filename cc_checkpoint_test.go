@@ -0,0 +1,127 @@
+package testbed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckpointRecovery(t *testing.T) {
+	fmt.Println("===============================")
+	fmt.Println("Test Checkpoint Recovery Begin")
+	fmt.Println("===============================")
+
+	defer func() {
+		*SysType = PARTITION
+		*LogDir = ""
+		*LogEpoch = 0
+		*CkptDir = ""
+		*IndexType = ""
+	}()
+
+	nKeys := int64(8)
+	insKeys := make([]Key, 4)
+	insVals := make([]int64, len(insKeys))
+	for i := range insKeys {
+		insKeys[i] = CKey(nKeys + int64(i))
+		insVals[i] = int64(i)
+	}
+
+	for _, sys := range []int{PARTITION, OCC, LOCKING} {
+		for _, epoch := range []time.Duration{0, time.Millisecond} {
+			*SysType = sys
+			*NumPart = 1
+			logDir, err := ioutil.TempDir("", "cclog")
+			if err != nil {
+				t.Fatalf("Create Temp Dir Error %s", err.Error())
+			}
+			defer os.RemoveAll(logDir)
+			ckptDir, err := ioutil.TempDir("", "ccckpt")
+			if err != nil {
+				t.Fatalf("Create Temp Dir Error %s", err.Error())
+			}
+			defer os.RemoveAll(ckptDir)
+			*LogDir = logDir
+			*LogEpoch = epoch
+			*CkptDir = ckptDir
+			*CkptInterval = time.Hour
+
+			store := NewStore()
+			table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+			for i := int64(0); i < nKeys; i++ {
+				table.CreateKV(CKey(i), table.Schema.MakeTuple(int64(0)), 0)
+			}
+			for i, k := range insKeys {
+				table.CreateKV(k, table.Schema.MakeTuple(insVals[i]), 0)
+			}
+
+			nWorkers := 3
+			coord := NewCoordinator(nWorkers, store)
+			var wg sync.WaitGroup
+			for i := 0; i < nWorkers; i++ {
+				wg.Add(1)
+				go func(n int) {
+					w := coord.Workers[n]
+					q := &Query{
+						TXN:         ADD_ONE,
+						accessParts: []int{0},
+						wKeys:       []Key{CKey(int64(n) % nKeys), CKey(int64(n+3) % nKeys)},
+					}
+					if n == nWorkers-1 {
+						// Deletes and inserts the same keys in turn
+						q = &Query{
+							TXN:         INSERT_DELETE_INT,
+							accessParts: []int{0},
+							wKeys:       insKeys,
+							wValue:      &SingleIntValue{intVals: insVals},
+						}
+					}
+					for j := 0; j < 301; j++ {
+						w.One(q)
+						time.Sleep(10 * time.Microsecond)
+					}
+					wg.Done()
+				}(i)
+			}
+			for i := 0; i < 3; i++ {
+				coord.ckpt.Checkpoint()
+			}
+			wg.Wait()
+			coord.Close()
+
+			recovered := NewStore()
+			rt := recovered.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+			rs := Recover(recovered, ckptDir, logDir)
+			if rs.NCkptRecords == 0 {
+				t.Errorf("Mode %v epoch %v: no checkpoint loaded", sys, epoch)
+			}
+
+			for i := int64(0); i < nKeys+int64(len(insKeys)); i++ {
+				k := CKey(i)
+				r, rr := table.GetRecord(k, 0), rt.GetRecord(k, 0)
+				present := r != nil && !r.IsAbsent()
+				if rr == nil || rr.IsAbsent() {
+					if present {
+						t.Errorf("Mode %v epoch %v: key %v not recovered", sys, epoch, i)
+					}
+					continue
+				}
+				if !present {
+					t.Errorf("Mode %v epoch %v: key %v recovered though deleted", sys, epoch, i)
+				} else if v, rv := r.Tuple().GetInt64(0), rr.Tuple().GetInt64(0); v != rv {
+					t.Errorf("Mode %v epoch %v: key %v recovered as %v; expected %v", sys, epoch, i, rv, v)
+				}
+			}
+			if rt.nKeys != table.nKeys-int64(len(insKeys)) {
+				t.Errorf("Mode %v epoch %v: recovered %v keys; expected %v", sys, epoch, rt.nKeys, table.nKeys-int64(len(insKeys)))
+			}
+		}
+	}
+
+	fmt.Println("=============================")
+	fmt.Println("Test Checkpoint Recovery End")
+	fmt.Println("=============================")
+}
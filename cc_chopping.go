@@ -0,0 +1,374 @@
+package testbed
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+var ChopTxn = flag.Bool("chop", false, "Execute transactions as the finest safe chopping of their declared pieces")
+var ROKeys = flag.Int64("rokeys", 0, "Int keys below this are read by transactions but never written")
+
+const (
+	MAXENUMPIECES = 12
+)
+
+// A piece runs part of a transaction without committing it
+type PieceFunc func(q *Query, tx ETransaction, piece int) error
+
+// Read and write sets name the data a piece may touch, e.g. a table.
+// MayAbort marks pieces which can roll back for other reasons than
+// concurrency control; a safe chopping keeps them in its first piece.
+type PieceDecl struct {
+	Name     string
+	ReadSet  []string
+	WriteSet []string
+	MayAbort bool
+}
+
+type TxnDecl struct {
+	TXN    int
+	Name   string
+	Pieces []PieceDecl
+	Piece  PieceFunc
+}
+
+// A chopping groups consecutive declared pieces; group i covers
+// pieces Bounds[i] up to Bounds[i+1]-1
+type Chopping struct {
+	TXN    int
+	Bounds []int
+	nPiece int
+}
+
+func (c *Chopping) NGroups() int {
+	return len(c.Bounds)
+}
+
+func (c *Chopping) Group(i int) (int, int) {
+	if i+1 < len(c.Bounds) {
+		return c.Bounds[i], c.Bounds[i+1]
+	}
+	return c.Bounds[i], c.nPiece
+}
+
+func (c *Chopping) String() string {
+	s := ""
+	for i := 0; i < c.NGroups(); i++ {
+		lo, hi := c.Group(i)
+		s += fmt.Sprintf("[%v-%v]", lo, hi-1)
+	}
+	return s
+}
+
+func wholeChopping(d *TxnDecl) *Chopping {
+	return &Chopping{
+		TXN:    d.TXN,
+		Bounds: []int{0},
+		nPiece: len(d.Pieces),
+	}
+}
+
+func finestChopping(d *TxnDecl) *Chopping {
+	c := &Chopping{
+		TXN:    d.TXN,
+		Bounds: make([]int, len(d.Pieces)),
+		nPiece: len(d.Pieces),
+	}
+	for i := range c.Bounds {
+		c.Bounds[i] = i
+	}
+	return c
+}
+
+type scNode struct {
+	decl     int
+	instance int
+	group    int
+	readSet  map[string]bool
+	writeSet map[string]bool
+}
+
+// SC-graph of a set of chopped transactions. Every transaction type
+// appears twice, as two instances of one type may run concurrently.
+// Pieces of one instance are linked by S-edges; pieces of different
+// instances which conflict are linked by C-edges.
+type SCGraph struct {
+	nodes  []scNode
+	sEdges [][2]int
+	cEdges [][2]int
+}
+
+func BuildSCGraph(decls []*TxnDecl, chops []*Chopping) *SCGraph {
+	g := &SCGraph{}
+	for i, d := range decls {
+		c := chops[i]
+		for inst := 0; inst < 2; inst++ {
+			first := len(g.nodes)
+			for j := 0; j < c.NGroups(); j++ {
+				n := scNode{
+					decl:     i,
+					instance: inst,
+					group:    j,
+					readSet:  make(map[string]bool),
+					writeSet: make(map[string]bool),
+				}
+				lo, hi := c.Group(j)
+				for _, p := range d.Pieces[lo:hi] {
+					for _, r := range p.ReadSet {
+						n.readSet[r] = true
+					}
+					for _, w := range p.WriteSet {
+						n.writeSet[w] = true
+					}
+				}
+				for k := first; k < len(g.nodes); k++ {
+					g.sEdges = append(g.sEdges, [2]int{k, len(g.nodes)})
+				}
+				g.nodes = append(g.nodes, n)
+			}
+		}
+	}
+
+	for i := range g.nodes {
+		for j := i + 1; j < len(g.nodes); j++ {
+			a, b := &g.nodes[i], &g.nodes[j]
+			if a.decl == b.decl && a.instance == b.instance {
+				continue
+			}
+			if conflict(a, b) {
+				g.cEdges = append(g.cEdges, [2]int{i, j})
+			}
+		}
+	}
+	return g
+}
+
+func conflict(a, b *scNode) bool {
+	for w := range a.writeSet {
+		if b.readSet[w] || b.writeSet[w] {
+			return true
+		}
+	}
+	for w := range b.writeSet {
+		if a.readSet[w] {
+			return true
+		}
+	}
+	return false
+}
+
+// SCCycle reports whether the graph has a cycle with both S- and
+// C-edges. Since the pieces of one instance are pairwise S-linked,
+// there is such a cycle iff two pieces of one instance are still
+// connected once that instance's own S-edges are removed.
+func (g *SCGraph) SCCycle() (bool, int) {
+	for i := range g.nodes {
+		n := &g.nodes[i]
+		if n.group != 0 || n.instance != 0 {
+			continue
+		}
+		comp := g.components(n.decl, n.instance)
+		seen := make(map[int]bool)
+		for j := range g.nodes {
+			m := &g.nodes[j]
+			if m.decl != n.decl || m.instance != n.instance {
+				continue
+			}
+			if seen[comp[j]] {
+				return true, n.decl
+			}
+			seen[comp[j]] = true
+		}
+	}
+	return false, -1
+}
+
+// Connected components ignoring S-edges within the given instance
+func (g *SCGraph) components(decl int, inst int) []int {
+	parent := make([]int, len(g.nodes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(x int) int
+	find = func(x int) int {
+		if parent[x] != x {
+			parent[x] = find(parent[x])
+		}
+		return parent[x]
+	}
+	for _, e := range g.sEdges {
+		a := &g.nodes[e[0]]
+		if a.decl == decl && a.instance == inst {
+			continue
+		}
+		parent[find(e[0])] = find(e[1])
+	}
+	for _, e := range g.cEdges {
+		parent[find(e[0])] = find(e[1])
+	}
+	comp := make([]int, len(g.nodes))
+	for i := range comp {
+		comp[i] = find(i)
+	}
+	return comp
+}
+
+// IsSafe reports whether chops is a correct chopping: it has no
+// SC-cycle and only the first piece of a transaction may roll back
+func IsSafe(decls []*TxnDecl, chops []*Chopping) bool {
+	for i, d := range decls {
+		if chops[i].NGroups() > 1 {
+			_, hi := chops[i].Group(0)
+			for _, p := range d.Pieces[hi:] {
+				if p.MayAbort {
+					return false
+				}
+			}
+		}
+	}
+	cycle, _ := BuildSCGraph(decls, chops).SCCycle()
+	return !cycle
+}
+
+// FinestChopping computes the finest chopping of each transaction
+// with all others left whole; their union is the finest safe chopping
+// of the whole set
+func FinestChopping(decls []*TxnDecl) []*Chopping {
+	ret := make([]*Chopping, len(decls))
+	chops := make([]*Chopping, len(decls))
+	for i, d := range decls {
+		chops[i] = wholeChopping(d)
+	}
+
+	for i, d := range decls {
+		if len(d.Pieces) <= 1 {
+			ret[i] = wholeChopping(d)
+			continue
+		}
+		chops[i] = finestChopping(d)
+		g := BuildSCGraph(decls, chops)
+		comp := g.components(i, 0)
+		chops[i] = wholeChopping(d)
+
+		// Pieces connected through other transactions are merged,
+		// along with everything between them
+		first := make(map[int]int)
+		last := make(map[int]int)
+		for j := range g.nodes {
+			n := &g.nodes[j]
+			if n.decl != i || n.instance != 0 {
+				continue
+			}
+			if _, ok := first[comp[j]]; !ok {
+				first[comp[j]] = n.group
+			}
+			last[comp[j]] = n.group
+		}
+		reach := make([]int, len(d.Pieces))
+		for p := range reach {
+			reach[p] = p
+		}
+		for c, lo := range first {
+			if last[c] > reach[lo] {
+				reach[lo] = last[c]
+			}
+		}
+		for p, mp := range d.Pieces {
+			if mp.MayAbort {
+				reach[0] = maxInt(reach[0], p)
+			}
+		}
+
+		c := &Chopping{
+			TXN:    d.TXN,
+			nPiece: len(d.Pieces),
+		}
+		end := -1
+		for p := range d.Pieces {
+			if p > end {
+				c.Bounds = append(c.Bounds, p)
+			}
+			if reach[p] > end {
+				end = reach[p]
+			}
+		}
+		ret[i] = c
+	}
+	return ret
+}
+
+// SafeChoppings enumerates all choppings of decls[i] and returns
+// those which are safe with all other transactions left whole
+func SafeChoppings(decls []*TxnDecl, i int) []*Chopping {
+	d := decls[i]
+	n := len(d.Pieces)
+	if n > MAXENUMPIECES {
+		return nil
+	}
+	chops := make([]*Chopping, len(decls))
+	for j, dj := range decls {
+		chops[j] = wholeChopping(dj)
+	}
+
+	var ret []*Chopping
+	for mask := 0; mask < 1<<uint(n-1); mask++ {
+		c := &Chopping{
+			TXN:    d.TXN,
+			Bounds: []int{0},
+			nPiece: n,
+		}
+		for p := 1; p < n; p++ {
+			if mask&(1<<uint(p-1)) != 0 {
+				c.Bounds = append(c.Bounds, p)
+			}
+		}
+		chops[i] = c
+		if IsSafe(decls, chops) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func PrintChopping(f io.Writer, decls []*TxnDecl) {
+	chops := make([]*Chopping, len(decls))
+	for i, d := range decls {
+		chops[i] = finestChopping(d)
+	}
+	g := BuildSCGraph(decls, chops)
+
+	fmt.Fprintf(f, "SC-graph of finest declared pieces: %v nodes, %v S-edges, %v C-edges\n",
+		len(g.nodes), len(g.sEdges), len(g.cEdges))
+	for _, e := range g.cEdges {
+		a, b := &g.nodes[e[0]], &g.nodes[e[1]]
+		fmt.Fprintf(f, "C-edge %s.%v/%s -- %s.%v/%s\n",
+			decls[a.decl].Name, a.instance, decls[a.decl].Pieces[a.group].Name,
+			decls[b.decl].Name, b.instance, decls[b.decl].Pieces[b.group].Name)
+	}
+
+	for i, d := range decls {
+		safe := SafeChoppings(decls, i)
+		if safe == nil && len(d.Pieces) > MAXENUMPIECES {
+			fmt.Fprintf(f, "%s: too many pieces to enumerate\n", d.Name)
+			continue
+		}
+		fmt.Fprintf(f, "%s: %v safe choppings\n", d.Name, len(safe))
+		for _, c := range safe {
+			fmt.Fprintf(f, "\t%v\n", c)
+		}
+	}
+
+	finest := FinestChopping(decls)
+	for i, d := range decls {
+		fmt.Fprintf(f, "%s finest chopping %v\n", d.Name, finest[i])
+	}
+	fmt.Fprintf(f, "Finest chopping is safe: %v\n", IsSafe(decls, finest))
+}
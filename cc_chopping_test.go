@@ -0,0 +1,206 @@
+package testbed
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestChopping(t *testing.T) {
+	fmt.Println("===================")
+	fmt.Println("Test Chopping Begin")
+	fmt.Println("===================")
+
+	// T0 updates x, then reads y; T1 reads y and updates z
+	decls := []*TxnDecl{
+		&TxnDecl{
+			TXN:  0,
+			Name: "T0",
+			Pieces: []PieceDecl{
+				{Name: "ux", ReadSet: []string{"x"}, WriteSet: []string{"x"}},
+				{Name: "ry", ReadSet: []string{"y"}},
+			},
+		},
+		&TxnDecl{
+			TXN:  1,
+			Name: "T1",
+			Pieces: []PieceDecl{
+				{Name: "ryuz", ReadSet: []string{"y", "z"}, WriteSet: []string{"z"}},
+			},
+		},
+	}
+
+	finest := FinestChopping(decls)
+	if finest[0].NGroups() != 2 {
+		t.Errorf("T0 should be chopped in 2 pieces, got %v", finest[0])
+	}
+	if !IsSafe(decls, finest) {
+		t.Errorf("Finest chopping should be safe")
+	}
+	PrintChopping(os.Stdout, decls)
+
+	// T2 writes y and z, which links the pieces of T0:
+	// T0.ux -> T0' -> T2 -> T0.ry
+	decls = append(decls, &TxnDecl{
+		TXN:  2,
+		Name: "T2",
+		Pieces: []PieceDecl{
+			{Name: "wy", WriteSet: []string{"y"}},
+		},
+	})
+	if IsSafe(decls, []*Chopping{finest[0], finest[1], wholeChopping(decls[2])}) {
+		t.Errorf("Chopping T0 should not be safe with T2")
+	}
+	finest = FinestChopping(decls)
+	if finest[0].NGroups() != 1 {
+		t.Errorf("T0 should not be chopped, got %v", finest[0])
+	}
+
+	// A piece which may roll back has to stay in the first group
+	decls[2].Pieces = []PieceDecl{{Name: "wz", WriteSet: []string{"z"}}}
+	if FinestChopping(decls)[0].NGroups() != 2 {
+		t.Errorf("T0 should be chopped in 2 pieces again")
+	}
+	decls[0].Pieces[1].MayAbort = true
+	finest = FinestChopping(decls)
+	if finest[0].NGroups() != 1 {
+		t.Errorf("T0 should not be chopped, got %v", finest[0])
+	}
+
+	fmt.Println("=================")
+	fmt.Println("Test Chopping End")
+	fmt.Println("=================")
+}
+
+func TestChoppedExecution(t *testing.T) {
+	fmt.Println("============================")
+	fmt.Println("Test Chopped Execution Begin")
+	fmt.Println("============================")
+
+	*SysType = OCC
+	*PhyPart = false
+	*ChopTxn = true
+	defer func() {
+		*ChopTxn = false
+	}()
+
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+	for i := int64(0); i < 2; i++ {
+		table.CreateKV(CKey(i), table.Schema.MakeTuple(int64(0)), 0)
+	}
+	w := NewWorker(0, store)
+
+	// Increment key 0, then read key 1 which nobody writes
+	w.Declare(&TxnDecl{
+		TXN:  ADD_ONE,
+		Name: "AddRead",
+		Pieces: []PieceDecl{
+			{Name: "k0", ReadSet: []string{"k0"}, WriteSet: []string{"k0"}},
+			{Name: "k1", ReadSet: []string{"k1"}},
+		},
+		Piece: func(q *Query, tx ETransaction, piece int) error {
+			if piece == 1 {
+				_, err := tx.Read(table, q.rKeys[0], 0, false)
+				return err
+			}
+			k := q.wKeys[0]
+			v, err := tx.Read(table, k, 0, false)
+			if err != nil {
+				return err
+			}
+			return tx.WriteColumn(table, k, 0, v.Tuple().GetInt64(0)+1, 0)
+		},
+	})
+
+	q := &Query{
+		TXN:   ADD_ONE,
+		rKeys: []Key{CKey(1)},
+		wKeys: []Key{CKey(0)},
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := w.One(q); err != nil {
+			t.Errorf("Chopped transaction fails %v", err)
+		}
+	}
+
+	if w.NStats[NPIECES] != 20 {
+		t.Errorf("Expect 20 pieces, got %v", w.NStats[NPIECES])
+	}
+	if v := table.GetRecord(CKey(0), 0).Tuple().GetInt64(0); v != 10 {
+		t.Errorf("Key 0 has value %v; expected 10", v)
+	}
+
+	fmt.Println("==========================")
+	fmt.Println("Test Chopped Execution End")
+	fmt.Println("==========================")
+}
+
+func TestBuiltinChopping(t *testing.T) {
+	fmt.Println("============================")
+	fmt.Println("Test Builtin Chopping Begin")
+	fmt.Println("============================")
+
+	*SysType = OCC
+	*PhyPart = false
+	defer func() {
+		*ROKeys = 0
+		*ChopTxn = false
+	}()
+
+	// Reads of any record tie the pieces of two instances together
+	for i, c := range FinestChopping(builtinDecls()) {
+		if c.NGroups() != 1 {
+			t.Errorf("Built-in transaction %v chopped in %v without read-only keys", i, c)
+		}
+	}
+	*ROKeys = 100
+	for i, c := range FinestChopping(builtinDecls()) {
+		if c.NGroups() != 2 {
+			t.Errorf("Built-in transaction %v chopped in %v with read-only keys", i, c)
+		}
+	}
+
+	*ChopTxn = true
+	nKeys := int64(1000)
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+	LoadTable(table, nKeys, 1, 0)
+	w := NewWorker(0, store)
+	zk := NewZipfKey(0, nKeys, 1, nil, 1, nil)
+	g := NewTxnGen(0, ADD_ONE, 50, 8, 1, zk)
+	written := make(map[Key]int64)
+	for i := 0; i < 100; i++ {
+		q := g.GenOneQuery()
+		for _, k := range q.rKeys {
+			if ParseKey(k) >= *ROKeys {
+				t.Errorf("Read key %v is not read-only", k)
+			}
+		}
+		for _, k := range q.wKeys {
+			if ParseKey(k) < *ROKeys {
+				t.Errorf("Written key %v is read-only", k)
+			}
+		}
+		if _, err := w.One(q); err != nil {
+			t.Errorf("Chopped transaction fails %v", err)
+			continue
+		}
+		for _, k := range q.wKeys {
+			written[k]++
+		}
+	}
+	if w.NStats[NPIECES] != 200 {
+		t.Errorf("Expect 200 pieces, got %v", w.NStats[NPIECES])
+	}
+	for k, n := range written {
+		v := SeededTuple(table.Schema, 1, k).GetInt64(0) + n
+		if r := table.GetRecord(k, 0); r.Tuple().GetInt64(0) != v {
+			t.Errorf("Key %v is %v; expected %v", k, r.Tuple().GetInt64(0), v)
+		}
+	}
+
+	fmt.Println("==========================")
+	fmt.Println("Test Builtin Chopping End")
+	fmt.Println("==========================")
+}
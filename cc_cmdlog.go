@@ -0,0 +1,199 @@
+package testbed
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var CmdLog = flag.Bool("cmdlog", false, "Log transaction invocations instead of their writes; partition mode only")
+
+// Kinds of the wValue of a logged query
+const (
+	CMDNOVALUE = iota
+	CMDINTS
+	CMDSTRINGS
+)
+
+// Whether a logged query was routed by a partitioner
+const (
+	CMDNOPART = iota
+	CMDPART
+)
+
+// A command record has the usual header, with the order of the
+// command in place of the tid and no writes, followed by the query:
+// [txn uint16][nParts uint16][part uint16]... [kind uint8] telling
+// whether it was routed. The partitioner itself is not logged;
+// replay takes the one of the records table, which recovery creates
+// as it was. Then [nKeys uint16][key]... for the read and the write
+// keys, and [kind uint8] of wValue with
+// [n uint32][int64]... or [n uint32]([index uint16][string])...
+func (l *CommitLog) AppendCommand(q *Query) {
+	l.rec = appendUint16(l.rec, uint16(q.TXN))
+	l.rec = appendUint16(l.rec, uint16(len(q.accessParts)))
+	for _, p := range q.accessParts {
+		l.rec = appendUint16(l.rec, uint16(p))
+	}
+	if q.partitioner == nil {
+		l.rec = append(l.rec, CMDNOPART)
+	} else {
+		l.rec = append(l.rec, CMDPART)
+	}
+	l.rec = appendKeys(l.rec, q.rKeys)
+	l.rec = appendKeys(l.rec, q.wKeys)
+
+	switch v := q.wValue.(type) {
+	case nil:
+		l.rec = append(l.rec, CMDNOVALUE)
+	case *SingleIntValue:
+		l.rec = append(l.rec, CMDINTS)
+		l.rec = appendUint32(l.rec, uint32(len(v.intVals)))
+		for _, x := range v.intVals {
+			l.rec = appendUint64(l.rec, uint64(x))
+		}
+	case *StringListValue:
+		l.rec = append(l.rec, CMDSTRINGS)
+		l.rec = appendUint32(l.rec, uint32(len(v.strVals)))
+		for _, sa := range v.strVals {
+			l.rec = appendUint16(l.rec, uint16(sa.index))
+			l.rec = appendValue(l.rec, sa.value)
+		}
+	default:
+		clog.Error("Logging Value Type %T Not Supported", q.wValue)
+	}
+}
+
+func appendKeys(b []byte, keys []Key) []byte {
+	b = appendUint16(b, uint16(len(keys)))
+	for _, k := range keys {
+		b = appendUint16(b, uint16(len(k)))
+		b = append(b, k...)
+	}
+	return b
+}
+
+func (r *logReader) keys() []Key {
+	keys := make([]Key, r.uint16())
+	for i := range keys {
+		keys[i] = r.key()
+	}
+	return keys
+}
+
+// Returns nil if the query is cut short
+func (r *logReader) query(s *Store) *Query {
+	q := &Query{
+		TXN:         int(r.uint16()),
+		accessParts: make([]int, r.uint16()),
+	}
+	for i := range q.accessParts {
+		q.accessParts[i] = int(r.uint16())
+	}
+	if r.uint8() == CMDPART {
+		t := s.Table(RECORDS)
+		if t == nil || t.Partitioner == nil {
+			clog.Error("Replaying Commands Needs the Partitioner of Table %s", RECORDS)
+		}
+		q.partitioner = t.Partitioner
+		q.isPartition = true
+	}
+	q.rKeys = r.keys()
+	q.wKeys = r.keys()
+
+	switch r.uint8() {
+	case CMDINTS:
+		v := &SingleIntValue{
+			intVals: make([]int64, r.uint32()),
+		}
+		for i := range v.intVals {
+			v.intVals[i] = int64(r.uint64())
+		}
+		q.wValue = v
+	case CMDSTRINGS:
+		v := &StringListValue{
+			strVals: make([]*StrAttr, r.uint32()),
+		}
+		for i := range v.strVals {
+			v.strVals[i] = &StrAttr{
+				index: int(r.uint16()),
+				value: r.value(STRING).(string),
+			}
+		}
+		q.wValue = v
+	}
+	if r.short {
+		return nil
+	}
+	return q
+}
+
+type cmdRecord struct {
+	seq uint64
+	q   *Query
+}
+
+// Re-executes the durable commands after start one by one in the
+// order they ran. Queries are deterministic given the store, so
+// replay makes the same writes, including those of a transaction
+// which gave up after writing.
+func replayCommands(s *Store, logDir string, start uint64, rs *RecoveryStats) {
+	durable := uint64(math.MaxUint64)
+	if b, err := ioutil.ReadFile(filepath.Join(logDir, "epoch")); err == nil && len(b) == 8 {
+		durable = (&logReader{b: b}).uint64()
+	}
+
+	names, _ := filepath.Glob(filepath.Join(logDir, "worker-*.log"))
+	var cmds []cmdRecord
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			clog.Error("Read Log Error %s\n", err.Error())
+		}
+		r := &logReader{b: b}
+		for r.pos < len(b) {
+			seq := r.uint64()
+			epoch := r.uint64()
+			r.uint32()
+			q := r.query(s)
+			if q == nil {
+				break
+			}
+			if seq > start && epoch <= durable {
+				cmds = append(cmds, cmdRecord{seq: seq, q: q})
+			}
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].seq < cmds[j].seq
+	})
+
+	w := NewWorker(0, s)
+	for _, c := range cmds {
+		if c.q.TXN >= LAST_TXN {
+			clog.Error("Log Has Unknown Transaction %v", c.q.TXN)
+		}
+		w.One(c.q)
+		rs.NLogEntries += int64(len(c.q.wKeys))
+	}
+	rs.NLogRecords = int64(len(cmds))
+	if len(cmds) > 0 {
+		start = cmds[len(cmds)-1].seq
+	}
+	atomic.StoreUint64(&s.cmdSeq, start)
+}
+
+// Checks the flags command logging depends on
+func checkCmdLog() {
+	if *SysType != PARTITION {
+		clog.Error("Command Logging Needs Partition Mode")
+	}
+	if *ChopTxn {
+		clog.Error("Command Logging Cannot Log Chopped Transactions")
+	}
+}
@@ -3,6 +3,7 @@ package testbed
 import (
 	"fmt"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -11,10 +12,24 @@ type Coordinator struct {
 	Workers      []*Worker
 	store        *Store
 	NStats       []int64
+	NPartTxn     []int64
 	NGen         time.Duration
 	NExecute     time.Duration
 	NWait        time.Duration
 	NLockAcquire int64
+	NFlush       time.Duration
+	NDepWait     time.Duration
+	MaxDepChain  int64
+	NReclaimLag  time.Duration
+	logs         []*CommitLog
+	elog         *EpochLogger
+	NLogRecords  int64
+	NLogBytes    int64
+	NLogLatency  time.Duration
+	ckpt         *Checkpointer
+	rep          *Replicator
+	omu          sync.Mutex
+	owner        []int // Partition holding the keys hashed to each; see Rebalance
 	padding1     [128]byte
 }
 
@@ -24,18 +39,63 @@ const (
 
 func NewCoordinator(nWorkers int, store *Store) *Coordinator {
 	coordinator := &Coordinator{
-		Workers: make([]*Worker, nWorkers),
-		store:   store,
-		NStats:  make([]int64, LAST_STAT),
+		Workers:  make([]*Worker, nWorkers),
+		store:    store,
+		NStats:   make([]int64, LAST_STAT),
+		NPartTxn: make([]int64, len(store.locks)),
 	}
 
 	for i := range coordinator.Workers {
 		coordinator.Workers[i] = NewWorker(i, store)
 	}
 
+	if *LogDir != "" {
+		if *CmdLog {
+			checkCmdLog()
+		}
+		coordinator.logs = make([]*CommitLog, nWorkers)
+		for i, w := range coordinator.Workers {
+			coordinator.logs[i] = NewCommitLog(*LogDir, i)
+			w.log = coordinator.logs[i]
+			w.logs = coordinator.logs
+		}
+		if *LogEpoch > 0 {
+			coordinator.elog = NewEpochLogger(*LogDir, coordinator.logs, *LogEpoch)
+		}
+	}
+
+	if *Replica != "" {
+		checkReplica()
+		coordinator.rep = NewReplicator(*Replica, nWorkers)
+		for _, l := range coordinator.logs {
+			l.rep = coordinator.rep
+		}
+	}
+
+	if *CkptDir != "" {
+		coordinator.ckpt = NewCheckpointer(store, *CkptDir, coordinator.logs, coordinator.elog)
+		coordinator.ckpt.Start(*CkptInterval)
+	}
+
 	return coordinator
 }
 
+// Stop checkpoints, flush and close commit logs; workers must be done
+func (coord *Coordinator) Close() {
+	if coord.ckpt != nil {
+		coord.ckpt.Stop()
+	}
+	if coord.elog != nil {
+		coord.elog.Close()
+	}
+	for _, l := range coord.logs {
+		l.Close()
+	}
+	if coord.rep != nil {
+		coord.rep.Close()
+	}
+}
+
 func (coord *Coordinator) gatherStats() {
 	for _, worker := range coord.Workers {
 		coord.NStats[NABORTS] += worker.NStats[NABORTS]
@@ -48,10 +108,35 @@ func (coord *Coordinator) gatherStats() {
 		coord.NStats[NCROSSTXN] += worker.NStats[NCROSSTXN]
 		coord.NStats[NREADKEYS] += worker.NStats[NREADKEYS]
 		coord.NStats[NWRITEKEYS] += worker.NStats[NWRITEKEYS]
+		coord.NStats[NDEPTXN] += worker.NStats[NDEPTXN]
+		coord.NStats[NDEPCHAIN] += worker.NStats[NDEPCHAIN]
+		coord.NStats[NPIECES] += worker.NStats[NPIECES]
+		coord.NStats[NPIECEABORTS] += worker.NStats[NPIECEABORTS]
+		coord.NStats[NPHANTOMABORTS] += worker.NStats[NPHANTOMABORTS]
+		coord.NStats[NDUPKEY] += worker.NStats[NDUPKEY]
+		coord.NStats[NEVICTRESTARTS] += worker.NStats[NEVICTRESTARTS]
+		coord.NStats[NPULLS] += worker.NStats[NPULLS]
+		coord.NStats[NREROUTES] += worker.NStats[NREROUTES]
+		for p, n := range worker.NPartTxn {
+			coord.NPartTxn[p] += n
+		}
+		coord.NStats[NRETIRED] += worker.ebr.NRetired
+		coord.NStats[NRECLAIMED] += worker.ebr.NReclaimed
+		coord.NReclaimLag += worker.ebr.NLag
 		coord.NGen += worker.NGen
 		coord.NExecute += worker.NExecute
 		coord.NWait += worker.NWait
 		coord.NLockAcquire += worker.NLockAcquire
+		coord.NFlush += worker.NFlush
+		coord.NDepWait += worker.NDepWait
+		if worker.log != nil {
+			coord.NLogRecords += worker.log.NRecords
+			coord.NLogBytes += worker.log.NBytes
+			coord.NLogLatency += worker.log.NLatency
+		}
+		if worker.MaxDepChain > coord.MaxDepChain {
+			coord.MaxDepChain = worker.MaxDepChain
+		}
 	}
 }
 
@@ -68,10 +153,74 @@ func (coord *Coordinator) PrintStats(f *os.File) {
 	f.WriteString(fmt.Sprintf("Read %v Keys\n", coord.NStats[NREADKEYS]))
 	f.WriteString(fmt.Sprintf("Write %v Keys\n", coord.NStats[NWRITEKEYS]))
 
+	if coord.NStats[NRETIRED] != 0 {
+		f.WriteString(fmt.Sprintf("Retire %v Records\n", coord.NStats[NRETIRED]))
+		f.WriteString(fmt.Sprintf("Reclaim %v Records\n", coord.NStats[NRECLAIMED]))
+		if coord.NStats[NRECLAIMED] != 0 {
+			r := float64(coord.NReclaimLag.Nanoseconds()) / float64(coord.NStats[NRECLAIMED]) / float64(PERSEC)
+			f.WriteString(fmt.Sprintf("Average Reclamation Lag %.6f secs\n", r))
+		}
+	}
+
+	if coord.logs != nil {
+		f.WriteString(fmt.Sprintf("Log %v Commit Records\n", coord.NLogRecords))
+		f.WriteString(fmt.Sprintf("Log %v Bytes\n", coord.NLogBytes))
+		if coord.NLogRecords != 0 {
+			f.WriteString(fmt.Sprintf("Log %.1f Bytes per Commit Record\n", float64(coord.NLogBytes)/float64(coord.NLogRecords)))
+		}
+		f.WriteString(fmt.Sprintf("Log Flush Spends %v secs\n", float64(coord.NFlush.Nanoseconds())/float64(PERSEC)))
+		if coord.NLogRecords != 0 {
+			r := float64(coord.NLogLatency.Nanoseconds()) / float64(coord.NLogRecords) / float64(PERSEC)
+			f.WriteString(fmt.Sprintf("Average Commit to Durable Latency %.6f secs\n", r))
+		}
+		if coord.elog != nil {
+			f.WriteString(fmt.Sprintf("Group Commit %v Epochs\n", coord.elog.NEpochs))
+			f.WriteString(fmt.Sprintf("Epoch Logger Spends %v secs\n", float64(coord.elog.NFlush.Nanoseconds())/float64(PERSEC)))
+		}
+	}
+
+	if coord.rep != nil {
+		rep := coord.rep
+		f.WriteString(fmt.Sprintf("Replicate %v Commit Records\n", rep.NRecords))
+		f.WriteString(fmt.Sprintf("Replicate %v Bytes\n", rep.NBytes))
+		if rep.NFrames != 0 {
+			r := float64(rep.NLag.Nanoseconds()) / float64(rep.NFrames) / float64(PERSEC)
+			f.WriteString(fmt.Sprintf("Average Replication Lag %.6f secs\n", r))
+		}
+		if *SyncRep {
+			f.WriteString(fmt.Sprintf("Replication Acknowledgement Spends %v secs\n", float64(rep.NAckWait.Nanoseconds())/float64(PERSEC)))
+		}
+	}
+
+	if coord.ckpt != nil {
+		f.WriteString(fmt.Sprintf("Checkpoint %v Times\n", coord.ckpt.NCheckpoints))
+		f.WriteString(fmt.Sprintf("Checkpoint %v Records\n", coord.ckpt.NRecords))
+		f.WriteString(fmt.Sprintf("Checkpoint %v Bytes\n", coord.ckpt.NBytes))
+		f.WriteString(fmt.Sprintf("Checkpoint Spends %v secs\n", float64(coord.ckpt.NTime.Nanoseconds())/float64(PERSEC)))
+	}
+
+	if *AntiCacheDir != "" {
+		evicted, unevicted, bytes := coord.store.AntiCacheStats()
+		f.WriteString(fmt.Sprintf("Evict %v Records\n", evicted))
+		f.WriteString(fmt.Sprintf("Evict %v Bytes\n", bytes))
+		f.WriteString(fmt.Sprintf("Unevict %v Records\n", unevicted))
+		f.WriteString(fmt.Sprintf("Restart %v Transactions for Evicted Records\n", coord.NStats[NEVICTRESTARTS]))
+	}
+
+	if *ChopTxn {
+		f.WriteString(fmt.Sprintf("Commit %v Chopped Pieces\n", coord.NStats[NPIECES]))
+		f.WriteString(fmt.Sprintf("Retry %v Chopped Pieces\n", coord.NStats[NPIECEABORTS]))
+	}
+
 	if *SysType == PARTITION {
 		f.WriteString(fmt.Sprintf("Cross Partition %v Transactions\n", coord.NStats[NCROSSTXN]))
 		f.WriteString(fmt.Sprintf("Transaction Waiting Spends %v secs\n", float64(coord.NWait.Nanoseconds())/float64(PERSEC)))
 		f.WriteString(fmt.Sprintf("Has Acquired %v Locks\n", coord.NLockAcquire))
+		coord.printPartLoad(f)
+		if coord.NStats[NPULLS] > 0 || coord.NStats[NREROUTES] > 0 {
+			f.WriteString(fmt.Sprintf("Pull %v Migrating Records\n", coord.NStats[NPULLS]))
+			f.WriteString(fmt.Sprintf("Reroute %v Transactions\n", coord.NStats[NREROUTES]))
+		}
 		for i, worker := range coord.Workers {
 			f.WriteString(fmt.Sprintf("Worker %v Issue %v Transactions\n", i, worker.NStats[NTXN]))
 			f.WriteString(fmt.Sprintf("Worker %v Issue %v Cross Transactions\n", i, worker.NStats[NCROSSTXN]))
@@ -84,6 +233,7 @@ func (coord *Coordinator) PrintStats(f *os.File) {
 
 		if *PhyPart {
 			f.WriteString(fmt.Sprintf("Cross Partition %v Transactions\n", coord.NStats[NCROSSTXN]))
+			coord.printPartLoad(f)
 		}
 
 		f.WriteString(fmt.Sprintf("Abort %v Transactions\n", coord.NStats[NABORTS]))
@@ -103,6 +253,9 @@ func (coord *Coordinator) PrintStats(f *os.File) {
 		r = ((float64)(coord.NStats[NRWABORTS]) / (float64)(coord.NStats[NABORTS])) * 100
 		f.WriteString(fmt.Sprintf("Read Write Conflict Occupy %.4f%% Aborts \n", r))
 
+		r = ((float64)(coord.NStats[NPHANTOMABORTS]) / (float64)(coord.NStats[NABORTS])) * 100
+		f.WriteString(fmt.Sprintf("Phantom Occupy %.4f%% Aborts \n", r))
+
 		for i, worker := range coord.Workers {
 			f.WriteString(fmt.Sprintf("Worker %v Issue %v Transactions\n", i, worker.NStats[NTXN]))
 			f.WriteString(fmt.Sprintf("Worker %v Aborts %v Transactions\n", i, worker.NStats[NABORTS]))
@@ -121,15 +274,49 @@ func (coord *Coordinator) PrintStats(f *os.File) {
 
 			r = ((float64)(worker.NStats[NRWABORTS]) / (float64)(worker.NStats[NABORTS])) * 100
 			f.WriteString(fmt.Sprintf("Worker %v Read Write Conflict Occupy %.4f%% Aborts \n", i, r))
+
+			r = ((float64)(worker.NStats[NPHANTOMABORTS]) / (float64)(worker.NStats[NABORTS])) * 100
+			f.WriteString(fmt.Sprintf("Worker %v Phantom Occupy %.4f%% Aborts \n", i, r))
+		}
+	} else if *SysType == LOCKING {
+
+		if *PhyPart {
+			f.WriteString(fmt.Sprintf("Cross Partition %v Transactions\n", coord.NStats[NCROSSTXN]))
+			coord.printPartLoad(f)
+		}
+
+		f.WriteString(fmt.Sprintf("Abort %v Transactions\n", coord.NStats[NABORTS]))
+
+		r := ((float64)(coord.NStats[NABORTS]) / (float64)(coord.NStats[NTXN])) * 100
+		f.WriteString(fmt.Sprintf("Abort Rate %.4f%% \n", r))
+
+		if coord.logs != nil {
+			f.WriteString(fmt.Sprintf("Early Lock Release %v\n", *EarlyRelease))
+			f.WriteString(fmt.Sprintf("Commit Dependency Waiting Spends %v secs\n", float64(coord.NDepWait.Nanoseconds())/float64(PERSEC)))
+			f.WriteString(fmt.Sprintf("%v Transactions Have Commit Dependencies\n", coord.NStats[NDEPTXN]))
+			if coord.NStats[NDEPTXN] != 0 {
+				r = (float64)(coord.NStats[NDEPCHAIN]) / (float64)(coord.NStats[NDEPTXN])
+				f.WriteString(fmt.Sprintf("Average Dependency Chain Length %.4f\n", r))
+			}
+			f.WriteString(fmt.Sprintf("Max Dependency Chain Length %v\n", coord.MaxDepChain))
+		}
+
+		for i, worker := range coord.Workers {
+			f.WriteString(fmt.Sprintf("Worker %v Issue %v Transactions\n", i, worker.NStats[NTXN]))
+			f.WriteString(fmt.Sprintf("Worker %v Aborts %v Transactions\n", i, worker.NStats[NABORTS]))
+			if coord.logs != nil {
+				f.WriteString(fmt.Sprintf("Worker %v Has %v Commit Dependencies\n", i, worker.NStats[NDEPTXN]))
+				f.WriteString(fmt.Sprintf("Worker %v Max Dependency Chain Length %v\n", i, worker.MaxDepChain))
+			}
 		}
 	}
 
 	/*
 		var sum int64
 		for i := int64(0); i < coord.store.nKeys; i++ {
-			k := Key(i)
+			k := CKey(i)
 			rec := coord.store.GetRecord(k, 0)
-			sum += *rec.Value().(*int64)
+			sum += rec.Tuple().GetInt64(0)
 		}
 	*/
 
@@ -0,0 +1,434 @@
+package testbed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// Formats of datasets
+const (
+	DSBINARY = "binary"
+	DSCSV    = "csv"
+)
+
+const (
+	DSMAGIC   = "CCDS"
+	DSVERSION = 1
+)
+
+// A binary dataset is one file: DSMAGIC, [version uint16],
+// [nTables uint16], then for each table [name][nParts uint16]
+// [nCols uint16] and per column [name][type uint8][size uint32],
+// where a name is [len uint16][bytes]. Records follow until the end,
+// each [table uint16][part uint16][keylen uint16][key] and the values
+// of its columns as in the commit log.
+//
+// A CSV dataset is a directory with a file <table>.csv per table. Its
+// header is part, key and name:type:size per column, e.g.
+// value:int64:0; its rows are the partition, the key and the values.
+// Keys of INTKEYLEN bytes are written as ints, others in hex after
+// 0x. Bytes values are in hex too.
+//
+// Only present records are written. Types are the names of ColType.
+
+var colTypeNames = []string{"int64", "float64", "string", "bytes"}
+
+// ExportStore writes the records of all tables of s to path, a file
+// for DSBINARY or a directory for DSCSV; it returns their number.
+// No transactions may run meanwhile.
+func ExportStore(s *Store, path string, format string) int64 {
+	switch format {
+	case DSBINARY:
+		return exportBinary(s, path)
+	case DSCSV:
+		return exportCSV(s, path)
+	}
+	clog.Error("Dataset Format %s Not Supported", format)
+	return 0
+}
+
+// ImportStore adds the records of a dataset to s, each to the
+// partition it was exported from. Tables missing in s are created
+// without a partitioner; those in s must have the schema and number
+// of partitions of the dataset, and a partitioner which agrees with
+// it. It returns the number of records.
+func ImportStore(s *Store, path string, format string) int64 {
+	switch format {
+	case DSBINARY:
+		return importBinary(s, path)
+	case DSCSV:
+		return importCSV(s, path)
+	}
+	clog.Error("Dataset Format %s Not Supported", format)
+	return 0
+}
+
+func exportBinary(s *Store, path string) int64 {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		clog.Error("Open Dataset Error %s\n", err.Error())
+	}
+	w := bufio.NewWriterSize(f, LOGBUFSIZE)
+
+	b := append([]byte(nil), DSMAGIC...)
+	b = appendUint16(b, DSVERSION)
+	b = appendUint16(b, uint16(len(s.tables)))
+	for _, t := range s.tables {
+		b = appendName(b, t.Name)
+		b = appendUint16(b, uint16(len(t.parts)))
+		b = appendUint16(b, uint16(len(t.Schema.Columns)))
+		for _, c := range t.Schema.Columns {
+			b = appendName(b, c.Name)
+			b = append(b, uint8(c.Type))
+			b = appendUint32(b, uint32(c.Size))
+		}
+	}
+	w.Write(b)
+
+	var n int64
+	for _, t := range s.tables {
+		for p, part := range t.parts {
+			part.index.ForEach(func(k Key, r Record) bool {
+				if r.IsAbsent() {
+					return true
+				}
+				b = appendUint16(b[:0], uint16(t.ID))
+				b = appendUint16(b, uint16(p))
+				b = appendUint16(b, uint16(len(k)))
+				b = append(b, k...)
+				b = appendTuple(b, tupleOf(part.ac, r))
+				w.Write(b)
+				n++
+				return true
+			})
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		clog.Error("Write Dataset Error %s\n", err.Error())
+	}
+	f.Close()
+	return n
+}
+
+func appendName(b []byte, name string) []byte {
+	b = appendUint16(b, uint16(len(name)))
+	return append(b, name...)
+}
+
+// Decodes a binary dataset as it is read. Errors stick, so that
+// the caller checks once per record.
+type dsReader struct {
+	r   *bufio.Reader
+	buf [8]byte
+	err error
+}
+
+func (d *dsReader) next(n int) []byte {
+	var b []byte
+	if n <= len(d.buf) {
+		b = d.buf[:n]
+	} else {
+		b = make([]byte, n)
+	}
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, b)
+	}
+	return b
+}
+
+func (d *dsReader) uint8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *dsReader) uint16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+func (d *dsReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *dsReader) uint64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+func (d *dsReader) name() string {
+	return string(d.next(int(d.uint16())))
+}
+
+func (d *dsReader) tuple(s *Schema) *Tuple {
+	tup := s.NewTuple()
+	for i, c := range s.Columns {
+		switch c.Type {
+		case INT64:
+			tup.SetInt64(i, int64(d.uint64()))
+		case FLOAT64:
+			tup.SetFloat64(i, math.Float64frombits(d.uint64()))
+		case STRING:
+			tup.SetString(i, string(d.next(int(d.uint32()))))
+		case BYTES:
+			tup.SetBytes(i, append([]byte(nil), d.next(int(d.uint32()))...))
+		}
+	}
+	return tup
+}
+
+func importBinary(s *Store, path string) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		clog.Error("Open Dataset Error %s\n", err.Error())
+	}
+	defer f.Close()
+	d := &dsReader{r: bufio.NewReaderSize(f, LOGBUFSIZE)}
+
+	if string(d.next(len(DSMAGIC))) != DSMAGIC || d.err != nil {
+		clog.Error("%s Is Not a Dataset", path)
+	}
+	if v := d.uint16(); v != DSVERSION {
+		clog.Error("Dataset %s Has Version %v; Expected %v", path, v, DSVERSION)
+	}
+	tables := make([]*Table, d.uint16())
+	for i := range tables {
+		name := d.name()
+		nParts := int(d.uint16())
+		cols := make([]Column, d.uint16())
+		for j := range cols {
+			cols[j].Name = d.name()
+			cols[j].Type = ColType(d.uint8())
+			cols[j].Size = int(d.uint32())
+		}
+		if d.err != nil {
+			clog.Error("Dataset %s Is Truncated", path)
+		}
+		tables[i] = importTable(s, name, nParts, cols)
+	}
+
+	var n int64
+	for {
+		id := d.uint16()
+		if d.err == io.EOF {
+			break
+		}
+		part := int(d.uint16())
+		k := Key(d.name())
+		if int(id) >= len(tables) {
+			clog.Error("Dataset %s Has No Table %v", path, id)
+		}
+		t := tables[id]
+		tup := d.tuple(t.Schema)
+		if d.err != nil {
+			clog.Error("Dataset %s Is Truncated", path)
+		}
+		importKV(t, k, tup, part)
+		n++
+	}
+	return n
+}
+
+// Returns the table of s called name, creating it if needed
+func importTable(s *Store, name string, nParts int, cols []Column) *Table {
+	if nParts != len(s.locks) {
+		clog.Error("Dataset Has %v Partitions of Table %s; Store Has %v", nParts, name, len(s.locks))
+	}
+	t := s.Table(name)
+	if t == nil {
+		return s.CreateTable(name, NewSchema(cols...), nil, "")
+	}
+	if len(cols) != len(t.Schema.Columns) {
+		clog.Error("Dataset Has %v Columns of Table %s; Store Has %v", len(cols), name, len(t.Schema.Columns))
+	}
+	for i, c := range cols {
+		if c != t.Schema.Columns[i] {
+			clog.Error("Dataset Has Column %v of Table %s; Store Has %v", c, name, t.Schema.Columns[i])
+		}
+	}
+	return t
+}
+
+func importKV(t *Table, k Key, tup *Tuple, part int) {
+	if part >= len(t.parts) {
+		clog.Error("Dataset Has Partition %v of Table %s", part, t.Name)
+	}
+	if t.Partitioner != nil {
+		if p := t.Partitioner.GetPartition(k); p != part {
+			clog.Error("Dataset Puts Key %v of Table %s in Partition %v; Partitioner in %v", k, t.Name, part, p)
+		}
+	}
+	if t.CreateKV(k, tup, part) == nil {
+		clog.Error("Dataset Has Key %v of Table %s Twice", k, t.Name)
+	}
+}
+
+func exportCSV(s *Store, dir string) int64 {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		clog.Error("Create Dataset Directory Error %s\n", err.Error())
+	}
+	var n int64
+	for _, t := range s.tables {
+		f, err := os.OpenFile(filepath.Join(dir, t.Name+".csv"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			clog.Error("Open Dataset Error %s\n", err.Error())
+		}
+		w := csv.NewWriter(f)
+
+		row := []string{"part", "key"}
+		for _, c := range t.Schema.Columns {
+			row = append(row, fmt.Sprintf("%s:%s:%d", c.Name, colTypeNames[c.Type], c.Size))
+		}
+		w.Write(row)
+
+		for p, part := range t.parts {
+			part.index.ForEach(func(k Key, r Record) bool {
+				if r.IsAbsent() {
+					return true
+				}
+				row = append(row[:0], strconv.Itoa(p), formatCSVKey(k))
+				tup := tupleOf(part.ac, r)
+				for i, c := range t.Schema.Columns {
+					row = append(row, formatCSVValue(tup.Get(i), c.Type))
+				}
+				w.Write(row)
+				n++
+				return true
+			})
+		}
+
+		w.Flush()
+		if err := w.Error(); err != nil {
+			clog.Error("Write Dataset Error %s\n", err.Error())
+		}
+		f.Close()
+	}
+	return n
+}
+
+func formatCSVKey(k Key) string {
+	if len(k) == INTKEYLEN {
+		return strconv.FormatInt(ParseKey(k), 10)
+	}
+	return "0x" + hex.EncodeToString([]byte(k))
+}
+
+func formatCSVValue(v Value, ct ColType) string {
+	switch ct {
+	case INT64:
+		return strconv.FormatInt(v.(int64), 10)
+	case FLOAT64:
+		return strconv.FormatFloat(v.(float64), 'g', -1, 64)
+	case STRING:
+		return v.(string)
+	}
+	return hex.EncodeToString(v.([]byte))
+}
+
+// Tables are read in the order of their files' names
+func importCSV(s *Store, dir string) int64 {
+	names, _ := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if len(names) == 0 {
+		clog.Error("Dataset %s Has No Tables", dir)
+	}
+	var n int64
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			clog.Error("Open Dataset Error %s\n", err.Error())
+		}
+		r := csv.NewReader(bufio.NewReaderSize(f, LOGBUFSIZE))
+		r.ReuseRecord = true
+
+		header, err := r.Read()
+		if err != nil || len(header) < 2 {
+			clog.Error("Dataset %s Has No Header", name)
+		}
+		cols := make([]Column, len(header)-2)
+		for i := range cols {
+			cols[i] = parseCSVColumn(name, header[i+2])
+		}
+		t := importTable(s, strings.TrimSuffix(filepath.Base(name), ".csv"), len(s.locks), cols)
+
+		for line := 2; ; line++ {
+			row, err := r.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				clog.Error("Read Dataset %s Error %s", name, err.Error())
+			}
+			part, err := strconv.Atoi(row[0])
+			if err != nil {
+				clog.Error("Dataset %s Line %v: Bad Partition %s", name, line, row[0])
+			}
+			k, ok := parseCSVKey(row[1])
+			if !ok {
+				clog.Error("Dataset %s Line %v: Bad Key %s", name, line, row[1])
+			}
+			tup := t.Schema.NewTuple()
+			for i, c := range t.Schema.Columns {
+				v, ok := parseCSVValue(row[i+2], c.Type)
+				if !ok {
+					clog.Error("Dataset %s Line %v: Bad Value %s of Column %s", name, line, row[i+2], c.Name)
+				}
+				tup.Set(i, v)
+			}
+			importKV(t, k, tup, part)
+			n++
+		}
+		f.Close()
+	}
+	return n
+}
+
+// Parses name:type:size
+func parseCSVColumn(file string, s string) Column {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		clog.Error("Dataset %s Has Column %s; Expected name:type:size", file, s)
+	}
+	c := Column{Name: parts[0], Type: -1}
+	for i, name := range colTypeNames {
+		if name == parts[1] {
+			c.Type = ColType(i)
+		}
+	}
+	size, err := strconv.Atoi(parts[2])
+	if c.Type < 0 || err != nil {
+		clog.Error("Dataset %s Has Column %s; Expected name:type:size", file, s)
+	}
+	c.Size = size
+	return c
+}
+
+func parseCSVKey(s string) (Key, bool) {
+	if strings.HasPrefix(s, "0x") {
+		b, err := hex.DecodeString(s[2:])
+		return Key(b), err == nil
+	}
+	x, err := strconv.ParseInt(s, 10, 64)
+	return CKey(x), err == nil
+}
+
+func parseCSVValue(s string, ct ColType) (Value, bool) {
+	switch ct {
+	case INT64:
+		x, err := strconv.ParseInt(s, 10, 64)
+		return x, err == nil
+	case FLOAT64:
+		x, err := strconv.ParseFloat(s, 64)
+		return x, err == nil
+	case STRING:
+		return s, true
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
@@ -0,0 +1,95 @@
+package testbed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataset(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Dataset Begin")
+	fmt.Println("=======================")
+
+	defer func() {
+		*SysType = PARTITION
+	}()
+	*SysType = PARTITION
+	*NumPart = 2
+
+	dir, err := ioutil.TempDir("", "ccds")
+	if err != nil {
+		t.Fatalf("Create Temp Dir Error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	hp := &HashPartitioner{
+		NParts: 2,
+		NKeys:  10,
+	}
+	mixed := NewSchema(
+		Column{Name: "id", Type: INT64},
+		Column{Name: "price", Type: FLOAT64},
+		Column{Name: "name", Type: STRING, Size: 16},
+		Column{Name: "blob", Type: BYTES},
+	)
+
+	store := NewStore()
+	ints := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), hp, "")
+	for i := int64(0); i < 10; i++ {
+		ints.CreateKV(CKey(i), ints.Schema.MakeTuple(i*i), hp.GetPartition(CKey(i)))
+	}
+	// Absent records are left out
+	ints.GetRecord(CKey(3), hp.GetPartition(CKey(3))).SetAbsent(true)
+	other := store.CreateTable("other", mixed, nil, "btree")
+	keys := []Key{CompositeKey("a,b", int64(1)), CompositeKey("x\"y\n", int64(-2)), BytesKey([]byte{0, 1, 2})}
+	for i, k := range keys {
+		other.CreateKV(k, mixed.MakeTuple(int64(i), 0.5*float64(i), fmt.Sprintf("n,%d\"", i), []byte{byte(i), 0}), i%2)
+	}
+
+	for _, format := range []string{DSBINARY, DSCSV} {
+		path := filepath.Join(dir, format)
+		if n := ExportStore(store, path, format); n != 12 {
+			t.Errorf("%v: exported %v records; expected 12", format, n)
+		}
+
+		// One table is created beforehand with its partitioner
+		s := NewStore()
+		s.CreateTable(RECORDS, SchemaOf(SINGLEINT), hp, "")
+		if n := ImportStore(s, path, format); n != 12 {
+			t.Errorf("%v: imported %v records; expected 12", format, n)
+		}
+		for _, src := range store.Tables() {
+			dst := s.Table(src.Name)
+			if dst == nil {
+				t.Errorf("%v: table %v not imported", format, src.Name)
+				continue
+			}
+			if dst.Schema.NCols() != src.Schema.NCols() {
+				t.Errorf("%v: table %v has %v columns", format, src.Name, dst.Schema.NCols())
+			}
+			for p := 0; p < 2; p++ {
+				src.parts[p].index.ForEach(func(k Key, r Record) bool {
+					dr := dst.GetRecord(k, p)
+					if r.IsAbsent() {
+						if dr != nil {
+							t.Errorf("%v: absent key %v imported", format, k)
+						}
+					} else if dr == nil || dr.Tuple().String() != r.Tuple().String() {
+						t.Errorf("%v: key %v in partition %v imported as %v", format, k, p, dr)
+					}
+					return true
+				})
+			}
+		}
+		if s.Table(RECORDS).NKeys() != 9 || s.Table("other").NKeys() != 3 {
+			t.Errorf("%v: imported %v and %v keys", format, s.Table(RECORDS).NKeys(), s.Table("other").NKeys())
+		}
+	}
+
+	fmt.Println("=======================")
+	fmt.Println("Test Dataset End")
+	fmt.Println("=======================")
+}
@@ -0,0 +1,130 @@
+package testbed
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// Elastic scaling after E-Store: a store keeps the partitions of
+// -ncores, and a run uses the first n of them with their workers,
+// n changing as a schedule says. In partition mode the keys hashed to
+// each partition move as a whole, so that the partitions in use hold
+// all of them.
+
+// Step runs N workers from At after the start
+type Step struct {
+	At time.Duration
+	N  int
+}
+
+// LoadSchedule reads lines "<duration> <workers>", e.g. "2s 4", with
+// durations ascending from 0
+func LoadSchedule(path string) []Step {
+	f, err := os.Open(path)
+	if err != nil {
+		clog.Error("Open Schedule Error %s\n", err.Error())
+	}
+	defer f.Close()
+
+	var steps []Step
+	sc := bufio.NewScanner(f)
+	line := 0
+	for sc.Scan() {
+		line++
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			clog.Error("Schedule %s Line %v: Expected Duration and Workers", path, line)
+		}
+		at, err1 := time.ParseDuration(fields[0])
+		n, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil || n <= 0 {
+			clog.Error("Schedule %s Line %v: Invalid Step %s", path, line, sc.Text())
+		}
+		if (len(steps) == 0 && at != 0) || (len(steps) > 0 && at <= steps[len(steps)-1].At) {
+			clog.Error("Schedule %s Line %v: Steps Start at 0 and Ascend", path, line)
+		}
+		steps = append(steps, Step{At: at, N: n})
+	}
+	if err := sc.Err(); err != nil {
+		clog.Error("Read Schedule Error %s\n", err.Error())
+	}
+	if len(steps) == 0 {
+		clog.Error("Schedule %s Has No Steps", path)
+	}
+	return steps
+}
+
+// Rebalance makes partitions 0 to n-1 hold all keys of hp while
+// workers run, moving the keys hashed to partition p >= n to
+// partition p % n, and those hashed to p < n back home. Workers should
+// route queries with hp. It returns the migrations made.
+func (coord *Coordinator) Rebalance(hp *HashPartitioner, n int) []*Migration {
+	nParts := len(coord.store.locks)
+	if n <= 0 || n > nParts || hp.NParts != int64(nParts) {
+		clog.Error("Rebalancing %v Partitions of %v", n, nParts)
+	}
+	coord.omu.Lock()
+	defer coord.omu.Unlock()
+	if coord.owner == nil {
+		coord.owner = make([]int, nParts)
+		for p := range coord.owner {
+			coord.owner[p] = p
+		}
+	}
+	var ms []*Migration
+	for p, cur := range coord.owner {
+		to := p
+		if p >= n {
+			to = p % n
+		}
+		if to == cur {
+			continue
+		}
+		mv := keyMove{lo: math.MinInt64, hi: math.MaxInt64, base: p, from: cur, to: to}
+		ms = append(ms, coord.store.migrate(hp, mv))
+		coord.owner[p] = to
+	}
+	return ms
+}
+
+// Owned returns the partitions whose keys partition p holds, which
+// are empty if it is not in use
+func (coord *Coordinator) Owned(p int) []int {
+	coord.omu.Lock()
+	defer coord.omu.Unlock()
+	if coord.owner == nil {
+		return []int{p}
+	}
+	var parts []int
+	for x, owner := range coord.owner {
+		if owner == p {
+			parts = append(parts, x)
+		}
+	}
+	return parts
+}
+
+// SetBases makes the generator draw the keys of a single-partition
+// query from those hashed to bases, e.g. Owned by its partition
+func (tg *TxnGen) SetBases(bases []int) {
+	tg.bases = bases
+}
+
+func (tg *TxnGen) selfKey(home int) Key {
+	if home != tg.partIndex {
+		return tg.zk.GetOtherKey(home)
+	}
+	if len(tg.bases) < 2 {
+		return tg.zk.GetSelfKey()
+	}
+	return tg.zk.GetOtherKey(tg.bases[tg.rnd.Intn(len(tg.bases))])
+}
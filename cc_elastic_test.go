@@ -0,0 +1,131 @@
+package testbed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestElastic(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Elastic Begin")
+	fmt.Println("=======================")
+
+	defer func() {
+		*CrossPercent = 0
+	}()
+
+	dir, err := ioutil.TempDir("", "ccelastic")
+	if err != nil {
+		t.Fatalf("Create Temp Dir Error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedule")
+	ioutil.WriteFile(path, []byte("# Ramp down and up\n0s 4\n100ms 2\n\n1s 3\n1.5s 4\n"), 0600)
+	steps := LoadSchedule(path)
+	expected := []Step{{0, 4}, {100 * time.Millisecond, 2}, {time.Second, 3}, {1500 * time.Millisecond, 4}}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("Schedule is %v; expected %v", steps, expected)
+	}
+
+	*SysType = PARTITION
+	*CrossPercent = 20
+	nParts := 4
+	*NumPart = nParts
+	nKeys := int64(1024)
+	hp := &HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+	}
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), hp, "")
+	pKeysArray := LoadTable(table, nKeys, 1, 0)
+	coord := NewCoordinator(nParts, store)
+	gens := make([]*TxnGen, nParts)
+	for i := range gens {
+		zk := NewZipfKey(i, nKeys, nParts, pKeysArray, 1, hp)
+		gens[i] = NewTxnGen(i, ADD_ONE, 50, 4, 2, zk)
+	}
+
+	written := make([]map[Key]int64, nParts)
+	for i := range written {
+		written[i] = make(map[Key]int64)
+	}
+	// The workers in use run while the partitions are rebalanced
+	prev := nParts
+	for _, step := range steps[1:] {
+		running := step.N
+		if prev < running {
+			running = prev
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < running; i++ {
+			gens[i].SetBases(coord.Owned(i))
+			wg.Add(1)
+			go func(n int) {
+				for j := 0; j < 500; j++ {
+					q := gens[n].GenOneQuery()
+					if _, err := coord.Workers[n].One(q); err != nil {
+						t.Errorf("Worker %v: query fails with %v", n, err)
+						break
+					}
+					for _, k := range q.wKeys {
+						written[n][k]++
+					}
+				}
+				wg.Done()
+			}(i)
+		}
+		coord.Rebalance(hp, step.N)
+		wg.Wait()
+		prev = step.N
+		if m := hp.mapping(); m != nil && len(m.moves) != 0 {
+			t.Errorf("%v partitions: %v moves left to walk", step.N, len(m.moves))
+		}
+
+		for p := 0; p < nParts; p++ {
+			owner := p
+			if p >= step.N {
+				owner = p % step.N
+			}
+			if owned := coord.Owned(owner); len(owned) == 0 || owned[0] != owner {
+				t.Errorf("%v partitions: partition %v holds %v", step.N, owner, owned)
+			}
+			if part := hp.GetPartition(CKey(int64(p))); part != owner {
+				t.Errorf("%v partitions: keys of partition %v are in %v", step.N, p, part)
+			}
+		}
+	}
+	coord.Close()
+
+	for i := int64(0); i < nKeys; i++ {
+		k := CKey(i)
+		part := hp.GetPartition(k)
+		r := table.GetRecord(k, part)
+		if r == nil {
+			t.Errorf("Key %v is not in partition %v", i, part)
+			continue
+		}
+		for p := 0; p < nParts; p++ {
+			if p != part && table.GetRecord(k, p) != nil {
+				t.Errorf("Key %v is in partition %v too", i, p)
+			}
+		}
+		v := SeededTuple(table.Schema, 1, k).GetInt64(0)
+		for _, w := range written {
+			v += w[k]
+		}
+		if r.Tuple().GetInt64(0) != v {
+			t.Errorf("Key %v is %v; expected %v", i, r.Tuple().GetInt64(0), v)
+		}
+	}
+
+	fmt.Println("=====================")
+	fmt.Println("Test Elastic End")
+	fmt.Println("=====================")
+}
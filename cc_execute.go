@@ -1,26 +1,51 @@
 package testbed
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/totemtang/cc-testbed/clog"
 )
 
 type ETransaction interface {
 	Reset(q *Query)
-	Read(k Key, partNum int, force bool) (Record, error)
-	WriteInt64(k Key, intValue int64, partNum int) error
-	WriteString(k Key, sa *StrAttr, partNum int) error
+	Read(t *Table, k Key, partNum int, force bool) (Record, error)
+	// WriteColumn sets column col of k to v, which has the Go type
+	// of the column: int64, float64, string or []byte
+	WriteColumn(t *Table, k Key, col int, v Value, partNum int) error
+	Scan(t *Table, lo Key, hi Key, partNum int) ([]Record, error)
+	// Insert fails with EDUPKEY if k exists; Delete fails with
+	// ENOKEY if it does not
+	Insert(t *Table, k Key, tup *Tuple, partNum int) error
+	Delete(t *Table, k Key, partNum int) error
+	// LookupSec returns the keys of records whose attribute covered
+	// by si equals val; the slice is read only
+	LookupSec(si *SecIndex, val string, partNum int) ([]Key, error)
 	Abort() TID
 	Commit() TID
 	Store() *Store
 	Worker() *Worker
 }
 
+// Kinds of writes a transaction buffers or undoes
+const (
+	WRITE_UPDATE = iota
+	WRITE_INSERT
+	WRITE_DELETE
+)
+
 // Partition Transaction Implementation
 type PTransaction struct {
 	padding0 [64]byte
 	w        *Worker
 	s        *Store
-	newValue int64
+	scanRecs []Record
+	logging  bool // A commit record has begun
+	wRecs    []Record
+	maxSeen  TID
+	q        *Query
+	evicted  []evictedRec // Evicted records touched; fetched before a restart
+	undo     []undoRec    // Before-images of records written, with anti-caching
 	padding  [64]byte
 }
 
@@ -33,46 +58,313 @@ func StartPTransaction(w *Worker) *PTransaction {
 }
 
 func (p *PTransaction) Reset(q *Query) {
+	p.q = q
+	p.logging = false
+	p.wRecs = p.wRecs[:0]
+	p.maxSeen = 0
+	p.evicted = p.evicted[:0]
+	p.undo = p.undo[:0]
+}
 
+// Writes are logged as they are applied to r. The commit TID has to
+// be larger than those of the records written, for replay. With
+// command logging, the query is logged at commit instead.
+func (p *PTransaction) log(r Record) *CommitLog {
+	l := p.w.log
+	if l == nil {
+		return nil
+	}
+	if !p.logging {
+		l.Begin()
+		p.logging = true
+	}
+	p.wRecs = append(p.wRecs, r)
+	if tid := r.GetTID(); tid > p.maxSeen {
+		p.maxSeen = tid
+	}
+	if *CmdLog {
+		return nil
+	}
+	return l
 }
 
-func (p *PTransaction) Read(k Key, partNum int, force bool) (Record, error) {
-	r := p.s.GetRecord(k, partNum)
-	if r == nil {
+// With anti-caching, an evicted record fails with EEVICTED and is
+// fetched before the transaction restarts; others become the most
+// recent of their partition
+func (p *PTransaction) resident(t *Table, partNum int, r Record) error {
+	ac := t.parts[partNum].ac
+	if ac == nil {
+		return nil
+	}
+	if pr := r.(*PRecord); pr.evicted {
+		p.evicted = append(p.evicted, evictedRec{ac: ac, r: pr})
+		return EEVICTED
+	}
+	ac.touch(r)
+	return nil
+}
+
+// Keeps the values r had before the first write of the transaction,
+// to roll it back if it has to restart
+func (p *PTransaction) saveUndo(t *Table, k Key, partNum int, r Record) {
+	if t.parts[partNum].ac == nil {
+		return
+	}
+	for i := range p.undo {
+		if p.undo[i].r == r {
+			return
+		}
+	}
+	u := undoRec{t: t, k: k, partNum: partNum, r: r}
+	if !r.IsAbsent() {
+		u.tup = t.Schema.NewTuple()
+		u.tup.CopyFrom(r.Tuple())
+	}
+	p.undo = append(p.undo, u)
+}
+
+func (p *PTransaction) Read(t *Table, k Key, partNum int, force bool) (Record, error) {
+	if t.hot[k] {
+		partNum = p.readPart(partNum)
+	}
+	p.pull(t, k, partNum)
+	r := t.GetRecord(k, partNum)
+	if r == nil || r.IsAbsent() {
 		return nil, ENOKEY
 	}
+	if err := p.resident(t, partNum, r); err != nil {
+		return nil, err
+	}
 	return r, nil
 }
 
-func (p *PTransaction) WriteInt64(k Key, intValue int64, partNum int) error {
-	r := p.s.GetRecord(k, partNum)
-	pr := r.(*PRecord)
-	//success := s.SetRecord(k, intValue, partNum)
-	p.newValue = intValue
-	success := pr.UpdateValue(&p.newValue)
-	if !success {
+// A replicated key is read from any partition the transaction holds,
+// its home partition if it can
+func (p *PTransaction) readPart(partNum int) int {
+	parts := p.q.accessParts
+	for _, x := range parts {
+		if x == partNum {
+			return partNum
+		}
+	}
+	if len(parts) == 0 {
+		return partNum
+	}
+	return parts[0]
+}
+
+// A write of a replicated key goes to its copies in all partitions,
+// which the transaction has to hold
+func (p *PTransaction) replicas(t *Table, k Key) []int {
+	if len(p.q.accessParts) != len(t.parts) {
+		clog.Error("Writing Replicated Key %v Needs All Partitions", k)
+	}
+	return p.q.accessParts
+}
+
+func (p *PTransaction) WriteColumn(t *Table, k Key, col int, v Value, partNum int) error {
+	if t.hot[k] {
+		for _, part := range p.replicas(t, k) {
+			if err := p.writeColumn(t, k, col, v, part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return p.writeColumn(t, k, col, v, partNum)
+}
+
+func (p *PTransaction) writeColumn(t *Table, k Key, col int, v Value, partNum int) error {
+	p.pull(t, k, partNum)
+	r := t.GetRecord(k, partNum)
+	if r == nil || r.IsAbsent() {
 		return ENOKEY
 	}
+	if err := p.resident(t, partNum, r); err != nil {
+		return err
+	}
+	p.saveUndo(t, k, partNum, r)
+	if len(t.secIndexes) > 0 {
+		t.secChanges(k, partNum, col, r.Tuple().GetString,
+			func(int) string { return v.(string) }, applySec)
+	}
+	r.SetColumn(col, v)
+	if l := p.log(r); l != nil {
+		l.AppendUpdate(t.ID, partNum, k, col, v)
+	}
 	return nil
 }
 
-func (p *PTransaction) WriteString(k Key, sa *StrAttr, partNum int) error {
-	s := p.s
-	success := s.SetRecord(k, sa, partNum)
-	if !success {
+// The returned slice is reused by the next Scan. All evicted records
+// in the range are fetched before a restart.
+func (p *PTransaction) Scan(t *Table, lo Key, hi Key, partNum int) ([]Record, error) {
+	var err error
+	p.scanRecs = p.scanRecs[:0]
+	p.pullRange(t, lo, hi, partNum)
+	t.parts[partNum].index.Scan(lo, hi, func(k Key, r Record) bool {
+		if !r.IsAbsent() {
+			if e := p.resident(t, partNum, r); e != nil {
+				err = e
+			}
+			p.scanRecs = append(p.scanRecs, r)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.scanRecs, nil
+}
+
+// Like other writes in partition mode, inserts and deletes are
+// applied at once and not undone
+func (p *PTransaction) Insert(t *Table, k Key, tup *Tuple, partNum int) error {
+	if t.hot[k] {
+		for _, part := range p.replicas(t, k) {
+			if err := p.insert(t, k, tup, part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return p.insert(t, k, tup, partNum)
+}
+
+func (p *PTransaction) insert(t *Table, k Key, tup *Tuple, partNum int) error {
+	p.pull(t, k, partNum)
+	r, _, _ := t.getOrInsert(k, partNum, nil)
+	if !r.IsAbsent() {
+		return EDUPKEY
+	}
+	p.saveUndo(t, k, partNum, r)
+	r.SetTuple(tup)
+	r.SetAbsent(false)
+	if ac := t.parts[partNum].ac; ac != nil {
+		ac.touch(r)
+	}
+	if len(t.secIndexes) > 0 {
+		t.secChanges(k, partNum, -1, nil, attrOf(r.Tuple()), applySec)
+	}
+	if l := p.log(r); l != nil {
+		l.AppendInsert(t.ID, partNum, k, tup)
+	}
+	return nil
+}
+
+func (p *PTransaction) Delete(t *Table, k Key, partNum int) error {
+	if t.hot[k] {
+		for _, part := range p.replicas(t, k) {
+			if err := p.delete(t, k, part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return p.delete(t, k, partNum)
+}
+
+func (p *PTransaction) delete(t *Table, k Key, partNum int) error {
+	p.pull(t, k, partNum)
+	r := t.GetRecord(k, partNum)
+	if r == nil || r.IsAbsent() {
 		return ENOKEY
 	}
+	if err := p.resident(t, partNum, r); err != nil {
+		return err
+	}
+	p.saveUndo(t, k, partNum, r)
+	r.SetAbsent(true)
+	if len(t.secIndexes) > 0 {
+		t.secChanges(k, partNum, -1, attrOf(r.Tuple()), nil, applySec)
+	}
+	p.w.retire(t, k, partNum, r, 0)
+	if l := p.log(r); l != nil {
+		l.AppendDelete(t.ID, partNum, k)
+	}
 	return nil
 }
 
+func (p *PTransaction) LookupSec(si *SecIndex, val string, partNum int) ([]Key, error) {
+	return si.entry(val, partNum).Keys(), nil
+}
+
+// Writes are not undone, so they are logged like committed ones;
+// only a transaction which touched evicted records is rolled back,
+// to restart once they are fetched
 func (p *PTransaction) Abort() TID {
+	if len(p.evicted) > 0 {
+		p.rollback()
+		return 0
+	}
+	p.logCommit()
 	return 0
 }
 
+// Restores the before-images in reverse order and drops the commit
+// record begun; the partitions written are still locked
+func (p *PTransaction) rollback() {
+	for i := len(p.undo) - 1; i >= 0; i-- {
+		u := &p.undo[i]
+		r := u.r
+		if len(u.t.secIndexes) > 0 {
+			var cur, old func(i int) string
+			if !r.IsAbsent() {
+				cur = attrOf(r.Tuple())
+			}
+			if u.tup != nil {
+				old = attrOf(u.tup)
+			}
+			u.t.secChanges(u.k, u.partNum, -1, cur, old, applySec)
+		}
+		if u.tup != nil {
+			r.SetTuple(u.tup)
+			r.SetAbsent(false)
+		} else if !r.IsAbsent() {
+			r.SetAbsent(true)
+			p.w.retire(u.t, u.k, u.partNum, r, 0)
+		}
+	}
+	p.undo = p.undo[:0]
+	p.logging = false
+	p.wRecs = p.wRecs[:0]
+	p.maxSeen = 0
+}
+
 func (p *PTransaction) Commit() TID {
+	p.logCommit()
 	return 1
 }
 
+// The partitions written are still locked
+func (p *PTransaction) logCommit() {
+	if !p.logging {
+		return
+	}
+	p.logging = false
+	w := p.w
+	tid := w.commitTID()
+	if tid <= p.maxSeen {
+		w.ResetTID(p.maxSeen)
+		tid = w.commitTID()
+	}
+	for _, r := range p.wRecs {
+		r.SetTID(tid)
+	}
+	p.wRecs = p.wRecs[:0]
+	p.maxSeen = 0
+	if *CmdLog {
+		// Commands touching a partition are ordered by its lock
+		w.log.AppendCommand(p.q)
+		tid = TID(atomic.AddUint64(&p.s.cmdSeq, 1))
+	}
+	w.log.End(tid, w.log.Epoch())
+	if !w.log.Grouped() {
+		tm := time.Now()
+		w.log.Flush()
+		w.NFlush += time.Since(tm)
+	}
+}
+
 func (p *PTransaction) Store() *Store {
 	return p.s
 }
@@ -81,25 +373,106 @@ func (p *PTransaction) Worker() *Worker {
 	return p.w
 }
 
+type evictedRec struct {
+	ac *antiCache
+	r  *PRecord
+}
+
+type undoRec struct {
+	t       *Table
+	k       Key
+	partNum int
+	r       Record
+	tup     *Tuple // nil if r was absent
+}
+
+type ColWrite struct {
+	col int
+	v   Value
+}
+
 type WriteKey struct {
 	padding1 [64]byte
+	t        *Table
 	k        Key
 	partNum  int
-	intVal   int64
-	v        Value
+	cols     []ColWrite // Columns an update sets, each once
+	tup      *Tuple     // The tuple an insert adds
+	op       int
 	locked   bool
+	former   TID // The TID the record had when locked
 	rec      Record
 	padding2 [64]byte
 }
 
+type SecReadKey struct {
+	padding1 [64]byte
+	e        *SecEntry
+	last     TID
+	padding2 [64]byte
+}
+
+type SecWriteKey struct {
+	padding1 [64]byte
+	e        *SecEntry
+	k        Key
+	add      bool
+	locked   bool
+	former   TID
+	padding2 [64]byte
+}
+
+type NodeKey struct {
+	padding1 [64]byte
+	node     IndexNode
+	version  uint64
+	padding2 [64]byte
+}
+
 type ReadKey struct {
 	padding1 [64]byte
+	t        *Table
 	k        Key
 	last     TID
 	rec      Record
 	padding2 [64]byte
 }
 
+// A point access which found no record. Tombstones are unlinked
+// once reclaimed, so that no record is left for validation or locks
+// to notice a later insert of k; it is checked again at commit.
+type MissKey struct {
+	t       *Table
+	k       Key
+	partNum int
+}
+
+func missed(misses []MissKey, t *Table, k Key) bool {
+	for i := range misses {
+		if misses[i].t == t && misses[i].k == k {
+			return true
+		}
+	}
+	return false
+}
+
+// An absent record an insert added to the index at tid. It is
+// retired if the transaction aborts, as a committed delete would.
+type NewKey struct {
+	t       *Table
+	k       Key
+	partNum int
+	rec     Record
+	tid     TID
+}
+
+func retireNew(w *Worker, created []NewKey) {
+	for i := range created {
+		nk := &created[i]
+		w.retire(nk.t, nk.k, nk.partNum, nk.rec, nk.tid)
+	}
+}
+
 // Silo OCC Transaction Implementation
 type OTransaction struct {
 	padding0 [64]byte
@@ -109,8 +482,15 @@ type OTransaction struct {
 	//wKeys       map[Key]*WriteKey
 	rKeys       []ReadKey
 	wKeys       []WriteKey
+	nodes       []NodeKey
+	secReads    []SecReadKey
+	secWrites   []SecWriteKey
+	misses      []MissKey
+	created     []NewKey
 	dummyRecord *DRecord
+	dummyTuple  Tuple
 	maxSeen     TID
+	scanRecs    []Record
 	padding     [64]byte
 }
 
@@ -120,6 +500,7 @@ func StartOTransaction(w *Worker) *OTransaction {
 		s:           w.store,
 		rKeys:       make([]ReadKey, 0, 100),
 		wKeys:       make([]WriteKey, 0, 100),
+		nodes:       make([]NodeKey, 0, 100),
 		dummyRecord: &DRecord{},
 	}
 	return tx
@@ -130,32 +511,50 @@ func (o *OTransaction) Reset(q *Query) {
 	//o.wKeys = make(map[Key]*WriteKey, len(q.wKeys))
 	o.rKeys = o.rKeys[:0]
 	o.wKeys = o.wKeys[:0]
+	o.nodes = o.nodes[:0]
+	o.secReads = o.secReads[:0]
+	o.secWrites = o.secWrites[:0]
+	o.misses = o.misses[:0]
+	o.created = o.created[:0]
 }
 
-func (o *OTransaction) Read(k Key, partNum int, force bool) (Record, error) {
+func (o *OTransaction) Read(t *Table, k Key, partNum int, force bool) (Record, error) {
 	if !force {
 		for i := 0; i < len(o.wKeys); i++ {
 			wk := &o.wKeys[i]
-			if wk.k == k {
+			if wk.t == t && wk.k == k {
+				switch wk.op {
+				case WRITE_DELETE:
+					return nil, ENOKEY
+				case WRITE_INSERT:
+					o.dummyRecord.SetTuple(wk.tup)
+					return o.dummyRecord, nil
+				}
 				ok, _ := wk.rec.IsUnlocked()
 				if !ok {
 					o.w.NStats[NREADABORTS]++
 					return nil, EABORT
 				}
-				o.dummyRecord.UpdateValue(&wk.intVal)
+				// The record as this transaction will write it
+				o.dummyTuple.CopyFrom(wk.rec.Tuple())
+				for j := range wk.cols {
+					o.dummyTuple.Set(wk.cols[j].col, wk.cols[j].v)
+				}
+				o.dummyRecord.SetTuple(&o.dummyTuple)
 				return o.dummyRecord, nil
 			}
 		}
 	}
 
-	r := o.s.GetRecord(k, partNum)
+	r := t.GetRecord(k, partNum)
 	if r == nil {
+		o.misses = append(o.misses, MissKey{t: t, k: k, partNum: partNum})
 		return nil, ENOKEY
 	}
 
-	var ok bool
+	var ok, absent bool
 	var tid TID
-	ok, tid = r.IsUnlocked()
+	ok, tid, absent = readAbsent(r)
 
 	if !ok {
 		o.w.NStats[NREADABORTS]++
@@ -166,7 +565,7 @@ func (o *OTransaction) Read(k Key, partNum int, force bool) (Record, error) {
 	ok = false
 	for j := 0; j < len(o.rKeys); j++ {
 		rk := &o.rKeys[j]
-		if rk.k == k {
+		if rk.t == t && rk.k == k {
 			ok = true
 			break
 		}
@@ -181,6 +580,7 @@ func (o *OTransaction) Read(k Key, partNum int, force bool) (Record, error) {
 		o.rKeys[k] = readKey*/
 		n := len(o.rKeys)
 		o.rKeys = o.rKeys[0 : n+1]
+		o.rKeys[n].t = t
 		o.rKeys[n].k = k
 		o.rKeys[n].last = tid
 		o.rKeys[n].rec = r
@@ -190,125 +590,323 @@ func (o *OTransaction) Read(k Key, partNum int, force bool) (Record, error) {
 		o.maxSeen = tid
 	}
 
+	// Absence is validated through the TID like any other read
+	if absent {
+		return nil, ENOKEY
+	}
+
 	return r, nil
 }
 
-func (o *OTransaction) WriteInt64(k Key, intValue int64, partNum int) error {
-	r := o.Store().GetRecord(k, partNum)
-
-	if r == nil {
+// Updates are buffered per column until commit
+func (o *OTransaction) WriteColumn(t *Table, k Key, col int, v Value, partNum int) error {
+	wk := o.findWrite(t, k)
+	if wk == nil {
+		r := t.GetRecord(k, partNum)
+		if r == nil {
+			return ENOKEY
+		}
+		ok, tid, absent := readAbsent(r)
+		if !ok {
+			o.w.NStats[NREADABORTS]++
+			return EABORT
+		}
+		if !o.addRead(t, k, r, tid) {
+			o.w.NStats[NRCHANGEABORTS]++
+			return EABORT
+		}
+		if absent {
+			return ENOKEY
+		}
+		o.addWrite(t, k, partNum, r, WRITE_UPDATE)
+		wk = &o.wKeys[len(o.wKeys)-1]
+	} else if wk.op == WRITE_DELETE {
 		return ENOKEY
 	}
 
-	// Read this record
-	ok, tid := r.IsUnlocked()
-
-	if !ok {
-		o.w.NStats[NREADABORTS]++
-		return EABORT
+	if len(t.secIndexes) > 0 {
+		t.secChanges(k, partNum, col, func(i int) string { return o.column(wk, i).(string) },
+			func(int) string { return v.(string) }, o.addSecWrite)
 	}
 
-	//_, ok = o.rKeys[k]
-	ok = false
-	for j := 0; j < len(o.rKeys); j++ {
-		rk := &o.rKeys[j]
-		if rk.k == k {
-			ok = true
-			break
+	if wk.op == WRITE_INSERT {
+		wk.tup.Set(col, v)
+		return nil
+	}
+	for j := range wk.cols {
+		if wk.cols[j].col == col {
+			wk.cols[j].v = v
+			return nil
 		}
 	}
+	wk.cols = append(wk.cols, ColWrite{col: col, v: v})
+	return nil
+}
 
-	if !ok {
-		// Store this key
-		/*readKey := &ReadKey{
-			last: tid,
-			rec:  r,
+// IsUnlocked which also returns the absent flag as of that TID
+func readAbsent(r Record) (bool, TID, bool) {
+	ok, tid := r.IsUnlocked()
+	absent := r.IsAbsent()
+	if ok2, tid2 := r.IsUnlocked(); !ok2 || tid2 != tid {
+		return false, tid, absent
+	}
+	return ok, tid, absent
+}
+
+// Returns false if k was read before with another TID
+func (o *OTransaction) addRead(t *Table, k Key, r Record, tid TID) bool {
+	for j := 0; j < len(o.rKeys); j++ {
+		if o.rKeys[j].t == t && o.rKeys[j].k == k {
+			return o.rKeys[j].last == tid
 		}
-		o.rKeys[k] = readKey*/
-		n := len(o.rKeys)
-		o.rKeys = o.rKeys[0 : n+1]
-		o.rKeys[n].k = k
-		o.rKeys[n].last = tid
-		o.rKeys[n].rec = r
 	}
+	n := len(o.rKeys)
+	o.rKeys = append(o.rKeys, ReadKey{})
+	o.rKeys[n].t = t
+	o.rKeys[n].k = k
+	o.rKeys[n].last = tid
+	o.rKeys[n].rec = r
 
 	if tid > o.maxSeen {
 		o.maxSeen = tid
 	}
+	return true
+}
 
-	// Store this key
-	/*
-		writeKey := &WriteKey{
-			partNum: partNum,
-			v:       intValue,
-			locked:  false,
-			rec:     r,
+func (o *OTransaction) addWrite(t *Table, k Key, partNum int, r Record, op int) {
+	n := len(o.wKeys)
+	// Keep the column buffer of an earlier transaction
+	var cols []ColWrite
+	if n < cap(o.wKeys) {
+		cols = o.wKeys[:n+1][n].cols[:0]
+	}
+	o.wKeys = append(o.wKeys, WriteKey{})
+	wk := &o.wKeys[n]
+	wk.t = t
+	wk.k = k
+	wk.partNum = partNum
+	wk.rec = r
+	wk.op = op
+	wk.cols = cols
+	wk.locked = false
+}
+
+// An insert of this transaction changes the version of the index
+// node it goes into. A scanned node stays valid if nobody else
+// changed it; if it split, its new sibling now covers part of the
+// scanned range as well.
+func (o *OTransaction) fixNode(n IndexNode, before uint64, after uint64, sib IndexNode, sibVersion uint64) {
+	for j := 0; j < len(o.nodes); j++ {
+		nk := &o.nodes[j]
+		if nk.node != n {
+			continue
 		}
-		o.wKeys[k] = writeKey*/
-	ok = false
-	for j := 0; j < len(o.wKeys); j++ {
-		wk := &o.wKeys[j]
-		if wk.k == k {
-			ok = true
-			break
+		if nk.version == before {
+			nk.version = after
+			if sib != nil {
+				o.addNode(sib, sibVersion)
+			}
 		}
+		return
 	}
-	if !ok {
-		n := len(o.wKeys)
-		o.wKeys = o.wKeys[0 : n+1]
-		o.wKeys[n].k = k
-		o.wKeys[n].partNum = partNum
-		o.wKeys[n].intVal = intValue
-		o.wKeys[n].locked = false
-		o.wKeys[n].rec = r
+}
+
+func (o *OTransaction) addNode(n IndexNode, version uint64) {
+	for j := 0; j < len(o.nodes); j++ {
+		if o.nodes[j].node == n {
+			return
+		}
 	}
+	m := len(o.nodes)
+	o.nodes = append(o.nodes, NodeKey{})
+	o.nodes[m].node = n
+	o.nodes[m].version = version
+}
 
-	return nil
+// Scanned records join the read set, and index nodes covering the
+// range join the node set, which Commit checks against phantoms.
+// The scan does not see writes buffered by this transaction.
+// The returned slice is reused by the next Scan.
+func (o *OTransaction) Scan(t *Table, lo Key, hi Key, partNum int) ([]Record, error) {
+	o.scanRecs = o.scanRecs[:0]
+	conflict := false
+	t.parts[partNum].index.ScanNodes(lo, hi, func(k Key, r Record) bool {
+		ok, tid, absent := readAbsent(r)
+		if !ok {
+			conflict = true
+			return false
+		}
+		if !o.addRead(t, k, r, tid) {
+			conflict = true
+			return false
+		}
+		if !absent {
+			o.scanRecs = append(o.scanRecs, r)
+		}
+		return true
+	}, o.addNode)
+
+	if conflict {
+		o.w.NStats[NREADABORTS]++
+		return nil, EABORT
+	}
+	return o.scanRecs, nil
 }
 
-func (o *OTransaction) WriteString(k Key, sa *StrAttr, partNum int) error {
+// A missing key gets an absent record first, which the insert
+// then revives at commit like any other write
+func (o *OTransaction) Insert(t *Table, k Key, tup *Tuple, partNum int) error {
+	wk := o.findWrite(t, k)
+	if wk != nil {
+		if wk.op != WRITE_DELETE {
+			return EDUPKEY
+		}
+		wk.op = WRITE_INSERT
+		wk.cols = wk.cols[:0]
+	} else {
+		r, tid, created := t.getOrInsert(k, partNum, o.fixNode)
+		if created {
+			o.created = append(o.created, NewKey{t, k, partNum, r, tid})
+		}
+		ok, tid, absent := readAbsent(r)
+		if !ok {
+			o.w.NStats[NREADABORTS]++
+			return EABORT
+		}
+		if !o.addRead(t, k, r, tid) {
+			o.w.NStats[NRCHANGEABORTS]++
+			return EABORT
+		}
+		if !absent {
+			if missed(o.misses, t, k) {
+				o.w.NStats[NRCHANGEABORTS]++
+				return EABORT
+			}
+			return EDUPKEY
+		}
+		o.addWrite(t, k, partNum, r, WRITE_INSERT)
+		wk = &o.wKeys[len(o.wKeys)-1]
+	}
+
+	// Later writes of this transaction change its own copy
+	wk.tup = tup.Copy()
+	if len(t.secIndexes) > 0 {
+		t.secChanges(k, partNum, -1, nil, attrOf(wk.tup), o.addSecWrite)
+	}
 	return nil
-	/*
-		r := o.Store().GetRecord(k, partNum)
+}
 
+func (o *OTransaction) Delete(t *Table, k Key, partNum int) error {
+	wk := o.findWrite(t, k)
+	if wk == nil {
+		r := t.GetRecord(k, partNum)
 		if r == nil {
+			o.misses = append(o.misses, MissKey{t: t, k: k, partNum: partNum})
 			return ENOKEY
 		}
-
-		// Read this record
-		ok, tid := r.IsUnlocked()
-
+		ok, tid, absent := readAbsent(r)
 		if !ok {
 			o.w.NStats[NREADABORTS]++
 			return EABORT
 		}
+		if !o.addRead(t, k, r, tid) {
+			o.w.NStats[NRCHANGEABORTS]++
+			return EABORT
+		}
+		if absent {
+			return ENOKEY
+		}
+		o.addWrite(t, k, partNum, r, WRITE_UPDATE)
+		wk = &o.wKeys[len(o.wKeys)-1]
+	} else if wk.op == WRITE_DELETE {
+		return ENOKEY
+	}
 
-		_, ok = o.rKeys[k]
+	if len(t.secIndexes) > 0 {
+		t.secChanges(k, partNum, -1, func(i int) string { return o.column(wk, i).(string) },
+			nil, o.addSecWrite)
+	}
+	wk.op = WRITE_DELETE
+	return nil
+}
 
-		if !ok {
-			// Store this key
-			readKey := &ReadKey{
-				last: tid,
-				rec:  r,
+// Index changes of this transaction are applied to the returned keys
+func (o *OTransaction) LookupSec(si *SecIndex, val string, partNum int) ([]Key, error) {
+	e := si.entry(val, partNum)
+	ok, tid := e.IsUnlocked()
+	keys := e.Keys()
+	if ok2, tid2 := e.IsUnlocked(); !ok || !ok2 || tid2 != tid {
+		o.w.NStats[NREADABORTS]++
+		return nil, EABORT
+	}
+
+	found := false
+	for j := 0; j < len(o.secReads); j++ {
+		sr := &o.secReads[j]
+		if sr.e == e {
+			if sr.last != tid {
+				o.w.NStats[NRCHANGEABORTS]++
+				return nil, EABORT
 			}
-			o.rKeys[k] = readKey
+			found = true
+			break
 		}
-
+	}
+	if !found {
+		o.secReads = append(o.secReads, SecReadKey{e: e, last: tid})
 		if tid > o.maxSeen {
 			o.maxSeen = tid
 		}
+	}
 
-		// Store this key
-		writeKey := &WriteKey{
-			partNum: partNum,
-			v:       sa,
-			locked:  false,
-			rec:     r,
+	copied := false
+	for j := 0; j < len(o.secWrites); j++ {
+		sw := &o.secWrites[j]
+		if sw.e == e {
+			if !copied {
+				keys = append([]Key(nil), keys...)
+				copied = true
+			}
+			keys = applyKey(keys, sw.k, sw.add)
 		}
-		o.wKeys[k] = writeKey
+	}
+	return keys, nil
+}
 
-		return nil
-	*/
+func (o *OTransaction) findWrite(t *Table, k Key) *WriteKey {
+	for j := 0; j < len(o.wKeys); j++ {
+		if o.wKeys[j].t == t && o.wKeys[j].k == k {
+			return &o.wKeys[j]
+		}
+	}
+	return nil
+}
+
+// Column i of a record as this transaction sees it
+func (o *OTransaction) column(wk *WriteKey, i int) Value {
+	if wk.op == WRITE_INSERT {
+		return wk.tup.Get(i)
+	}
+	for j := range wk.cols {
+		if wk.cols[j].col == i {
+			return wk.cols[j].v
+		}
+	}
+	return wk.rec.Tuple().Get(i)
+}
+
+func (o *OTransaction) addSecWrite(e *SecEntry, k Key, add bool) error {
+	o.secWrites = append(o.secWrites, SecWriteKey{e: e, k: k, add: add})
+	return nil
+}
+
+func (o *OTransaction) secWritten(e *SecEntry) bool {
+	for j := 0; j < len(o.secWrites); j++ {
+		if o.secWrites[j].e == e {
+			return true
+		}
+	}
+	return false
 }
 
 func (o *OTransaction) Abort() TID {
@@ -320,9 +918,19 @@ func (o *OTransaction) Abort() TID {
 	for i := 0; i < len(o.wKeys); i++ {
 		wk := &o.wKeys[i]
 		if wk.locked {
-			wk.rec.Unlock(0)
+			wk.rec.Unlock(wk.former)
+			wk.locked = false
+		}
+	}
+	for i := 0; i < len(o.secWrites); i++ {
+		sw := &o.secWrites[i]
+		if sw.locked {
+			sw.e.Unlock(sw.former)
+			sw.locked = false
 		}
 	}
+	retireNew(o.w, o.created)
+	o.created = o.created[:0]
 	return 0
 }
 
@@ -339,11 +947,36 @@ func (o *OTransaction) Commit() TID {
 			return o.Abort()
 		}
 		wk.locked = true
+		wk.former = former
 		if former > o.maxSeen {
 			o.maxSeen = former
 		}
 	}
 
+	// Lock each changed secondary index entry once
+	for i := 0; i < len(o.secWrites); i++ {
+		sw := &o.secWrites[i]
+		dup := false
+		for j := 0; j < i; j++ {
+			if o.secWrites[j].e == sw.e {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		var ok bool
+		if ok, sw.former = sw.e.Lock(); !ok {
+			o.w.NStats[NLOCKABORTS]++
+			return o.Abort()
+		}
+		sw.locked = true
+		if sw.former > o.maxSeen {
+			o.maxSeen = sw.former
+		}
+	}
+
 	tid := o.w.commitTID()
 	if tid <= o.maxSeen {
 		o.w.ResetTID(o.maxSeen)
@@ -353,6 +986,13 @@ func (o *OTransaction) Commit() TID {
 		}
 	}
 
+	// The epoch is read with all writes locked, so that a
+	// transaction reading them commits in this epoch or a later one
+	var epoch uint64
+	if o.w.log != nil {
+		epoch = o.w.log.Epoch()
+	}
+
 	// Phase 2: Check conflicts
 	//for k, rk := range o.rKeys {
 	for i := 0; i < len(o.rKeys); i++ {
@@ -372,7 +1012,7 @@ func (o *OTransaction) Commit() TID {
 		ok2 = false
 		for j := 0; j < len(o.wKeys); j++ {
 			wk := &o.wKeys[j]
-			if wk.k == k {
+			if wk.t == rk.t && wk.k == k {
 				ok2 = true
 				break
 			}
@@ -384,17 +1024,108 @@ func (o *OTransaction) Commit() TID {
 		}
 	}
 
+	// Check that looked up secondary index entries did not change
+	for i := 0; i < len(o.secReads); i++ {
+		sr := &o.secReads[i]
+		ok, tmpTID := sr.e.IsUnlocked()
+		if tmpTID != sr.last {
+			o.w.NStats[NRCHANGEABORTS]++
+			return o.Abort()
+		}
+		if !ok && !o.secWritten(sr.e) {
+			o.w.NStats[NRWABORTS]++
+			return o.Abort()
+		}
+	}
+
+	// Check that keys found missing were not inserted since
+	for i := 0; i < len(o.misses); i++ {
+		mk := &o.misses[i]
+		r := mk.t.GetRecord(mk.k, mk.partNum)
+		if r == nil || o.findWrite(mk.t, mk.k) != nil {
+			continue
+		}
+		ok, _, absent := readAbsent(r)
+		if !ok || !absent {
+			o.w.NStats[NRCHANGEABORTS]++
+			return o.Abort()
+		}
+	}
+
+	// Check that no key was added to or removed from a scanned range
+	for i := 0; i < len(o.nodes); i++ {
+		nk := &o.nodes[i]
+		if nk.node.Version() != nk.version {
+			o.w.NStats[NPHANTOMABORTS]++
+			return o.Abort()
+		}
+	}
+
+	if o.w.log != nil && len(o.wKeys) > 0 {
+		o.logWrites(tid, epoch)
+	}
+
 	// Phase 3: Apply all writes
 	for i, _ := range o.wKeys {
 		wk := &o.wKeys[i]
-		//wk.rec.UpdateValue(wk.v)
-		wk.rec.UpdateValue(&wk.intVal)
+		switch wk.op {
+		case WRITE_UPDATE:
+			for j := range wk.cols {
+				wk.rec.SetColumn(wk.cols[j].col, wk.cols[j].v)
+			}
+		case WRITE_INSERT:
+			wk.rec.SetTuple(wk.tup)
+			wk.rec.SetAbsent(false)
+		case WRITE_DELETE:
+			wk.rec.SetAbsent(true)
+		}
 		wk.rec.Unlock(tid)
+		if wk.op == WRITE_DELETE {
+			o.w.retire(wk.t, wk.k, wk.partNum, wk.rec, tid)
+		}
+	}
+
+	for i := 0; i < len(o.secWrites); i++ {
+		sw := &o.secWrites[i]
+		sw.e.apply(sw.k, sw.add)
+	}
+	for i := 0; i < len(o.secWrites); i++ {
+		sw := &o.secWrites[i]
+		if sw.locked {
+			sw.e.Unlock(tid)
+			sw.locked = false
+		}
 	}
 
 	return tid
 }
 
+// Without the epoch logger, the record is made durable before
+// the writes are unlocked
+func (o *OTransaction) logWrites(tid TID, epoch uint64) {
+	w := o.w
+	w.log.Begin()
+	for i := range o.wKeys {
+		wk := &o.wKeys[i]
+		switch wk.op {
+		case WRITE_UPDATE:
+			for j := range wk.cols {
+				w.log.AppendUpdate(wk.t.ID, wk.partNum, wk.k, wk.cols[j].col, wk.cols[j].v)
+			}
+		case WRITE_INSERT:
+			w.log.AppendInsert(wk.t.ID, wk.partNum, wk.k, wk.tup)
+		case WRITE_DELETE:
+			w.log.AppendDelete(wk.t.ID, wk.partNum, wk.k)
+		}
+	}
+	w.log.End(tid, epoch)
+	if !w.log.Grouped() {
+		tm := time.Now()
+		w.log.Flush()
+		w.NFlush += time.Since(tm)
+	}
+}
+
 func (o *OTransaction) Store() *Store {
 	return o.s
 }
@@ -402,3 +1133,487 @@ func (o *OTransaction) Store() *Store {
 func (o *OTransaction) Worker() *Worker {
 	return o.w
 }
+
+type LockKey struct {
+	padding1  [64]byte
+	t         *Table
+	k         Key
+	exclusive bool
+	rec       *LRecord
+	padding2  [64]byte
+}
+
+type SecLockKey struct {
+	padding1  [64]byte
+	e         *SecEntry
+	exclusive bool
+	padding2  [64]byte
+}
+
+type UndoKey struct {
+	padding1 [64]byte
+	t        *Table
+	k        Key
+	partNum  int
+	rec      *LRecord
+	op       int
+	col      int
+	v        Value // The value an update sets
+	old      Value
+	padding2 [64]byte
+}
+
+// 2PL Transaction Implementation
+// NO_WAIT: a lock conflict aborts the transaction at once.
+// Writes are applied in place and undone on abort.
+type LTransaction struct {
+	padding0 [64]byte
+	w        *Worker
+	s        *Store
+	lKeys    []LockKey
+	uKeys    []UndoKey
+	secLocks []SecLockKey
+	secUndo  []SecWriteKey
+	misses   []MissKey
+	created  []NewKey
+	deps     []CommitDep
+	chain    int
+	maxSeen  TID
+	scanRecs []Record
+	padding  [64]byte
+}
+
+func StartLTransaction(w *Worker) *LTransaction {
+	tx := &LTransaction{
+		w:     w,
+		s:     w.store,
+		lKeys: make([]LockKey, 0, 100),
+		uKeys: make([]UndoKey, 0, 100),
+		deps:  make([]CommitDep, 0, 100),
+	}
+	return tx
+}
+
+func (l *LTransaction) Reset(q *Query) {
+	l.lKeys = l.lKeys[:0]
+	l.uKeys = l.uKeys[:0]
+	l.secLocks = l.secLocks[:0]
+	l.secUndo = l.secUndo[:0]
+	l.misses = l.misses[:0]
+	l.created = l.created[:0]
+	l.deps = l.deps[:0]
+	l.chain = 0
+	l.maxSeen = 0
+}
+
+func (l *LTransaction) lock(t *Table, k Key, partNum int, exclusive bool) (*LRecord, error) {
+	for i := 0; i < len(l.lKeys); i++ {
+		lk := &l.lKeys[i]
+		if lk.t == t && lk.k == k {
+			if exclusive && !lk.exclusive {
+				if !lk.rec.Upgrade() {
+					l.w.NStats[NLOCKABORTS]++
+					l.Abort()
+					return nil, EABORT
+				}
+				lk.exclusive = true
+			}
+			return lk.rec, nil
+		}
+	}
+
+	// Locks are released by the caller's Abort after ENOKEY, as a
+	// transaction may go on, e.g. to insert the missing key
+	r := t.GetRecord(k, partNum)
+	if r == nil {
+		l.misses = append(l.misses, MissKey{t: t, k: k, partNum: partNum})
+		return nil, ENOKEY
+	}
+
+	return l.lockRecord(t, k, r.(*LRecord), exclusive)
+}
+
+func (l *LTransaction) locked(t *Table, k Key) bool {
+	for i := 0; i < len(l.lKeys); i++ {
+		if l.lKeys[i].t == t && l.lKeys[i].k == k {
+			return true
+		}
+	}
+	return false
+}
+
+// lr must not be locked by this transaction yet
+func (l *LTransaction) lockRecord(t *Table, k Key, lr *LRecord, exclusive bool) (*LRecord, error) {
+	var ok bool
+	if exclusive {
+		ok = lr.WLock()
+	} else {
+		ok = lr.RLock()
+	}
+	if !ok {
+		l.w.NStats[NLOCKABORTS]++
+		l.Abort()
+		return nil, EABORT
+	}
+
+	n := len(l.lKeys)
+	l.lKeys = append(l.lKeys, LockKey{})
+	l.lKeys[n].t = t
+	l.lKeys[n].k = k
+	l.lKeys[n].exclusive = exclusive
+	l.lKeys[n].rec = lr
+
+	if lr.last > l.maxSeen {
+		l.maxSeen = lr.last
+	}
+
+	// With early lock release, the last writer may still be
+	// waiting for its commit record to become durable
+	d := &lr.dep
+	if d.lsn != 0 && l.w.logs[d.worker].Durable() < d.lsn {
+		l.deps = append(l.deps, *d)
+		if d.chain+1 > l.chain {
+			l.chain = d.chain + 1
+		}
+	}
+
+	return lr, nil
+}
+
+func (l *LTransaction) Read(t *Table, k Key, partNum int, force bool) (Record, error) {
+	lr, err := l.lock(t, k, partNum, false)
+	if err != nil {
+		return nil, err
+	}
+	if lr.absent {
+		return nil, ENOKEY
+	}
+	return lr, nil
+}
+
+func (l *LTransaction) addUndo(t *Table, k Key, partNum int, lr *LRecord, op int) *UndoKey {
+	n := len(l.uKeys)
+	l.uKeys = append(l.uKeys, UndoKey{})
+	uk := &l.uKeys[n]
+	uk.t = t
+	uk.k = k
+	uk.partNum = partNum
+	uk.rec = lr
+	uk.op = op
+	return uk
+}
+
+func (l *LTransaction) WriteColumn(t *Table, k Key, col int, v Value, partNum int) error {
+	lr, err := l.lock(t, k, partNum, true)
+	if err != nil {
+		return err
+	}
+	if lr.absent {
+		return ENOKEY
+	}
+
+	if len(t.secIndexes) > 0 {
+		err = t.secChanges(k, partNum, col, lr.tuple.GetString,
+			func(int) string { return v.(string) }, l.writeSec)
+		if err != nil {
+			return err
+		}
+	}
+
+	uk := l.addUndo(t, k, partNum, lr, WRITE_UPDATE)
+	uk.col = col
+	uk.v = v
+	uk.old = lr.tuple.Get(col)
+
+	lr.SetColumn(col, v)
+	return nil
+}
+
+// Scanned records are read locked, but the range is not, so a
+// scan under 2PL is not protected against phantoms. Records found
+// absent once locked are left out. The returned slice is reused
+// by the next Scan.
+func (l *LTransaction) Scan(t *Table, lo Key, hi Key, partNum int) ([]Record, error) {
+	l.scanRecs = l.scanRecs[:0]
+	t.parts[partNum].index.Scan(lo, hi, func(k Key, r Record) bool {
+		l.scanRecs = append(l.scanRecs, r)
+		return true
+	})
+
+	n := 0
+	for _, r := range l.scanRecs {
+		k := r.GetKey()
+		held := false
+		for i := 0; i < len(l.lKeys); i++ {
+			if l.lKeys[i].rec == r.(*LRecord) {
+				held = true
+				break
+			}
+		}
+		if !held {
+			if _, err := l.lockRecord(t, k, r.(*LRecord), false); err != nil {
+				return nil, err
+			}
+		}
+		if !r.IsAbsent() {
+			l.scanRecs[n] = r
+			n++
+		}
+	}
+	return l.scanRecs[:n], nil
+}
+
+// Inserts and deletes are applied in place under an exclusive lock
+// and undone on abort. A missing key gets an absent record first.
+func (l *LTransaction) Insert(t *Table, k Key, tup *Tuple, partNum int) error {
+	if r, tid, created := t.getOrInsert(k, partNum, nil); created {
+		l.created = append(l.created, NewKey{t, k, partNum, r, tid})
+	}
+	lr, err := l.lock(t, k, partNum, true)
+	if err == ENOKEY {
+		// The tombstone found was unlinked in between
+		l.w.NStats[NRCHANGEABORTS]++
+		l.Abort()
+		return EABORT
+	} else if err != nil {
+		return err
+	}
+	if !lr.absent {
+		if missed(l.misses, t, k) {
+			l.w.NStats[NRCHANGEABORTS]++
+			l.Abort()
+			return EABORT
+		}
+		return EDUPKEY
+	}
+
+	l.addUndo(t, k, partNum, lr, WRITE_INSERT)
+	lr.SetTuple(tup)
+	lr.absent = false
+	if len(t.secIndexes) > 0 {
+		return t.secChanges(k, partNum, -1, nil, attrOf(&lr.tuple), l.writeSec)
+	}
+	return nil
+}
+
+func (l *LTransaction) Delete(t *Table, k Key, partNum int) error {
+	lr, err := l.lock(t, k, partNum, true)
+	if err != nil {
+		return err
+	}
+	if lr.absent {
+		return ENOKEY
+	}
+
+	if len(t.secIndexes) > 0 {
+		err = t.secChanges(k, partNum, -1, attrOf(&lr.tuple), nil, l.writeSec)
+		if err != nil {
+			return err
+		}
+	}
+	l.addUndo(t, k, partNum, lr, WRITE_DELETE)
+	lr.absent = true
+	return nil
+}
+
+func (l *LTransaction) LookupSec(si *SecIndex, val string, partNum int) ([]Key, error) {
+	e := si.entry(val, partNum)
+	if err := l.lockSec(e, false); err != nil {
+		return nil, err
+	}
+	return e.Keys(), nil
+}
+
+func (l *LTransaction) lockSec(e *SecEntry, exclusive bool) error {
+	for i := 0; i < len(l.secLocks); i++ {
+		sl := &l.secLocks[i]
+		if sl.e == e {
+			if exclusive && !sl.exclusive {
+				if !e.rwLock.TryUpgrade() {
+					l.w.NStats[NLOCKABORTS]++
+					l.Abort()
+					return EABORT
+				}
+				sl.exclusive = true
+			}
+			return nil
+		}
+	}
+
+	var ok bool
+	if exclusive {
+		ok = e.rwLock.TryLock()
+	} else {
+		ok = e.rwLock.TryRLock()
+	}
+	if !ok {
+		l.w.NStats[NLOCKABORTS]++
+		l.Abort()
+		return EABORT
+	}
+	l.secLocks = append(l.secLocks, SecLockKey{e: e, exclusive: exclusive})
+	return nil
+}
+
+// Entries are changed in place under an exclusive lock
+func (l *LTransaction) writeSec(e *SecEntry, k Key, add bool) error {
+	if err := l.lockSec(e, true); err != nil {
+		return err
+	}
+	l.secUndo = append(l.secUndo, SecWriteKey{e: e, k: k, add: add})
+	e.apply(k, add)
+	return nil
+}
+
+func (l *LTransaction) release() {
+	for i := 0; i < len(l.lKeys); i++ {
+		lk := &l.lKeys[i]
+		if lk.exclusive {
+			lk.rec.WUnlock()
+		} else {
+			lk.rec.RUnlock()
+		}
+	}
+	l.lKeys = l.lKeys[:0]
+	for i := 0; i < len(l.secLocks); i++ {
+		sl := &l.secLocks[i]
+		if sl.exclusive {
+			sl.e.rwLock.Unlock()
+		} else {
+			sl.e.rwLock.RUnlock()
+		}
+	}
+	l.secLocks = l.secLocks[:0]
+}
+
+func (l *LTransaction) Abort() TID {
+	// Undo writes in reverse order
+	for i := len(l.uKeys) - 1; i >= 0; i-- {
+		uk := &l.uKeys[i]
+		switch uk.op {
+		case WRITE_INSERT:
+			uk.rec.absent = true
+		case WRITE_DELETE:
+			uk.rec.absent = false
+		default:
+			uk.rec.SetColumn(uk.col, uk.old)
+		}
+	}
+	l.uKeys = l.uKeys[:0]
+	for i := len(l.secUndo) - 1; i >= 0; i-- {
+		su := &l.secUndo[i]
+		su.e.apply(su.k, !su.add)
+	}
+	l.secUndo = l.secUndo[:0]
+	l.release()
+	retireNew(l.w, l.created)
+	l.created = l.created[:0]
+	return 0
+}
+
+func (l *LTransaction) Commit() TID {
+	w := l.w
+
+	// Check that keys found missing were not inserted since
+	for i := 0; i < len(l.misses); i++ {
+		mk := &l.misses[i]
+		if l.locked(mk.t, mk.k) {
+			continue
+		}
+		r := mk.t.GetRecord(mk.k, mk.partNum)
+		if r == nil {
+			continue
+		}
+		lr := r.(*LRecord)
+		if !lr.RLock() {
+			w.NStats[NRCHANGEABORTS]++
+			return l.Abort()
+		}
+		absent := lr.absent
+		lr.RUnlock()
+		if !absent {
+			w.NStats[NRCHANGEABORTS]++
+			return l.Abort()
+		}
+	}
+
+	tid := w.commitTID()
+	if tid <= l.maxSeen {
+		w.ResetTID(l.maxSeen)
+		tid = w.commitTID()
+	}
+
+	var lsn uint64
+	if w.log != nil && len(l.uKeys) > 0 {
+		w.log.Begin()
+		for i := 0; i < len(l.uKeys); i++ {
+			uk := &l.uKeys[i]
+			switch uk.op {
+			case WRITE_INSERT:
+				// Still locked, so the tuple is the one inserted
+				// with later updates applied, which follow anyway
+				w.log.AppendInsert(uk.t.ID, uk.partNum, uk.k, &uk.rec.tuple)
+			case WRITE_DELETE:
+				w.log.AppendDelete(uk.t.ID, uk.partNum, uk.k)
+			default:
+				w.log.AppendUpdate(uk.t.ID, uk.partNum, uk.k, uk.col, uk.v)
+			}
+		}
+		lsn = w.log.End(tid, w.log.Epoch())
+		if w.log.Grouped() {
+			// Durable with its epoch; nobody waits for it
+			lsn = 0
+		}
+	}
+
+	for i := 0; i < len(l.uKeys); i++ {
+		uk := &l.uKeys[i]
+		uk.rec.last = tid
+		if lsn != 0 {
+			uk.rec.dep.worker = w.ID
+			uk.rec.dep.lsn = lsn
+			uk.rec.dep.chain = l.chain
+		}
+		if uk.op == WRITE_DELETE {
+			w.retire(uk.t, uk.k, uk.partNum, uk.rec, tid)
+		}
+	}
+
+	if *EarlyRelease {
+		l.release()
+		l.durable(lsn)
+	} else {
+		l.durable(lsn)
+		l.release()
+	}
+
+	return tid
+}
+
+// Make the commit record durable, then wait for all transactions
+// this one depends on
+func (l *LTransaction) durable(lsn uint64) {
+	w := l.w
+	if lsn != 0 {
+		tm := time.Now()
+		w.log.Flush()
+		w.NFlush += time.Since(tm)
+	}
+
+	if len(l.deps) > 0 {
+		w.NDepWait += waitDeps(w.logs, l.deps)
+		w.NStats[NDEPTXN]++
+		w.NStats[NDEPCHAIN] += int64(l.chain)
+		if int64(l.chain) > w.MaxDepChain {
+			w.MaxDepChain = int64(l.chain)
+		}
+	}
+}
+
+func (l *LTransaction) Store() *Store {
+	return l.s
+}
+
+func (l *LTransaction) Worker() *Worker {
+	return l.w
+}
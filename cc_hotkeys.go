@@ -0,0 +1,161 @@
+package testbed
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// ReplicateKeys copies the records of keys from their partitions into
+// all others, in partition mode and before transactions run. Reads of
+// a replicated key are then served by any partition a transaction
+// holds, and writes go to all copies, so they need all partitions.
+// Copies are not counted by NKeys, but scans of a partition see them.
+func (t *Table) ReplicateKeys(keys []Key) {
+	if *SysType != PARTITION {
+		clog.Error("Replicated Keys Need Partition Mode")
+	}
+	if t.Partitioner == nil {
+		clog.Error("Replicated Keys of Table %s Need a Partitioner", t.Name)
+	}
+	if t.hot == nil {
+		t.hot = make(map[Key]bool)
+	}
+	for _, k := range keys {
+		if t.hot[k] {
+			continue
+		}
+		home := t.GetPartition(k)
+		r := t.GetRecord(k, home)
+		if r == nil || r.IsAbsent() {
+			clog.Error("Replicated Key %v of Table %s Does Not Exist", k, t.Name)
+		}
+		tup := tupleOf(t.parts[home].ac, r)
+		for p := range t.parts {
+			if p == home {
+				continue
+			}
+			if t.CreateKV(k, tup.Copy(), p) == nil {
+				clog.Error("Replicated Key %v of Table %s Exists in Partition %v", k, t.Name, p)
+			}
+			atomic.AddInt64(&t.nKeys, -1)
+		}
+		t.hot[k] = true
+	}
+}
+
+// Replicated returns the keys copied into every partition
+func (t *Table) Replicated() []Key {
+	keys := make([]Key, 0, len(t.hot))
+	for k := range t.hot {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// SetReplicated makes the generator route the keys t replicates:
+// reading them keeps a transaction in its own partition, writing
+// them takes all partitions
+func (tg *TxnGen) SetReplicated(t *Table) {
+	tg.replicated = t
+	tg.q.hot = t.hot
+}
+
+// Sets accessParts to home, unless it is negative, and the partitions
+// the keys of q need. A key still migrating needs the partition it
+// moves from as well, and a scan the partitions of all keys it covers.
+func (q *Query) route(home int) {
+	if len(q.need) != *NumPart {
+		q.need = make([]bool, *NumPart)
+	}
+	for i := range q.need {
+		q.need[i] = false
+	}
+	// Read first, so that keys located by a later mapping reroute q
+	q.version = mappingVersion(q.partitioner)
+	if home >= 0 {
+		q.need[home] = true
+	}
+	all := false
+	for _, k := range q.rKeys {
+		if !q.hot[k] {
+			q.needKey(k)
+		}
+	}
+	for _, k := range q.wKeys {
+		if q.hot[k] {
+			all = true
+		} else {
+			q.needKey(k)
+		}
+	}
+	if q.TXN == SCAN_INT {
+		for _, k := range q.rKeys {
+			lo := ParseKey(k)
+			for x := lo + 1; x < lo+int64(*ScanLen); x++ {
+				q.needKey(CKey(x))
+			}
+		}
+		q.needSources()
+	}
+	q.accessParts = q.accessParts[:0]
+	for p, need := range q.need {
+		if all || need {
+			q.accessParts = append(q.accessParts, p)
+		}
+	}
+}
+
+// A scan reaches keys beyond its own, which may still be moving into
+// the partitions it takes
+func (q *Query) needSources() {
+	hp, ok := q.partitioner.(*HashPartitioner)
+	if !ok || hp.mapping() == nil {
+		return
+	}
+	for _, mv := range hp.mapping().moves {
+		if mv.moving && q.need[mv.to] {
+			q.need[mv.from] = true
+		}
+	}
+}
+
+func (q *Query) needKey(k Key) {
+	part, from := locate(q.partitioner, k)
+	q.need[part] = true
+	if from >= 0 {
+		q.need[from] = true
+	}
+}
+
+// HotKeys returns the n keys read most often by nQueries queries of
+// each generator, most often first. Keys mostly written are poor
+// candidates, as every write of a replicated key takes all partitions.
+func HotKeys(gens []*TxnGen, nQueries int, n int) []Key {
+	counts := make(map[Key]int)
+	for _, tg := range gens {
+		for i := 0; i < nQueries; i++ {
+			for _, k := range tg.GenOneQuery().rKeys {
+				counts[k]++
+			}
+		}
+	}
+	keys := make([]Key, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
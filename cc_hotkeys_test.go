@@ -0,0 +1,112 @@
+package testbed
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestReplicatedKeys(t *testing.T) {
+	fmt.Println("===============================")
+	fmt.Println("Test Replicated Keys Begin")
+	fmt.Println("===============================")
+
+	defer func() {
+		*CrossPercent = 0
+	}()
+
+	*SysType = PARTITION
+	*NumPart = 2
+	*CrossPercent = 100
+	nKeys := int64(8)
+	nParts := 2
+	nWorkers := 2
+	hp := &HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+	}
+	pKeysArray := make([]int64, nParts)
+	for i := int64(0); i < nKeys; i++ {
+		pKeysArray[hp.GetPartition(CKey(i))]++
+	}
+
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), hp, "")
+	for i := int64(0); i < nKeys; i++ {
+		k := CKey(i)
+		table.CreateKV(k, table.Schema.MakeTuple(int64(0)), hp.GetPartition(k))
+	}
+	// All keys of partition 1
+	var hot []Key
+	for i := int64(1); i < nKeys; i += 2 {
+		hot = append(hot, CKey(i))
+	}
+	table.ReplicateKeys(hot)
+	if table.NKeys() != nKeys || len(table.Replicated()) != len(hot) {
+		t.Errorf("%v keys and %v replicated after replication", table.NKeys(), len(table.Replicated()))
+	}
+
+	// Reads of partition 1 stay in partition 0
+	zk := NewZipfKey(0, nKeys, nParts, pKeysArray, 1, hp)
+	gen := NewTxnGen(0, ADD_ONE, 100, 4, 2, zk)
+	gen.SetReplicated(table)
+	for i := 0; i < 100; i++ {
+		if q := gen.GenOneQuery(); len(q.accessParts) != 1 || q.accessParts[0] != 0 {
+			t.Errorf("Read only query takes partitions %v", q.accessParts)
+			break
+		}
+	}
+
+	if keys := HotKeys([]*TxnGen{gen}, 100, 3); len(keys) != 3 {
+		t.Errorf("Asked for 3 hot keys; got %v", keys)
+	}
+
+	coord := NewCoordinator(nWorkers, store)
+	written := make([]map[Key]int64, nWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			written[n] = make(map[Key]int64)
+			zk := NewZipfKey(n, nKeys, nParts, pKeysArray, 1, hp)
+			gen := NewTxnGen(n, ADD_ONE, 50, 4, 2, zk)
+			gen.SetReplicated(table)
+			for j := 0; j < 300; j++ {
+				q := gen.GenOneQuery()
+				if _, err := coord.Workers[n].One(q); err != nil {
+					t.Errorf("Worker %v: query fails with %v", n, err)
+				}
+				for _, k := range q.wKeys {
+					written[n][k]++
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	coord.Close()
+
+	for i := int64(0); i < nKeys; i++ {
+		k := CKey(i)
+		var expected int64
+		for _, w := range written {
+			expected += w[k]
+		}
+		parts := []int{hp.GetPartition(k)}
+		if table.hot[k] {
+			parts = []int{0, 1}
+		}
+		for _, p := range parts {
+			if v := table.GetRecord(k, p).Tuple().GetInt64(0); v != expected {
+				t.Errorf("Key %v is %v in partition %v; expected %v", i, v, p, expected)
+			}
+		}
+	}
+	if table.GetRecord(CKey(0), 1) != nil {
+		t.Errorf("Key 0 is copied though not replicated")
+	}
+
+	fmt.Println("=============================")
+	fmt.Println("Test Replicated Keys End")
+	fmt.Println("=============================")
+}
@@ -0,0 +1,136 @@
+package testbed
+
+import (
+	"flag"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var IndexType = flag.String("index", "", "Default primary index of tables: hash, lfhash or btree; empty picks hash in partition mode and lfhash in OCC and 2PL")
+
+// Index maps keys to records within one partition
+type Index interface {
+	Get(k Key) Record
+	// Put inserts r unless k exists; it returns false in that case
+	Put(k Key, r Record) bool
+	// PutNodes is Put which also reports the node k went into, with
+	// its version before and after the insert, and the new sibling
+	// with its version if that node split
+	PutNodes(k Key, r Record, nodeFn PutNodeFunc) bool
+	// Remove unlinks k if it maps to r; it returns false otherwise
+	Remove(k Key, r Record) bool
+	// ForEach visits all keys in no given order until fn returns
+	// false. Keys put or removed meanwhile may be missed; fn must
+	// not use the index.
+	ForEach(fn func(k Key, r Record) bool)
+	// Scan visits records with lo <= key <= hi in key order
+	// until fn returns false
+	Scan(lo Key, hi Key, fn func(k Key, r Record) bool)
+	// ScanNodes is Scan which also reports every node it visits,
+	// together with the version the node had during the visit
+	ScanNodes(lo Key, hi Key, fn func(k Key, r Record) bool, nodeFn func(n IndexNode, version uint64))
+}
+
+// The version of an index node changes whenever a key is
+// added to or removed from the key range it covers
+type IndexNode interface {
+	Version() uint64
+}
+
+type PutNodeFunc func(n IndexNode, before uint64, after uint64, sib IndexNode, sibVersion uint64)
+
+func NewIndex(indexType string) Index {
+	switch indexType {
+	case "hash":
+		return NewHashIndex()
+	case "lfhash":
+		return NewLFHashIndex()
+	case "btree":
+		return NewBTree()
+	}
+	clog.Error("Index Type %s Not Supported", indexType)
+	return nil
+}
+
+// Records are spread over CHUNKS maps by the low byte of int keys
+// and the hash of others. Maps are not locked, so that reads cost
+// nothing more: keys may only be put or removed while nobody else
+// uses the partition, i.e. before workers start or under its lock in
+// partition mode, the only mode tables take it in. Keys are not
+// ordered, so Scan is not supported.
+type HashIndex struct {
+	padding1 [64]byte
+	data     []*Chunk
+	padding2 [64]byte
+}
+
+func NewHashIndex() *HashIndex {
+	h := &HashIndex{
+		data: make([]*Chunk, CHUNKS),
+	}
+	var bb1 byte
+	for j := 0; j < CHUNKS; j++ {
+		chunk := &Chunk{
+			rows: make(map[Key]Record),
+		}
+		bb1 = byte(j)
+		h.data[bb1] = chunk
+	}
+	return h
+}
+
+func chunkOf(k Key) int {
+	if len(k) == INTKEYLEN {
+		return int(k[INTKEYLEN-1])
+	}
+	return int(k.Hash() % CHUNKS)
+}
+
+func (h *HashIndex) Get(k Key) Record {
+	chunk := h.data[chunkOf(k)]
+	r, ok := chunk.rows[k]
+	if !ok {
+		return nil
+	}
+	return r
+}
+
+func (h *HashIndex) Put(k Key, r Record) bool {
+	chunk := h.data[chunkOf(k)]
+	if _, ok := chunk.rows[k]; ok {
+		return false
+	}
+	chunk.rows[k] = r
+	return true
+}
+
+func (h *HashIndex) PutNodes(k Key, r Record, nodeFn PutNodeFunc) bool {
+	return h.Put(k, r)
+}
+
+func (h *HashIndex) Remove(k Key, r Record) bool {
+	chunk := h.data[chunkOf(k)]
+	if old, ok := chunk.rows[k]; !ok || old != r {
+		return false
+	}
+	delete(chunk.rows, k)
+	return true
+}
+
+func (h *HashIndex) ForEach(fn func(k Key, r Record) bool) {
+	for _, chunk := range h.data {
+		for k, r := range chunk.rows {
+			if !fn(k, r) {
+				return
+			}
+		}
+	}
+}
+
+func (h *HashIndex) Scan(lo Key, hi Key, fn func(k Key, r Record) bool) {
+	clog.Error("Hash index does not support Scan; use -index btree")
+}
+
+func (h *HashIndex) ScanNodes(lo Key, hi Key, fn func(k Key, r Record) bool, nodeFn func(n IndexNode, version uint64)) {
+	clog.Error("Hash index does not support Scan; use -index btree")
+}
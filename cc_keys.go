@@ -1,18 +1,145 @@
 package testbed
 
+import (
+	"strconv"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// Keys are byte strings ordered bytewise. An int key made by CKey is
+// INTKEYLEN bytes big-endian with the sign bit flipped, so that int
+// keys sort like their ints. A composite key concatenates its parts:
+// ints encoded like int keys, strings and bytes with each 0x00
+// escaped as 0x00 0xFF and ended by 0x00 0x01. No part is then a
+// prefix of another, and composite keys sort part by part.
+const (
+	INTKEYLEN = 8
+)
+
 func CKey(x int64) Key {
-	/*
-		var b [16]byte
-		var i uint64
-		for i = 0; i < 8; i++ {
-			b[i] = byte(x >> (i * 8))
-		}
-		return Key(b)
-	*/
-	return Key(x)
+	var b [INTKEYLEN]byte
+	putIntKey(b[:], x)
+	return Key(b[:])
 }
 
+// ParseKey returns the int of an int key, or of the leading int part
+// of a composite key
 func ParseKey(key Key) int64 {
-	//intKey := int64(key[0]) + int64(key[1])<<8 + int64(key[2])<<16 + int64(key[3])<<24 + int64(key[4])<<32 + int64(key[5])<<40 + int64(key[6])<<48 + int64(key[7])<<56
-	return int64(key)
+	if len(key) < INTKEYLEN {
+		clog.Error("Key of %v Bytes Has No Int Part", len(key))
+	}
+	var x uint64
+	for i := 0; i < INTKEYLEN; i++ {
+		x = x<<8 | uint64(key[i])
+	}
+	return int64(x ^ 1<<63)
+}
+
+func BytesKey(b []byte) Key {
+	return Key(b)
+}
+
+// CompositeKey encodes parts of type int64, int, string or []byte
+func CompositeKey(parts ...Value) Key {
+	var b []byte
+	for _, p := range parts {
+		switch v := p.(type) {
+		case int64:
+			b = appendIntKey(b, v)
+		case int:
+			b = appendIntKey(b, int64(v))
+		case string:
+			b = appendStringKey(b, v)
+		case []byte:
+			b = appendStringKey(b, string(v))
+		default:
+			clog.Error("Key Part Type %T Not Supported", p)
+		}
+	}
+	return Key(b)
+}
+
+// SplitKey decodes a composite key whose parts have the given types,
+// each INT64, STRING or BYTES
+func SplitKey(key Key, types ...ColType) []Value {
+	parts := make([]Value, len(types))
+	pos := 0
+	for i, ct := range types {
+		switch ct {
+		case INT64:
+			parts[i] = ParseKey(key[pos:])
+			pos += INTKEYLEN
+		case STRING, BYTES:
+			var b []byte
+			for {
+				if pos+1 >= len(key) {
+					clog.Error("Key Part %v Is Not Terminated", i)
+				}
+				if key[pos] != 0 {
+					b = append(b, key[pos])
+					pos++
+					continue
+				}
+				pos += 2
+				if key[pos-1] == 0x01 {
+					break
+				}
+				b = append(b, 0)
+			}
+			if ct == STRING {
+				parts[i] = string(b)
+			} else {
+				parts[i] = b
+			}
+		default:
+			clog.Error("Key Part Type %v Not Supported", ct)
+		}
+	}
+	if pos != len(key) {
+		clog.Error("Key Has %v Bytes Left", len(key)-pos)
+	}
+	return parts
+}
+
+func putIntKey(b []byte, x int64) {
+	u := uint64(x) ^ 1<<63
+	for i := INTKEYLEN - 1; i >= 0; i-- {
+		b[i] = byte(u)
+		u >>= 8
+	}
+}
+
+func appendIntKey(b []byte, x int64) []byte {
+	n := len(b)
+	b = append(b, make([]byte, INTKEYLEN)...)
+	putIntKey(b[n:], x)
+	return b
+}
+
+func appendStringKey(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		b = append(b, s[i])
+		if s[i] == 0 {
+			b = append(b, 0xFF)
+		}
+	}
+	return append(b, 0, 0x01)
+}
+
+// Hash is FNV-1a over the bytes of the key
+func (k Key) Hash() uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(k); i++ {
+		h ^= uint64(k[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// Keys of INTKEYLEN bytes print as ints, others quoted
+func (k Key) String() string {
+	if len(k) == INTKEYLEN {
+		return strconv.FormatInt(ParseKey(k), 10)
+	}
+	return strconv.Quote(string(k))
 }
@@ -0,0 +1,94 @@
+package testbed
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	fmt.Println("================")
+	fmt.Println("Test Keys Begin")
+	fmt.Println("================")
+
+	ints := []int64{math.MinInt64, -5, -1, 0, 1, 255, 256, math.MaxInt64}
+	for i, x := range ints {
+		if ParseKey(CKey(x)) != x {
+			t.Errorf("Int key %v parses to %v", x, ParseKey(CKey(x)))
+		}
+		if i > 0 && CKey(ints[i-1]) >= CKey(x) {
+			t.Errorf("Int key %v sorts before %v", x, ints[i-1])
+		}
+	}
+
+	// Composite keys sort part by part, whatever their bytes
+	keys := []Key{
+		CompositeKey(1, "a", int64(9)),
+		CompositeKey(1, "a\x00", int64(0)),
+		CompositeKey(1, "ab", int64(0)),
+		CompositeKey(2, "", int64(0)),
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Errorf("Composite key %v sorts before %v", keys[i], keys[i-1])
+		}
+	}
+	parts := SplitKey(CompositeKey(int64(3), "x\x00y", []byte{0, 1}), INT64, STRING, BYTES)
+	if parts[0].(int64) != 3 || parts[1].(string) != "x\x00y" || !bytes.Equal(parts[2].([]byte), []byte{0, 1}) {
+		t.Errorf("Composite key splits into %v", parts)
+	}
+
+	// A warehouse stays in one partition; other keys go by hash
+	hp := &HashPartitioner{NParts: 4, IntLed: true}
+	if hp.GetPartition(CompositeKey(6, 1, 2)) != hp.GetPartition(CKey(6)) {
+		t.Errorf("Composite key goes to another partition than its leading part")
+	}
+	for _, k := range []Key{BytesKey([]byte("ab")), CKey(-2), CKey(math.MinInt64)} {
+		if p := hp.GetPartition(k); p < 0 || p >= 4 {
+			t.Errorf("Key %v goes to partition %v", k, p)
+		}
+	}
+	hp = &HashPartitioner{NParts: 4}
+	spread := make(map[int]bool)
+	for i := 0; i < 64; i++ {
+		for _, k := range []Key{BytesKey([]byte(fmt.Sprintf("customer-%04d", i))), CompositeKey("warehouse", i)} {
+			p := hp.GetPartition(k)
+			if p < 0 || p >= 4 || p != int(k.Hash()%4) {
+				t.Errorf("Key %v goes to partition %v", k, p)
+			}
+			spread[p] = true
+		}
+	}
+	if len(spread) != 4 {
+		t.Errorf("Byte keys go to partitions %v only", spread)
+	}
+
+	// Both indexes hold byte keys; the B+-tree scans composite ranges
+	for _, index := range []string{"hash", "btree"} {
+		idx := NewIndex(index)
+		for w := 1; w <= 3; w++ {
+			for o := 0; o < 100; o++ {
+				k := CompositeKey(w, fmt.Sprintf("d%v", o%2), o)
+				idx.Put(k, MakeRecord(k, intSchema.MakeTuple(int64(o))))
+			}
+		}
+		if r := idx.Get(CompositeKey(2, "d1", 51)); r == nil || r.Tuple().GetInt64(0) != 51 {
+			t.Errorf("Index %v misses a composite key", index)
+		}
+		if index == "btree" {
+			count := 0
+			idx.Scan(CompositeKey(2, "d1", 0), CompositeKey(2, "d1", math.MaxInt64), func(k Key, r Record) bool {
+				count++
+				return true
+			})
+			if count != 50 {
+				t.Errorf("Scan of one district returns %v keys; expected 50", count)
+			}
+		}
+	}
+
+	fmt.Println("==============")
+	fmt.Println("Test Keys End")
+	fmt.Println("==============")
+}
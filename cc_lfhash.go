@@ -0,0 +1,255 @@
+package testbed
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+const (
+	LFSEGBITS    = 10
+	LFSEGSIZE    = 1 << LFSEGBITS // Buckets of the first segment
+	LFSEGMENTS   = 64 - LFSEGBITS + 1
+	LFLOADFACTOR = 2 // Records per bucket before the table doubles
+	LFINITSIZE   = 16
+)
+
+// LFHashIndex is a lock-free split-ordered hash table (Shalev and
+// Shavit). All records sit in one linked list ordered by their
+// bit-reversed hash, and each bucket points to a dummy node in that
+// list. Doubling the number of buckets moves no record: a new bucket
+// just gets a dummy node splitting the list of its parent bucket.
+// Buckets are added lazily on first use. Each segment of the bucket
+// directory after the first holds as many buckets as all before it,
+// so the directory grows with the table and never moves.
+//
+// List nodes are unlinked as in Harris' list: a node is marked
+// deleted in its link to the next node first, then unlinked by any
+// thread which passes it. Links are immutable and replaced as a whole
+// by CAS, so a CAS on a link also fails if it has been marked.
+type LFHashIndex struct {
+	padding1 [64]byte
+	segments [LFSEGMENTS]unsafe.Pointer // *[]unsafe.Pointer of *lfNode
+	size     uint64                     // Number of buckets in use
+	count    int64
+	padding2 [64]byte
+}
+
+type lfNode struct {
+	so   uint64 // Split-order key; odd for records, even for dummies
+	key  Key
+	rec  Record
+	next unsafe.Pointer // *lfLink
+}
+
+type lfLink struct {
+	node   *lfNode
+	marked bool // The node owning this link is deleted
+}
+
+func NewLFHashIndex() *LFHashIndex {
+	h := &LFHashIndex{
+		size: LFINITSIZE,
+	}
+	head := &lfNode{}
+	head.next = unsafe.Pointer(&lfLink{})
+	h.segment(0)[0] = unsafe.Pointer(head)
+	return h
+}
+
+func soRecord(hash uint64) uint64 {
+	return bits.Reverse64(hash | 1<<63)
+}
+
+func soDummy(bucket uint64) uint64 {
+	return bits.Reverse64(bucket)
+}
+
+func loadLink(n *lfNode) *lfLink {
+	return (*lfLink)(atomic.LoadPointer(&n.next))
+}
+
+func casLink(n *lfNode, old *lfLink, new *lfLink) bool {
+	return atomic.CompareAndSwapPointer(&n.next, unsafe.Pointer(old), unsafe.Pointer(new))
+}
+
+// Returns segment i of the directory, adding it if missing. Segment
+// 0 holds buckets [0, LFSEGSIZE) and segment i > 0 holds buckets
+// [LFSEGSIZE<<(i-1), LFSEGSIZE<<i).
+func (h *LFHashIndex) segment(i int) []unsafe.Pointer {
+	p := atomic.LoadPointer(&h.segments[i])
+	if p == nil {
+		n := LFSEGSIZE
+		if i > 1 {
+			n <<= uint(i - 1)
+		}
+		buckets := make([]unsafe.Pointer, n)
+		seg := unsafe.Pointer(&buckets)
+		if atomic.CompareAndSwapPointer(&h.segments[i], nil, seg) {
+			p = seg
+		} else {
+			p = atomic.LoadPointer(&h.segments[i])
+		}
+	}
+	return *(*[]unsafe.Pointer)(p)
+}
+
+func (h *LFHashIndex) slot(b uint64) *unsafe.Pointer {
+	if b < LFSEGSIZE {
+		return &h.segment(0)[b]
+	}
+	i := bits.Len64(b) - LFSEGBITS
+	return &h.segment(i)[b-LFSEGSIZE<<uint(i-1)]
+}
+
+// Returns the dummy node of bucket b, adding it if missing
+func (h *LFHashIndex) bucket(b uint64) *lfNode {
+	slot := h.slot(b)
+	if p := atomic.LoadPointer(slot); p != nil {
+		return (*lfNode)(p)
+	}
+
+	// The parent bucket is b without its highest bit
+	parent := h.bucket(b &^ (1 << uint(63-bits.LeadingZeros64(b))))
+	dummy := &lfNode{so: soDummy(b)}
+	for {
+		pred, predLink, curr, found := h.find(parent, dummy.so, "")
+		if found {
+			dummy = curr
+			break
+		}
+		dummy.next = unsafe.Pointer(&lfLink{node: curr})
+		if casLink(pred, predLink, &lfLink{node: dummy}) {
+			break
+		}
+	}
+	atomic.CompareAndSwapPointer(slot, nil, unsafe.Pointer(dummy))
+	return (*lfNode)(atomic.LoadPointer(slot))
+}
+
+func (h *LFHashIndex) bucketOf(hash uint64) *lfNode {
+	return h.bucket(hash & (atomic.LoadUint64(&h.size) - 1))
+}
+
+// Returns the first node from start on which is not before (so, k),
+// with its unmarked predecessor and the link it was reached by.
+// Marked nodes on the way are unlinked.
+func (h *LFHashIndex) find(start *lfNode, so uint64, k Key) (*lfNode, *lfLink, *lfNode, bool) {
+retry:
+	pred := start
+	predLink := loadLink(pred)
+	curr := predLink.node
+	for curr != nil {
+		currLink := loadLink(curr)
+		if currLink.marked {
+			link := &lfLink{node: currLink.node}
+			if !casLink(pred, predLink, link) {
+				goto retry
+			}
+			predLink = link
+			curr = link.node
+			continue
+		}
+		if curr.so > so || (curr.so == so && curr.key >= k) {
+			return pred, predLink, curr, curr.so == so && curr.key == k
+		}
+		pred = curr
+		predLink = currLink
+		curr = currLink.node
+	}
+	return pred, predLink, nil, false
+}
+
+func (h *LFHashIndex) Get(k Key) Record {
+	hash := k.Hash()
+	so := soRecord(hash)
+	link := loadLink(h.bucketOf(hash))
+	for link.node != nil {
+		n := link.node
+		link = loadLink(n)
+		if n.so > so || (n.so == so && n.key > k) {
+			return nil
+		}
+		// A deleted node may still precede a new one of the same key
+		if n.so == so && n.key == k && !link.marked {
+			return n.rec
+		}
+	}
+	return nil
+}
+
+func (h *LFHashIndex) Put(k Key, r Record) bool {
+	hash := k.Hash()
+	n := &lfNode{
+		so:  soRecord(hash),
+		key: k,
+		rec: r,
+	}
+	start := h.bucketOf(hash)
+	for {
+		pred, predLink, curr, found := h.find(start, n.so, k)
+		if found {
+			return false
+		}
+		n.next = unsafe.Pointer(&lfLink{node: curr})
+		if casLink(pred, predLink, &lfLink{node: n}) {
+			break
+		}
+	}
+
+	size := atomic.LoadUint64(&h.size)
+	if atomic.AddInt64(&h.count, 1) > int64(size*LFLOADFACTOR) {
+		atomic.CompareAndSwapUint64(&h.size, size, size*2)
+	}
+	return true
+}
+
+func (h *LFHashIndex) PutNodes(k Key, r Record, nodeFn PutNodeFunc) bool {
+	return h.Put(k, r)
+}
+
+// The node is marked first, which is the linearization point, and
+// then unlinked by find
+func (h *LFHashIndex) Remove(k Key, r Record) bool {
+	hash := k.Hash()
+	so := soRecord(hash)
+	start := h.bucketOf(hash)
+	for {
+		_, _, curr, found := h.find(start, so, k)
+		if !found || curr.rec != r {
+			return false
+		}
+		link := loadLink(curr)
+		if link.marked {
+			continue
+		}
+		if casLink(curr, link, &lfLink{node: link.node, marked: true}) {
+			break
+		}
+	}
+	atomic.AddInt64(&h.count, -1)
+	h.find(start, so, k)
+	return true
+}
+
+// Walks the list from the head, skipping dummy and marked nodes
+func (h *LFHashIndex) ForEach(fn func(k Key, r Record) bool) {
+	link := loadLink(h.bucket(0))
+	for link.node != nil {
+		n := link.node
+		link = loadLink(n)
+		if n.so&1 == 1 && !link.marked && !fn(n.key, n.rec) {
+			return
+		}
+	}
+}
+
+func (h *LFHashIndex) Scan(lo Key, hi Key, fn func(k Key, r Record) bool) {
+	clog.Error("Hash index does not support Scan; use -index btree")
+}
+
+func (h *LFHashIndex) ScanNodes(lo Key, hi Key, fn func(k Key, r Record) bool, nodeFn func(n IndexNode, version uint64)) {
+	clog.Error("Hash index does not support Scan; use -index btree")
+}
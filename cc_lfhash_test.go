@@ -0,0 +1,160 @@
+package testbed
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+func TestLFHash(t *testing.T) {
+	fmt.Println("=================")
+	fmt.Println("Test LFHash Begin")
+	fmt.Println("=================")
+
+	*SysType = PARTITION
+	h := NewLFHashIndex()
+	nWorkers := 4
+	nKeys := 50000
+
+	// Workers insert overlapping keys while others read them
+	var wg sync.WaitGroup
+	var inserted int64
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			for j := n; j < nKeys; j += nWorkers / 2 {
+				k := CKey(int64(j))
+				if h.Put(k, MakeRecord(k, intSchema.MakeTuple(int64(j)))) {
+					atomic.AddInt64(&inserted, 1)
+				}
+				if r := h.Get(k); r == nil || r.Tuple().GetInt64(0) != int64(j) {
+					t.Errorf("Get of inserted key %v fails", j)
+				}
+			}
+			wg.Done()
+		}(i % (nWorkers / 2))
+	}
+	wg.Wait()
+
+	if inserted != int64(nKeys) {
+		t.Errorf("%v keys inserted; expected %v", inserted, nKeys)
+	}
+	if h.size <= LFINITSIZE {
+		t.Errorf("Table does not grow beyond %v buckets", h.size)
+	}
+	for j := 0; j < nKeys; j++ {
+		if r := h.Get(CKey(int64(j))); r == nil || r.Tuple().GetInt64(0) != int64(j) {
+			t.Fatalf("Get key %v fails", j)
+		}
+	}
+	if h.Get(CKey(int64(nKeys))) != nil || h.Get(BytesKey([]byte("none"))) != nil {
+		t.Errorf("Get of absent key succeeds")
+	}
+
+	// Buckets past the first segments, up to beyond a million, get
+	// slots of their own
+	slots := make(map[*unsafe.Pointer]uint64)
+	for _, b := range []uint64{0, LFSEGSIZE - 1, LFSEGSIZE, 2*LFSEGSIZE - 1, 2 * LFSEGSIZE, 1 << 20, 1<<21 - 1, 1 << 21} {
+		p := h.slot(b)
+		if other, ok := slots[p]; ok {
+			t.Errorf("Buckets %v and %v share a slot", other, b)
+		}
+		if h.slot(b) != p {
+			t.Errorf("Bucket %v moves", b)
+		}
+		slots[p] = b
+	}
+
+	fmt.Println("===============")
+	fmt.Println("Test LFHash End")
+	fmt.Println("===============")
+}
+
+// Both hash indexes under parallel reads of preloaded keys, and under
+// inserts of new keys, parallel ones where the index allows them
+func benchmarkIndexGet(b *testing.B, indexType string) {
+	*SysType = PARTITION
+	nKeys := int64(1 << 20)
+	idx := NewIndex(indexType)
+	for i := int64(0); i < nKeys; i++ {
+		k := CKey(i)
+		idx.Put(k, MakeRecord(k, intSchema.MakeTuple(i)))
+	}
+	keys := make([]Key, 1<<16)
+	for i := range keys {
+		keys[i] = CKey(int64(i) * 7919 % nKeys)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			idx.Get(keys[i&(len(keys)-1)])
+			i++
+		}
+	})
+}
+
+func benchmarkIndexPut(b *testing.B, indexType string) {
+	*SysType = PARTITION
+	idx := NewIndex(indexType)
+	if indexType == "hash" {
+		// Unlocked maps take a single writer
+		for i := 0; i < b.N; i++ {
+			k := CKey(int64(i))
+			idx.Put(k, MakeRecord(k, intSchema.NewTuple()))
+		}
+		return
+	}
+	var next int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			k := CKey(atomic.AddInt64(&next, 1))
+			idx.Put(k, MakeRecord(k, intSchema.NewTuple()))
+		}
+	})
+}
+
+// Plain unlocked maps per chunk, as the hash index was laid out
+// before inserts went concurrent
+func BenchmarkMapGet(b *testing.B) {
+	nKeys := int64(1 << 20)
+	var chunks [CHUNKS]map[Key]Record
+	for j := range chunks {
+		chunks[j] = make(map[Key]Record)
+	}
+	for i := int64(0); i < nKeys; i++ {
+		k := CKey(i)
+		chunks[k[INTKEYLEN-1]][k] = MakeRecord(k, intSchema.MakeTuple(i))
+	}
+	keys := make([]Key, 1<<16)
+	for i := range keys {
+		keys[i] = CKey(int64(i) * 7919 % nKeys)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := keys[i&(len(keys)-1)]
+			_ = chunks[k[INTKEYLEN-1]][k]
+			i++
+		}
+	})
+}
+
+func BenchmarkHashGet(b *testing.B) {
+	benchmarkIndexGet(b, "hash")
+}
+
+func BenchmarkLFHashGet(b *testing.B) {
+	benchmarkIndexGet(b, "lfhash")
+}
+
+func BenchmarkHashPut(b *testing.B) {
+	benchmarkIndexPut(b, "hash")
+}
+
+func BenchmarkLFHashPut(b *testing.B) {
+	benchmarkIndexPut(b, "lfhash")
+}
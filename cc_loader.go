@@ -0,0 +1,238 @@
+package testbed
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+const (
+	LOADBATCH = 4096 // Keys loaded between updates of the progress count
+)
+
+// LoadTable fills t with the int keys 0 to nKeys-1, each in the
+// partition of its partitioner. One goroutine loads each partition,
+// which hash and range partitioners lay out directly and lookup
+// tables list; keys of others are bucketed in one pass first. A
+// table of one partition is split into key ranges among GOMAXPROCS
+// goroutines instead, unless secondary indexes need a single writer.
+// Values come from SeededTuple, so one seed always gives the same
+// dataset. Progress is logged every interval, unless it is 0. It
+// returns the number of keys loaded into each partition.
+func LoadTable(t *Table, nKeys int64, seed int64, interval time.Duration) []int64 {
+	nParts := len(t.parts)
+	counts := make([]int64, nParts)
+	var loaded int64
+
+	done := make(chan bool)
+	if interval > 0 {
+		go func() {
+			tick := time.NewTicker(interval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-tick.C:
+					n := atomic.LoadInt64(&loaded)
+					clog.Info("Loaded %v of %v Keys of Table %s (%.1f%%)", n, nKeys, t.Name, float64(n)*100/float64(nKeys))
+				}
+			}
+		}()
+	}
+
+	// Loads the keys next returns until it returns false into part,
+	// or into the partition of each if part is negative
+	load := func(next func() (int64, bool), part int) {
+		var n int64
+		for i, ok := next(); ok; i, ok = next() {
+			k := CKey(i)
+			p := part
+			if p < 0 {
+				p = t.GetPartition(k)
+			}
+			if t.CreateKV(k, SeededTuple(t.Schema, seed, k), p) == nil {
+				clog.Error("Key %v of Table %s Loaded Twice", k, t.Name)
+			}
+			atomic.AddInt64(&counts[p], 1)
+			if n++; n == LOADBATCH {
+				atomic.AddInt64(&loaded, n)
+				n = 0
+			}
+		}
+		atomic.AddInt64(&loaded, n)
+	}
+
+	var wg sync.WaitGroup
+	if nParts > 1 {
+		var keysOf func(p int) func() (int64, bool)
+		switch tp := t.Partitioner.(type) {
+		case *HashPartitioner:
+			if tp.NParts == int64(nParts) {
+				// Hash partitions hold every nParts-th key
+				keysOf = func(p int) func() (int64, bool) {
+					return keyRange(int64(p), nKeys, int64(nParts))
+				}
+			}
+		case *RangePartitioner:
+			if tp.NParts == int64(nParts) {
+				keysOf = func(p int) func() (int64, bool) {
+					hi := nKeys
+					if p < len(tp.Splits) && tp.Splits[p] < hi {
+						hi = tp.Splits[p]
+					}
+					return keyRange(tp.start(p), hi, 1)
+				}
+			}
+		case *LookupPartitioner:
+			if tp.NParts == int64(nParts) {
+				// Keys past the table go by hash
+				rest := bucketKeys(t, tp.NKeys, nKeys)
+				keysOf = func(p int) func() (int64, bool) {
+					listed := tp.keys[p]
+					n := sort.Search(len(listed), func(i int) bool {
+						return int64(listed[i]) >= nKeys
+					})
+					return keyList(listed[:n], rest[p])
+				}
+			}
+		}
+		if keysOf == nil {
+			buckets := bucketKeys(t, 0, nKeys)
+			keysOf = func(p int) func() (int64, bool) {
+				return keyList(nil, buckets[p])
+			}
+		}
+		for p := 0; p < nParts; p++ {
+			wg.Add(1)
+			go func(p int) {
+				load(keysOf(p), p)
+				wg.Done()
+			}(p)
+		}
+	} else {
+		nLoaders := int64(runtime.GOMAXPROCS(0))
+		if len(t.secIndexes) > 0 {
+			nLoaders = 1
+		}
+		for i := int64(0); i < nLoaders; i++ {
+			wg.Add(1)
+			go func(i int64) {
+				load(keyRange(nKeys*i/nLoaders, nKeys*(i+1)/nLoaders, 1), -1)
+				wg.Done()
+			}(i)
+		}
+	}
+	wg.Wait()
+	close(done)
+	return counts
+}
+
+// Keys from lo below hi, step apart
+func keyRange(lo int64, hi int64, step int64) func() (int64, bool) {
+	return func() (int64, bool) {
+		if lo >= hi {
+			return 0, false
+		}
+		lo += step
+		return lo - step, true
+	}
+}
+
+// The keys of listed, then those of more
+func keyList(listed []uint32, more []int64) func() (int64, bool) {
+	return func() (int64, bool) {
+		if len(listed) > 0 {
+			k := listed[0]
+			listed = listed[1:]
+			return int64(k), true
+		}
+		if len(more) > 0 {
+			k := more[0]
+			more = more[1:]
+			return k, true
+		}
+		return 0, false
+	}
+}
+
+// The keys from lo below hi of each partition of t, in one pass
+func bucketKeys(t *Table, lo int64, hi int64) [][]int64 {
+	buckets := make([][]int64, len(t.parts))
+	for i := lo; i < hi; i++ {
+		p := t.GetPartition(CKey(i))
+		buckets[p] = append(buckets[p], i)
+	}
+	return buckets
+}
+
+// SeededTuple returns a tuple of s like GenTuple does, with strings
+// and bytes drawn from a generator seeded by seed and k. All strings
+// share one allocation.
+func SeededTuple(s *Schema, seed int64, k Key) *Tuple {
+	rnd := fastRand(uint64(seed) ^ k.Hash())
+	tup := s.NewTuple()
+	total := 0
+	for _, c := range s.Columns {
+		if c.Type == STRING {
+			total += colSize(c)
+		}
+	}
+	var strs string
+	if total > 0 {
+		strs = string(rnd.alphanum(total))
+	}
+	for i, c := range s.Columns {
+		n := colSize(c)
+		switch c.Type {
+		case STRING:
+			tup.SetString(i, strs[:n])
+			strs = strs[n:]
+		case BYTES:
+			tup.SetBytes(i, rnd.alphanum(n))
+		}
+	}
+	return tup
+}
+
+func colSize(c Column) int {
+	if c.Size == 0 {
+		return PERFIELD
+	}
+	return c.Size
+}
+
+// A splitmix64 generator; one call gives eight characters, far
+// cheaper than crypto/rand or math/rand
+type fastRand uint64
+
+func (r *fastRand) next() uint64 {
+	*r += 0x9E3779B97F4A7C15
+	z := uint64(*r)
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+const ALPHANUM = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func (r *fastRand) alphanum(n int) []byte {
+	b := make([]byte, n)
+	i := 0
+	for ; i+8 <= n; i += 8 {
+		x := r.next()
+		c := b[i : i+8 : i+8]
+		for j := range c {
+			c[j] = ALPHANUM[(x>>(8*uint(j))&0xFF)*62>>8]
+		}
+	}
+	for x := r.next(); i < n; i++ {
+		b[i] = ALPHANUM[(x&0xFF)*62>>8]
+		x >>= 8
+	}
+	return b
+}
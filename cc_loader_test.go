@@ -0,0 +1,123 @@
+package testbed
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLoadTable(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Load Table Begin")
+	fmt.Println("=======================")
+
+	defer func() {
+		*SysType = PARTITION
+	}()
+
+	nKeys := int64(1000)
+	for _, sys := range []int{PARTITION, OCC} {
+		for _, rt := range []RecType{SINGLEINT, STRINGLIST} {
+			*SysType = sys
+			*NumPart = 3
+			var p Partitioner
+			if sys == PARTITION {
+				p = &HashPartitioner{
+					NParts: 3,
+					NKeys:  nKeys,
+				}
+			}
+			load := func(seed int64) (*Table, []int64) {
+				table := NewStore().CreateTable(RECORDS, SchemaOf(rt), p, "")
+				return table, LoadTable(table, nKeys, seed, 0)
+			}
+			table, counts := load(1)
+			again, _ := load(1)
+			other, _ := load(2)
+
+			if table.NKeys() != nKeys {
+				t.Errorf("Mode %v type %v: loaded %v keys", sys, rt, table.NKeys())
+			}
+			var total int64
+			for _, n := range counts {
+				total += n
+			}
+			if total != nKeys || len(counts) != len(table.parts) {
+				t.Errorf("Mode %v type %v: partition counts %v", sys, rt, counts)
+			}
+			same := 0
+			for i := int64(0); i < nKeys; i++ {
+				k := CKey(i)
+				part := table.GetPartition(k)
+				r := table.GetRecord(k, part)
+				if r == nil {
+					t.Errorf("Mode %v type %v: key %v not in partition %v", sys, rt, i, part)
+					continue
+				}
+				if r.Tuple().String() != again.GetRecord(k, part).Tuple().String() {
+					t.Errorf("Mode %v type %v: seed 1 gives two values of key %v", sys, rt, i)
+				}
+				if r.Tuple().String() == other.GetRecord(k, part).Tuple().String() {
+					same++
+				}
+				if rt == STRINGLIST && len(r.Tuple().GetString(FIELDS-1)) != PERFIELD {
+					t.Errorf("Mode %v type %v: key %v has a string of %v bytes", sys, rt, i, len(r.Tuple().GetString(FIELDS-1)))
+				}
+			}
+			if rt == STRINGLIST && same != 0 {
+				t.Errorf("Mode %v type %v: seeds 1 and 2 give %v same values", sys, rt, same)
+			}
+		}
+	}
+
+	fmt.Println("=======================")
+	fmt.Println("Test Load Table End")
+	fmt.Println("=======================")
+}
+
+func TestLoadLayouts(t *testing.T) {
+	fmt.Println("=========================")
+	fmt.Println("Test Load Layouts Begin")
+	fmt.Println("=========================")
+
+	*SysType = PARTITION
+	*NumPart = 3
+	nKeys := int64(1000)
+	// The lookup table covers only part of the keys
+	parts := make([]uint8, 600)
+	for i := range parts {
+		parts[i] = uint8(i / 7 % 3)
+		if i%5 == 0 {
+			parts[i] = NOPART
+		}
+	}
+	for _, p := range []Partitioner{
+		&HashPartitioner{NParts: 3, NKeys: nKeys},
+		NewRangePartitioner(3, nKeys, []int64{100, 700}),
+		NewLookupPartitioner(3, int64(len(parts)), parts),
+	} {
+		table := NewStore().CreateTable(RECORDS, SchemaOf(SINGLEINT), p, "")
+		counts := LoadTable(table, nKeys, 1, 0)
+		if table.NKeys() != nKeys {
+			t.Errorf("%T: loaded %v keys", p, table.NKeys())
+		}
+		expected := make([]int64, 3)
+		for i := int64(0); i < nKeys; i++ {
+			k := CKey(i)
+			part := p.GetPartition(k)
+			expected[part]++
+			if table.GetRecord(k, part) == nil {
+				t.Errorf("%T: key %v not in partition %v", p, i, part)
+			}
+		}
+		for i := range counts {
+			if counts[i] != expected[i] {
+				t.Errorf("%T: partition counts %v; expected %v", p, counts, expected)
+				break
+			}
+		}
+	}
+
+	fmt.Println("=======================")
+	fmt.Println("Test Load Layouts End")
+	fmt.Println("=======================")
+}
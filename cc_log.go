@@ -0,0 +1,458 @@
+package testbed
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var LogDir = flag.String("logdir", "", "Directory of commit logs; empty disables logging")
+var EarlyRelease = flag.Bool("elr", false, "Release 2PL locks before the commit record is durable; needs -logepoch 0")
+var LogEpoch = flag.Duration("logepoch", 0, "Group commit interval of the epoch logger; 0 syncs the log at every commit")
+
+const (
+	LOGBUFSIZE = 1 << 20
+	LOGHEADER  = 20             // [tid][epoch][nWrites]
+	LOGIDLE    = math.MaxUint64 // Epoch announced outside transactions
+)
+
+// Commit times are taken relative to logBase
+var logBase = time.Now()
+
+// Kinds of log entries
+const (
+	LOGUPDATE = iota
+	LOGINSERT
+	LOGDELETE
+)
+
+// One log file per worker. A record is built in rec by its worker,
+// moved to buf when it ends and becomes durable after Flush, which
+// the worker calls at commit or the epoch logger for a group of
+// commits; with synchronous replication, after the backup has
+// applied them as well. LSNs count records and start from 1.
+type CommitLog struct {
+	padding1 [64]byte
+	id       int
+	f        *os.File
+	rec      []byte
+	nWrites  uint32
+	mu       sync.Mutex // Guards buf, lsn and the pending counts
+	buf      []byte
+	spare    []byte
+	lsn      uint64
+	nPending int64
+	tPending int64 // Sum of the commit times of pending records
+	durable  uint64
+	active   uint64 // Epoch announced by the worker, or LOGIDLE
+	cond     *sync.Cond
+	el       *EpochLogger
+	rep      *Replicator
+	NRecords int64
+	NBytes   int64
+	NLatency time.Duration // Sum of the times from commit to durable
+	padding2 [64]byte
+}
+
+func NewCommitLog(dir string, id int) *CommitLog {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		clog.Error("Create Log Directory Error %s\n", err.Error())
+	}
+	path := filepath.Join(dir, fmt.Sprintf("worker-%d.log", id))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		clog.Error("Open Log File Error %s\n", err.Error())
+	}
+	l := &CommitLog{
+		id:     id,
+		f:      f,
+		rec:    make([]byte, 0, 1024),
+		buf:    make([]byte, 0, LOGBUFSIZE),
+		spare:  make([]byte, 0, LOGBUFSIZE),
+		active: LOGIDLE,
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// A commit record is laid out as [tid uint64][epoch uint64]
+// [nWrites uint32] followed by nWrites entries of [table uint16]
+// [part uint16][keylen uint16][key][kind uint8]. An update goes on
+// with [col uint16][value], an insert with the values of all
+// columns in order, a delete with nothing. An int64 or float64 value
+// is 8 bytes, a string or bytes value is [len uint32][bytes].
+// The header is filled in by End.
+func (l *CommitLog) Begin() {
+	l.rec = append(l.rec[:0], make([]byte, LOGHEADER)...)
+	l.nWrites = 0
+}
+
+func (l *CommitLog) appendEntry(table int, part int, k Key, kind byte) {
+	l.rec = appendUint16(l.rec, uint16(table))
+	l.rec = appendUint16(l.rec, uint16(part))
+	l.rec = appendUint16(l.rec, uint16(len(k)))
+	l.rec = append(l.rec, k...)
+	l.rec = append(l.rec, kind)
+	l.nWrites++
+}
+
+// v is the new value of column col
+func (l *CommitLog) AppendUpdate(table int, part int, k Key, col int, v Value) {
+	l.appendEntry(table, part, k, LOGUPDATE)
+	l.rec = appendUint16(l.rec, uint16(col))
+	l.rec = appendValue(l.rec, v)
+}
+
+func (l *CommitLog) AppendInsert(table int, part int, k Key, tup *Tuple) {
+	l.appendEntry(table, part, k, LOGINSERT)
+	l.rec = appendTuple(l.rec, tup)
+}
+
+func (l *CommitLog) AppendDelete(table int, part int, k Key) {
+	l.appendEntry(table, part, k, LOGDELETE)
+}
+
+// End closes the current record of a transaction committed at tid
+// in epoch and returns its LSN
+func (l *CommitLog) End(tid TID, epoch uint64) uint64 {
+	binary.LittleEndian.PutUint64(l.rec[0:], uint64(tid))
+	binary.LittleEndian.PutUint64(l.rec[8:], epoch)
+	binary.LittleEndian.PutUint32(l.rec[16:], l.nWrites)
+	now := int64(time.Since(logBase))
+	l.mu.Lock()
+	l.buf = append(l.buf, l.rec...)
+	l.lsn++
+	lsn := l.lsn
+	l.nPending++
+	l.tPending += now
+	l.mu.Unlock()
+	return lsn
+}
+
+// Flush writes out all ended records and syncs the file. It is
+// called by one goroutine at a time.
+func (l *CommitLog) Flush() {
+	l.mu.Lock()
+	buf, lsn, n, t := l.buf, l.lsn, l.nPending, l.tPending
+	l.buf = l.spare[:0]
+	l.spare = buf
+	l.nPending, l.tPending = 0, 0
+	l.mu.Unlock()
+	if len(buf) == 0 {
+		return
+	}
+
+	if _, err := l.f.Write(buf); err != nil {
+		clog.Error("Write Log Error %s\n", err.Error())
+	}
+	if err := l.f.Sync(); err != nil {
+		clog.Error("Sync Log Error %s\n", err.Error())
+	}
+	if l.rep != nil {
+		l.rep.ship(l.id, lsn, n, buf)
+		if *SyncRep {
+			l.rep.WaitAcked(l.id, lsn)
+		}
+	}
+	now := int64(time.Since(logBase))
+	l.NRecords += n
+	l.NBytes += int64(len(buf))
+	l.NLatency += time.Duration(n*now - t)
+
+	l.mu.Lock()
+	atomic.StoreUint64(&l.durable, lsn)
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *CommitLog) Durable() uint64 {
+	return atomic.LoadUint64(&l.durable)
+}
+
+// WaitDurable blocks until the record with lsn is durable
+func (l *CommitLog) WaitDurable(lsn uint64) {
+	l.mu.Lock()
+	for atomic.LoadUint64(&l.durable) < lsn {
+		l.cond.Wait()
+	}
+	l.mu.Unlock()
+}
+
+func (l *CommitLog) Close() {
+	l.Flush()
+	l.f.Close()
+}
+
+// Grouped tells whether the epoch logger makes records durable
+func (l *CommitLog) Grouped() bool {
+	return l.el != nil
+}
+
+// Epoch returns the epoch of a transaction committing now; 0
+// without the epoch logger
+func (l *CommitLog) Epoch() uint64 {
+	if l.el == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.el.epoch)
+}
+
+// The worker announces the current epoch while it runs a transaction
+func (l *CommitLog) enter() {
+	if l.el != nil {
+		atomic.StoreUint64(&l.active, atomic.LoadUint64(&l.el.epoch))
+	}
+}
+
+func (l *CommitLog) exit() {
+	if l.el != nil {
+		atomic.StoreUint64(&l.active, LOGIDLE)
+	}
+}
+
+// The epoch logger makes commit logs durable in groups, as in Silo.
+// Every interval it starts a new epoch and waits until each worker
+// has announced it or is idle. Transactions read the epoch at their
+// commit point, after announcing theirs, so no record of an earlier
+// epoch can be ended from then on. All logs are then synced in
+// parallel, and the epoch before the new one is durable. The last
+// durable epoch is kept in the file "epoch" of the log directory.
+type EpochLogger struct {
+	padding1 [64]byte
+	epoch    uint64
+	durable  uint64
+	logs     []*CommitLog
+	f        *os.File
+	interval time.Duration
+	stop     chan bool
+	done     chan bool
+	NEpochs  int64
+	NFlush   time.Duration
+	padding2 [64]byte
+}
+
+func NewEpochLogger(dir string, logs []*CommitLog, interval time.Duration) *EpochLogger {
+	f, err := os.OpenFile(filepath.Join(dir, "epoch"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		clog.Error("Open Epoch File Error %s\n", err.Error())
+	}
+	el := &EpochLogger{
+		epoch:    1,
+		logs:     logs,
+		f:        f,
+		interval: interval,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+	for _, l := range logs {
+		l.el = el
+	}
+	go el.run()
+	return el
+}
+
+func (el *EpochLogger) run() {
+	tick := time.NewTicker(el.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-el.stop:
+			el.advance()
+			close(el.done)
+			return
+		case <-tick.C:
+			el.advance()
+		}
+	}
+}
+
+func (el *EpochLogger) advance() {
+	e := atomic.AddUint64(&el.epoch, 1)
+	for _, l := range el.logs {
+		for atomic.LoadUint64(&l.active) < e {
+			runtime.Gosched()
+		}
+	}
+
+	tm := time.Now()
+	var wg sync.WaitGroup
+	for _, l := range el.logs {
+		wg.Add(1)
+		go func(l *CommitLog) {
+			l.Flush()
+			wg.Done()
+		}(l)
+	}
+	wg.Wait()
+
+	if _, err := el.f.WriteAt(appendUint64(nil, e-1), 0); err != nil {
+		clog.Error("Write Epoch File Error %s\n", err.Error())
+	}
+	if err := el.f.Sync(); err != nil {
+		clog.Error("Sync Epoch File Error %s\n", err.Error())
+	}
+	atomic.StoreUint64(&el.durable, e-1)
+	el.NEpochs++
+	el.NFlush += time.Since(tm)
+}
+
+// Durable returns the last epoch whose records are all durable
+func (el *EpochLogger) Durable() uint64 {
+	return atomic.LoadUint64(&el.durable)
+}
+
+// Close makes all records durable and stops the logger; workers
+// must be idle
+func (el *EpochLogger) Close() {
+	el.stop <- true
+	<-el.done
+	el.f.Close()
+}
+
+// CommitDep names the commit record of the last writer of a record.
+// A transaction touching that record may not acknowledge its commit
+// before the record is durable.
+type CommitDep struct {
+	worker int
+	lsn    uint64
+	chain  int
+}
+
+// Wait until all deps are durable; returns the time spent waiting
+func waitDeps(logs []*CommitLog, deps []CommitDep) time.Duration {
+	tm := time.Now()
+	for i := range deps {
+		d := &deps[i]
+		logs[d.worker].WaitDurable(d.lsn)
+	}
+	return time.Since(tm)
+}
+
+func appendValue(b []byte, v Value) []byte {
+	switch val := v.(type) {
+	case int64:
+		b = appendUint64(b, uint64(val))
+	case float64:
+		b = appendUint64(b, math.Float64bits(val))
+	case string:
+		b = appendUint32(b, uint32(len(val)))
+		b = append(b, val...)
+	case []byte:
+		b = appendUint32(b, uint32(len(val)))
+		b = append(b, val...)
+	default:
+		clog.Error("Value Type %T Not Supported", v)
+	}
+	return b
+}
+
+func appendTuple(b []byte, tup *Tuple) []byte {
+	for i := range tup.Schema().Columns {
+		b = appendValue(b, tup.Get(i))
+	}
+	return b
+}
+
+// Decodes what the append functions encode. Reads past the end
+// set short and return zero values.
+type logReader struct {
+	b     []byte
+	pos   int
+	short bool
+}
+
+func (r *logReader) next(n int) []byte {
+	if r.short || r.pos+n > len(r.b) {
+		r.short = true
+		return nil
+	}
+	x := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return x
+}
+
+func (r *logReader) uint8() uint8 {
+	if x := r.next(1); x != nil {
+		return x[0]
+	}
+	return 0
+}
+
+func (r *logReader) uint16() uint16 {
+	if x := r.next(2); x != nil {
+		return binary.LittleEndian.Uint16(x)
+	}
+	return 0
+}
+
+func (r *logReader) uint32() uint32 {
+	if x := r.next(4); x != nil {
+		return binary.LittleEndian.Uint32(x)
+	}
+	return 0
+}
+
+func (r *logReader) uint64() uint64 {
+	if x := r.next(8); x != nil {
+		return binary.LittleEndian.Uint64(x)
+	}
+	return 0
+}
+
+func (r *logReader) key() Key {
+	return Key(r.next(int(r.uint16())))
+}
+
+func (r *logReader) value(ct ColType) Value {
+	switch ct {
+	case INT64:
+		return int64(r.uint64())
+	case FLOAT64:
+		return math.Float64frombits(r.uint64())
+	case STRING:
+		return string(r.next(int(r.uint32())))
+	case BYTES:
+		return append([]byte(nil), r.next(int(r.uint32()))...)
+	}
+	clog.Error("Column Type %v Not Supported", ct)
+	return nil
+}
+
+func (r *logReader) tuple(s *Schema) *Tuple {
+	tup := s.NewTuple()
+	for i, c := range s.Columns {
+		v := r.value(c.Type)
+		if r.short {
+			return nil
+		}
+		tup.Set(i, v)
+	}
+	return tup
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], x)
+	return append(b, tmp[:]...)
+}
+
+func appendUint16(b []byte, x uint16) []byte {
+	var tmp [2]byte
+	binary.LittleEndian.PutUint16(tmp[:], x)
+	return append(b, tmp[:]...)
+}
+
+func appendUint32(b []byte, x uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], x)
+	return append(b, tmp[:]...)
+}
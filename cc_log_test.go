@@ -0,0 +1,307 @@
+package testbed
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEarlyLockRelease(t *testing.T) {
+	fmt.Println("===============================")
+	fmt.Println("Test Early Lock Release Begin")
+	fmt.Println("===============================")
+
+	*SysType = LOCKING
+	*PhyPart = false
+	*EarlyRelease = true
+
+	dir, err := ioutil.TempDir("", "cclog")
+	if err != nil {
+		t.Fatalf("Create Temp Dir Error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	*LogDir = dir
+	defer func() {
+		*LogDir = ""
+		*EarlyRelease = false
+	}()
+
+	nKeys := int64(4)
+	nWorkers := 4
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+	for i := int64(0); i < nKeys; i++ {
+		table.CreateKV(CKey(i), table.Schema.MakeTuple(int64(0)), 0)
+	}
+
+	coord := NewCoordinator(nWorkers, store)
+	committed := make([]int64, nWorkers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			w := coord.Workers[n]
+			q := &Query{
+				TXN:   ADD_ONE,
+				wKeys: []Key{CKey(int64(n) % nKeys), CKey(int64(n+1) % nKeys)},
+			}
+			for j := 0; j < 200; j++ {
+				if _, err := w.One(q); err == nil {
+					committed[n]++
+				}
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	coord.Close()
+
+	var sum, total int64
+	for i := int64(0); i < nKeys; i++ {
+		sum += table.GetRecord(CKey(i), 0).Tuple().GetInt64(0)
+	}
+	for i, w := range coord.Workers {
+		total += committed[i]
+		if w.log.Durable() != uint64(committed[i]) {
+			t.Errorf("Worker %v has %v durable records; %v committed", i, w.log.Durable(), committed[i])
+		}
+	}
+	if sum != 2*total {
+		t.Errorf("Sum of values %v; expected %v", sum, 2*total)
+	}
+
+	coord.PrintStats(os.Stdout)
+
+	fmt.Println("=============================")
+	fmt.Println("Test Early Lock Release End")
+	fmt.Println("=============================")
+}
+
+func TestGroupCommit(t *testing.T) {
+	fmt.Println("===============================")
+	fmt.Println("Test Group Commit Begin")
+	fmt.Println("===============================")
+
+	defer func() {
+		*SysType = PARTITION
+		*LogDir = ""
+		*LogEpoch = 0
+	}()
+
+	for _, sys := range []int{PARTITION, OCC, LOCKING} {
+		*SysType = sys
+		*NumPart = 1
+		dir, err := ioutil.TempDir("", "cclog")
+		if err != nil {
+			t.Fatalf("Create Temp Dir Error %s", err.Error())
+		}
+		defer os.RemoveAll(dir)
+		*LogDir = dir
+		*LogEpoch = time.Millisecond
+
+		nKeys := int64(4)
+		nWorkers := 4
+		store := NewStore()
+		table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+		for i := int64(0); i < nKeys; i++ {
+			table.CreateKV(CKey(i), table.Schema.MakeTuple(int64(0)), 0)
+		}
+
+		coord := NewCoordinator(nWorkers, store)
+		committed := make([]int64, nWorkers)
+
+		var wg sync.WaitGroup
+		for i := 0; i < nWorkers; i++ {
+			wg.Add(1)
+			go func(n int) {
+				w := coord.Workers[n]
+				q := &Query{
+					TXN:         ADD_ONE,
+					accessParts: []int{0},
+					wKeys:       []Key{CKey(int64(n) % nKeys)},
+				}
+				for j := 0; j < 200; j++ {
+					if _, err := w.One(q); err == nil {
+						committed[n]++
+					}
+					time.Sleep(10 * time.Microsecond)
+				}
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		coord.Close()
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, "epoch"))
+		if err != nil || len(b) != 8 {
+			t.Fatalf("Mode %v: read epoch file %v", sys, err)
+		}
+		durable := binary.LittleEndian.Uint64(b)
+		if durable != coord.elog.Durable() || durable < 2 {
+			t.Errorf("Mode %v: durable epoch %v in file, %v in logger", sys, durable, coord.elog.Durable())
+		}
+
+		for i, w := range coord.Workers {
+			if w.log.Durable() != uint64(committed[i]) {
+				t.Errorf("Mode %v: worker %v has %v durable records; %v committed", sys, i, w.log.Durable(), committed[i])
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("worker-%d.log", i)))
+			if err != nil {
+				t.Fatalf("Mode %v: read log %v", sys, err)
+			}
+			// One update of an int64 column per record
+			recLen := LOGHEADER + 2 + 2 + 2 + INTKEYLEN + 1 + 2 + 8
+			if len(b) != recLen*int(committed[i]) {
+				t.Errorf("Mode %v: worker %v logs %v bytes for %v commits", sys, i, len(b), committed[i])
+				continue
+			}
+			var last uint64
+			for pos := 0; pos < len(b); pos += recLen {
+				epoch := binary.LittleEndian.Uint64(b[pos+8:])
+				if epoch < last || epoch > durable {
+					t.Errorf("Mode %v: worker %v logs epoch %v after %v, durable %v", sys, i, epoch, last, durable)
+				}
+				last = epoch
+			}
+		}
+	}
+
+	fmt.Println("=============================")
+	fmt.Println("Test Group Commit End")
+	fmt.Println("=============================")
+}
+
+func TestCommandLog(t *testing.T) {
+	fmt.Println("===============================")
+	fmt.Println("Test Command Log Begin")
+	fmt.Println("===============================")
+
+	defer func() {
+		*LogDir = ""
+		*LogEpoch = 0
+		*CmdLog = false
+		*CrossPercent = 0
+	}()
+
+	*SysType = PARTITION
+	*CmdLog = true
+	*CrossPercent = 50
+	nKeys := int64(64)
+	nParts := 2
+	nWorkers := 2
+
+	hash := &HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+	}
+	cases := []struct {
+		epoch time.Duration
+		hp    Partitioner
+	}{
+		{0, hash},
+		{time.Millisecond, hash},
+		{0, NewRangePartitioner(nParts, nKeys, nil)},
+		{0, NewLookupPartitioner(nParts, nKeys, []uint8{1, 1, 0, NOPART, 1})},
+	}
+	for _, tt := range []int{ADD_ONE, INSERT_DELETE_INT} {
+		for _, c := range cases {
+			epoch, hp := c.epoch, c.hp
+			*NumPart = nParts
+			logDir, err := ioutil.TempDir("", "cclog")
+			if err != nil {
+				t.Fatalf("Create Temp Dir Error %s", err.Error())
+			}
+			defer os.RemoveAll(logDir)
+			ckptDir, err := ioutil.TempDir("", "ccckpt")
+			if err != nil {
+				t.Fatalf("Create Temp Dir Error %s", err.Error())
+			}
+			defer os.RemoveAll(ckptDir)
+			*LogDir = logDir
+			*LogEpoch = epoch
+
+			create := func() (*Store, *Table) {
+				s := NewStore()
+				return s, s.CreateTable(RECORDS, SchemaOf(SINGLEINT), hp, "")
+			}
+			store, table := create()
+			pKeysArray := make([]int64, nParts)
+			for i := int64(0); i < nKeys; i++ {
+				k := CKey(i)
+				pKeysArray[hp.GetPartition(k)]++
+				table.CreateKV(k, table.Schema.MakeTuple(i), hp.GetPartition(k))
+			}
+			NewCheckpointer(store, ckptDir, nil, nil).Checkpoint()
+
+			coord := NewCoordinator(nWorkers, store)
+			var wg sync.WaitGroup
+			for i := 0; i < nWorkers; i++ {
+				wg.Add(1)
+				go func(n int) {
+					zk := NewZipfKey(n, nKeys, nParts, pKeysArray, 1, hp)
+					gen := NewTxnGen(n, tt, 0, 4, 2, zk)
+					for j := 0; j < 300; j++ {
+						coord.Workers[n].One(gen.GenOneQuery())
+					}
+					wg.Done()
+				}(i)
+			}
+			wg.Wait()
+			coord.Close()
+
+			var logged int64
+			for _, w := range coord.Workers {
+				logged += w.log.NRecords
+			}
+			rs, recovered := create()
+			stats := Recover(rs, ckptDir, logDir)
+			if stats.NLogRecords == 0 || stats.NLogRecords != logged {
+				t.Errorf("Txn %v epoch %v: replayed %v commands; %v logged", tt, epoch, stats.NLogRecords, logged)
+			}
+			for i := int64(0); i < nKeys; i++ {
+				k := CKey(i)
+				r, rr := table.GetRecord(k, hp.GetPartition(k)), recovered.GetRecord(k, hp.GetPartition(k))
+				present := r != nil && !r.IsAbsent()
+				if (rr != nil && !rr.IsAbsent()) != present {
+					t.Errorf("Txn %v epoch %v: key %v present %v after replay", tt, epoch, i, !present)
+				} else if present && r.Tuple().GetInt64(0) != rr.Tuple().GetInt64(0) {
+					t.Errorf("Txn %v epoch %v: key %v replayed as %v; expected %v", tt, epoch, i,
+						rr.Tuple().GetInt64(0), r.Tuple().GetInt64(0))
+				}
+			}
+			if tt == ADD_ONE && recovered.NKeys() != nKeys {
+				t.Errorf("Txn %v epoch %v: recovered %v keys", tt, epoch, recovered.NKeys())
+			}
+		}
+	}
+
+	// Replay routes composite keys with the partitioner of the table,
+	// by their int part
+	dir, err := ioutil.TempDir("", "cclog")
+	if err != nil {
+		t.Fatalf("Create Temp Dir Error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	intLed := &HashPartitioner{NParts: int64(nParts), NKeys: nKeys, IntLed: true}
+	s := NewStore()
+	s.CreateTable(RECORDS, SchemaOf(SINGLEINT), intLed, "")
+	k := CompositeKey(int64(3), "x")
+	l := NewCommitLog(dir, 0)
+	l.Begin()
+	l.AppendCommand(&Query{TXN: ADD_ONE, accessParts: []int{intLed.GetPartition(k)}, partitioner: intLed, wKeys: []Key{k}})
+	l.Close()
+	q := (&logReader{b: l.rec[LOGHEADER:]}).query(s)
+	if q == nil || q.partitioner != intLed || q.partitioner.GetPartition(k) != 1 {
+		t.Errorf("Replayed query is not routed by the partitioner of the table")
+	}
+
+	fmt.Println("=============================")
+	fmt.Println("Test Command Log End")
+	fmt.Println("=============================")
+}
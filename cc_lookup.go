@@ -0,0 +1,164 @@
+package testbed
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// A key of a lookup table without a partition of its own
+const NOPART = math.MaxUint8
+
+// LookupPartitioner maps the int keys below the length of its table
+// to the partitions the table gives, for placements computed offline.
+// Other keys, and those the table leaves at NOPART, go by hash as with
+// HashPartitioner. It takes a byte for the partition of each key and
+// four for its rank, so it holds up to 255 partitions of up to 2^32
+// keys.
+type LookupPartitioner struct {
+	padding1 [64]byte
+	NParts   int64
+	NKeys    int64
+	parts    []uint8
+	keys     [][]uint32 // Keys below NKeys of each partition, ascending
+	padding2 [64]byte
+}
+
+// NewLookupPartitioner maps int key k below len(parts) to parts[k];
+// ranks cover the keys below nKeys
+func NewLookupPartitioner(nParts int, nKeys int64, parts []uint8) *LookupPartitioner {
+	if nParts <= 0 || nParts >= NOPART {
+		clog.Error("Lookup Tables Hold 1 to %v Partitions; Got %v", NOPART-1, nParts)
+	}
+	if nKeys > math.MaxUint32 {
+		clog.Error("Lookup Tables Hold up to %v Keys; Got %v", uint64(math.MaxUint32), nKeys)
+	}
+	lp := &LookupPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+		parts:  parts,
+		keys:   make([][]uint32, nParts),
+	}
+	counts := make([]int64, nParts)
+	for i, p := range parts {
+		if p != NOPART && int(p) >= nParts {
+			clog.Error("Lookup Table Puts Key %v in Partition %v of %v", i, p, nParts)
+		}
+	}
+	for k := int64(0); k < nKeys; k++ {
+		counts[lp.part(k)]++
+	}
+	for p := range lp.keys {
+		lp.keys[p] = make([]uint32, 0, counts[p])
+	}
+	for k := int64(0); k < nKeys; k++ {
+		p := lp.part(k)
+		lp.keys[p] = append(lp.keys[p], uint32(k))
+	}
+	return lp
+}
+
+// LoadLookupPartitioner reads a table of lines "key partition", as
+// Save writes, for keys 0 to nKeys-1. Keys it does not list go by hash.
+func LoadLookupPartitioner(path string, nParts int, nKeys int64) *LookupPartitioner {
+	f, err := os.Open(path)
+	if err != nil {
+		clog.Error("Open Lookup Table Error %s\n", err.Error())
+	}
+	defer f.Close()
+
+	parts := make([]uint8, nKeys)
+	for i := range parts {
+		parts[i] = NOPART
+	}
+	sc := bufio.NewScanner(f)
+	line := 0
+	for sc.Scan() {
+		line++
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			clog.Error("Lookup Table %s Line %v: Expected Key and Partition", path, line)
+		}
+		k, err1 := strconv.ParseInt(fields[0], 10, 64)
+		p, err2 := strconv.ParseUint(fields[1], 10, 8)
+		if err1 != nil || err2 != nil || k < 0 || k >= nKeys || int(p) >= nParts {
+			clog.Error("Lookup Table %s Line %v: Invalid Entry %s", path, line, sc.Text())
+		}
+		parts[k] = uint8(p)
+	}
+	if err := sc.Err(); err != nil {
+		clog.Error("Read Lookup Table Error %s\n", err.Error())
+	}
+	return NewLookupPartitioner(nParts, nKeys, parts)
+}
+
+// Save writes the keys with a partition of their own
+func (lp *LookupPartitioner) Save(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		clog.Error("Create Lookup Table Error %s\n", err.Error())
+	}
+	w := bufio.NewWriter(f)
+	for k, p := range lp.parts {
+		if p != NOPART {
+			fmt.Fprintf(w, "%d %d\n", k, p)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		clog.Error("Write Lookup Table Error %s\n", err.Error())
+	}
+	if err := f.Close(); err != nil {
+		clog.Error("Write Lookup Table Error %s\n", err.Error())
+	}
+}
+
+func (lp *LookupPartitioner) part(k int64) int {
+	if k >= 0 && k < int64(len(lp.parts)) && lp.parts[k] != NOPART {
+		return int(lp.parts[k])
+	}
+	return int(uint64(k) % uint64(lp.NParts))
+}
+
+// Keys other than int keys go by hash
+func (lp *LookupPartitioner) GetPartition(key Key) int {
+	if len(key) != INTKEYLEN {
+		return int(key.Hash() % uint64(lp.NParts))
+	}
+	return lp.part(ParseKey(key))
+}
+
+func (lp *LookupPartitioner) GetPartitionN(key Key) int {
+	return lp.GetPartition(key)
+}
+
+func (lp *LookupPartitioner) GetKey(partIndex int, rank int64) Key {
+	if partIndex < 0 || partIndex >= len(lp.keys) || rank < 0 || rank >= int64(len(lp.keys[partIndex])) {
+		clog.Error("Lookup Table Has No Key of Rank %v in Partition %v", rank, partIndex)
+	}
+	return CKey(int64(lp.keys[partIndex][rank]))
+}
+
+// Keys from NKeys on, and those other than int keys, have no rank; it
+// returns -1 for them
+func (lp *LookupPartitioner) GetRank(key Key) int64 {
+	if len(key) != INTKEYLEN {
+		return -1
+	}
+	k := ParseKey(key)
+	if k < 0 || k >= lp.NKeys {
+		return -1
+	}
+	keys := lp.keys[lp.part(k)]
+	return int64(sort.Search(len(keys), func(i int) bool {
+		return int64(keys[i]) >= k
+	}))
+}
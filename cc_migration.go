@@ -0,0 +1,211 @@
+package testbed
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// Live migration of a range of int keys between partitions while
+// workers run, after Squall. Starting it maps the range to its new
+// partition at once; transactions then take both partitions and pull
+// the records they touch, while Migrate moves the rest in batches.
+
+const MIGRATEBATCH = 256 // Records moved under one pair of partition locks
+
+// Migrations change one mapping at a time
+var migrateLock sync.Mutex
+
+type Migration struct {
+	Lo       int64
+	Hi       int64
+	From     int
+	To       int
+	NMoved   int64 // Records moved by Migrate; the rest were pulled
+	NBatches int64
+	Time     time.Duration
+}
+
+// Migrate moves the keys of hp from lo to hi, both included, which
+// are in partition from to partition to, in all tables hp partitions.
+// It returns once all of them are moved; run it beside the workers,
+// which must route their queries with hp. Composite keys go by their
+// leading int part. Only partition mode without logging, checkpoints,
+// anti-caching or replicated keys is supported.
+func (s *Store) Migrate(hp *HashPartitioner, lo int64, hi int64, from int, to int) *Migration {
+	return s.migrate(hp, keyMove{lo: lo, hi: hi, base: -1, from: from, to: to})
+}
+
+func (s *Store) migrate(hp *HashPartitioner, mv keyMove) *Migration {
+	lo, hi, from, to := mv.lo, mv.hi, mv.from, mv.to
+	if *SysType != PARTITION {
+		clog.Error("Migration Needs Partition Mode")
+	}
+	if *LogDir != "" || *CkptDir != "" || *AntiCacheDir != "" {
+		clog.Error("Migration Does Not Support Logging, Checkpoints or Anti-Caching")
+	}
+	if from == to || from < 0 || to < 0 || from >= len(s.locks) || to >= len(s.locks) || lo > hi {
+		clog.Error("Invalid Migration of [%v, %v] from %v to %v", lo, hi, from, to)
+	}
+	var tables []*Table
+	for _, t := range s.tables {
+		if t.Partitioner != hp {
+			continue
+		}
+		if len(t.hot) > 0 {
+			clog.Error("Migration Does Not Support Replicated Keys of Table %s", t.Name)
+		}
+		tables = append(tables, t)
+	}
+
+	migrateLock.Lock()
+	defer migrateLock.Unlock()
+	m := &Migration{Lo: lo, Hi: hi, From: from, To: to}
+	tm := time.Now()
+	first, second := s.locks[from], s.locks[to]
+	if to < from {
+		first, second = second, first
+	}
+	remap := func(moving bool) {
+		first.Lock()
+		second.Lock()
+		m := &keyMoves{}
+		if old := hp.mapping(); old != nil {
+			m.moves = append(m.moves, old.moves...)
+			m.owner = old.owner
+			m.version = old.version
+		}
+		m.version++
+		if moving {
+			mv.moving = true
+			m.moves = append(m.moves, mv)
+		} else {
+			m.moves[len(m.moves)-1].moving = false
+			m.fold(int(hp.NParts))
+		}
+		hp.moves.Store(m)
+		second.Unlock()
+		first.Unlock()
+	}
+
+	remap(true)
+	for _, t := range tables {
+		// Nothing moves into from any more, so what is left to move
+		// can be listed once
+		var keys []Key
+		first.Lock()
+		second.Lock()
+		t.parts[from].index.ForEach(func(k Key, r Record) bool {
+			if part, src := hp.locate(k); part == to && src == from {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		second.Unlock()
+		first.Unlock()
+
+		for i := 0; i < len(keys); i += MIGRATEBATCH {
+			end := i + MIGRATEBATCH
+			if end > len(keys) {
+				end = len(keys)
+			}
+			first.Lock()
+			second.Lock()
+			for _, k := range keys[i:end] {
+				if t.moveRecord(k, from, to) {
+					m.NMoved++
+				}
+			}
+			second.Unlock()
+			first.Unlock()
+			m.NBatches++
+			// Let the workers in
+			runtime.Gosched()
+		}
+	}
+	remap(false)
+	m.Time = time.Since(tm)
+	return m
+}
+
+// Moves the record of k from partition from to partition to, with
+// its secondary index entries; the caller holds both. It returns
+// false if k is not in from. A tombstone moves too, keeping the TID
+// of the delete; a pending unlink of it in from does nothing.
+func (t *Table) moveRecord(k Key, from int, to int) bool {
+	src := t.parts[from].index
+	r := src.Get(k)
+	if r == nil {
+		return false
+	}
+	if !t.parts[to].index.Put(k, r) {
+		clog.Error("Migrated Key %v of Table %s Exists in Partition %v", k, t.Name, to)
+	}
+	src.Remove(k, r)
+	if len(t.secIndexes) > 0 && !r.IsAbsent() {
+		t.secChanges(k, from, -1, attrOf(r.Tuple()), nil, applySec)
+		t.secChanges(k, to, -1, nil, attrOf(r.Tuple()), applySec)
+	}
+	return true
+}
+
+// Returns the partitioner of t if a migration has changed it
+func migrating(t *Table) *HashPartitioner {
+	hp, ok := t.Partitioner.(*HashPartitioner)
+	if !ok || hp.mapping() == nil {
+		return nil
+	}
+	return hp
+}
+
+// Pulls k into partNum if it is still moving there
+func (p *PTransaction) pull(t *Table, k Key, partNum int) {
+	hp := migrating(t)
+	if hp == nil {
+		return
+	}
+	if part, from := hp.locate(k); from >= 0 && part == partNum {
+		p.holds(k, from)
+		if t.moveRecord(k, from, partNum) {
+			p.w.NStats[NPULLS]++
+		}
+	}
+}
+
+// Pulls the keys from lo to hi still moving into partNum
+func (p *PTransaction) pullRange(t *Table, lo Key, hi Key, partNum int) {
+	hp := migrating(t)
+	if hp == nil {
+		return
+	}
+	for _, mv := range hp.mapping().moves {
+		if !mv.moving || mv.to != partNum {
+			continue
+		}
+		p.holds(lo, mv.from)
+		var keys []Key
+		t.parts[mv.from].index.Scan(lo, hi, func(k Key, r Record) bool {
+			if part, from := hp.locate(k); part == partNum && from == mv.from {
+				keys = append(keys, k)
+			}
+			return true
+		})
+		for _, k := range keys {
+			if t.moveRecord(k, mv.from, partNum) {
+				p.w.NStats[NPULLS]++
+			}
+		}
+	}
+}
+
+// Routing makes a transaction hold the partitions its keys move from
+func (p *PTransaction) holds(k Key, partNum int) {
+	for _, x := range p.q.accessParts {
+		if x == partNum {
+			return
+		}
+	}
+	clog.Error("Pulling Key %v Needs Partition %v", k, partNum)
+}
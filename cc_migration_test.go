@@ -0,0 +1,174 @@
+package testbed
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestMigration(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Migration Begin")
+	fmt.Println("=======================")
+
+	defer func() {
+		*CrossPercent = 0
+	}()
+
+	*SysType = PARTITION
+	*CrossPercent = 50
+	nKeys := int64(4096)
+	nParts := 2
+	nWorkers := 2
+	lo, hi := int64(0), nKeys/2-1
+
+	for _, tt := range []int{ADD_ONE, LOOKUP_STRING} {
+		*NumPart = nParts
+		hp := &HashPartitioner{
+			NParts: int64(nParts),
+			NKeys:  nKeys,
+		}
+		var rt RecType = SINGLEINT
+		if tt == LOOKUP_STRING {
+			rt = STRINGLIST
+		}
+		store := NewStore()
+		table := store.CreateTable(RECORDS, SchemaOf(rt), hp, "")
+		if tt == LOOKUP_STRING {
+			table.CreateSecIndex(0)
+		}
+		pKeysArray := LoadTable(table, nKeys, 1, 0)
+
+		coord := NewCoordinator(nWorkers, store)
+		written := make([]map[Key]int64, nWorkers)
+		var wg sync.WaitGroup
+		for i := 0; i < nWorkers; i++ {
+			wg.Add(1)
+			go func(n int) {
+				written[n] = make(map[Key]int64)
+				zk := NewZipfKey(n, nKeys, nParts, pKeysArray, 1, hp)
+				gen := NewTxnGen(n, tt, 50, 4, 2, zk)
+				for j := 0; j < 2000; j++ {
+					q := gen.GenOneQuery()
+					if _, err := coord.Workers[n].One(q); err != nil {
+						t.Errorf("Txn %v worker %v: query fails with %v", tt, n, err)
+						break
+					}
+					for _, k := range q.wKeys {
+						written[n][k]++
+					}
+				}
+				wg.Done()
+			}(i)
+		}
+		m := store.Migrate(hp, lo, hi, 0, 1)
+		wg.Wait()
+		coord.Close()
+
+		var pulled int64
+		for _, w := range coord.Workers {
+			pulled += w.NStats[NPULLS]
+		}
+		if m.NMoved+pulled != nKeys/4 {
+			t.Errorf("Txn %v: %v records moved and %v pulled; expected %v", tt, m.NMoved, pulled, nKeys/4)
+		}
+		for i := int64(0); i < nKeys; i++ {
+			k := CKey(i)
+			part := int(i % int64(nParts))
+			if i <= hi {
+				part = 1
+			}
+			if p := hp.GetPartition(k); p != part {
+				t.Errorf("Txn %v: key %v is mapped to %v; expected %v", tt, i, p, part)
+			}
+			r := table.GetRecord(k, part)
+			if r == nil || table.GetRecord(k, 1-part) != nil {
+				t.Errorf("Txn %v: key %v is not only in partition %v", tt, i, part)
+				continue
+			}
+			if tt == ADD_ONE {
+				expected := SeededTuple(table.Schema, 1, k).GetInt64(0)
+				for _, w := range written {
+					expected += w[k]
+				}
+				if v := r.Tuple().GetInt64(0); v != expected {
+					t.Errorf("Key %v is %v; expected %v", i, v, expected)
+				}
+			} else if !containsKey(table.SecIndex(0).entry(r.Tuple().GetString(0), part).Keys(), k) {
+				t.Errorf("Secondary index of partition %v misses key %v", part, i)
+			}
+		}
+	}
+
+	// A transaction pulls what it touches of a range still moving
+	*NumPart = nParts
+	hp := &HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+	}
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), hp, "")
+	pKeysArray := LoadTable(table, nKeys, 1, 0)
+	coord := NewCoordinator(1, store)
+	zk := NewZipfKey(0, nKeys, nParts, pKeysArray, 1, hp)
+	gen := NewTxnGen(0, ADD_ONE, 0, 1, 1, zk)
+	q := gen.GenOneQuery()
+	q.wKeys[0] = CKey(2)
+	hp.moves.Store(&keyMoves{version: 1, moves: []keyMove{{lo: lo, hi: hi, base: -1, from: 0, to: 1, moving: true}}})
+	if _, err := coord.Workers[0].One(q); err != nil {
+		t.Errorf("Query fails with %v", err)
+	}
+	w := coord.Workers[0]
+	if w.NStats[NPULLS] != 1 || w.NStats[NREROUTES] != 1 || len(q.accessParts) != 2 {
+		t.Errorf("Pulled %v, rerouted %v, took partitions %v", w.NStats[NPULLS], w.NStats[NREROUTES], q.accessParts)
+	}
+	if table.GetRecord(CKey(2), 0) != nil || table.GetRecord(CKey(2), 1).Tuple().GetInt64(0) != SeededTuple(table.Schema, 1, CKey(2)).GetInt64(0)+1 {
+		t.Errorf("Key 2 is not pulled into partition 1")
+	}
+	coord.Close()
+
+	fmt.Println("=====================")
+	fmt.Println("Test Migration End")
+	fmt.Println("=====================")
+}
+
+func TestFoldMoves(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Fold Moves Begin")
+	fmt.Println("=======================")
+
+	all := func(base int, from int, to int) keyMove {
+		return keyMove{lo: math.MinInt64, hi: math.MaxInt64, base: base, from: from, to: to}
+	}
+	for _, tc := range []struct {
+		moves []keyMove
+		left  int
+	}{
+		{[]keyMove{all(2, 2, 0), all(3, 3, 1), all(-1, 1, 0), all(3, 0, 3)}, 0},
+		// A narrower range keeps the moves after it in line
+		{[]keyMove{all(2, 2, 0), {lo: 0, hi: 9, base: -1, from: 0, to: 1}, all(0, 0, 2)}, 2},
+	} {
+		listed := &HashPartitioner{NParts: 4, NKeys: 100}
+		listed.moves.Store(&keyMoves{moves: tc.moves})
+		folded := &HashPartitioner{NParts: 4, NKeys: 100}
+		m := &keyMoves{moves: append([]keyMove(nil), tc.moves...)}
+		m.fold(4)
+		folded.moves.Store(m)
+		if len(m.moves) != tc.left {
+			t.Errorf("%v moves left after folding %v; expected %v", len(m.moves), tc.moves, tc.left)
+		}
+		for i := int64(-20); i < 20; i++ {
+			if p, q := listed.GetPartition(CKey(i)), folded.GetPartition(CKey(i)); p != q {
+				t.Errorf("Key %v is in %v, %v when folded", i, p, q)
+			}
+		}
+		if p, q := listed.GetPartition(BytesKey([]byte("x"))), folded.GetPartition(BytesKey([]byte("x"))); p != q {
+			t.Errorf("Bytes key is in %v, %v when folded", p, q)
+		}
+	}
+
+	fmt.Println("=====================")
+	fmt.Println("Test Fold Moves End")
+	fmt.Println("=====================")
+}
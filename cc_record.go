@@ -2,6 +2,7 @@ package testbed
 
 import (
 	"github.com/totemtang/cc-testbed/clog"
+	"github.com/totemtang/cc-testbed/spinlock"
 	"github.com/totemtang/cc-testbed/wfmutex"
 )
 
@@ -26,72 +27,63 @@ type Record interface {
 	Lock() (bool, TID)
 	Unlock(tid TID)
 	IsUnlocked() (bool, TID)
-	Value() Value
+	// The tuple of a record is changed through SetColumn and SetTuple
+	Tuple() *Tuple
 	GetKey() Key
-	UpdateValue(val Value) bool
+	// SetColumn takes a value of the Go type of column col
+	SetColumn(col int, val Value)
 	GetTID() TID
 	SetTID(tid TID)
+	// A deleted record stays in the index as an absent tombstone
+	// until it is reclaimed; inserting its key again revives it
+	IsAbsent() bool
+	SetAbsent(absent bool)
+	// SetTuple replaces all columns with a copy of tup
+	SetTuple(tup *Tuple)
 	DoNothing()
 }
 
-func MakeRecord(k Key, v Value, rt RecType) Record {
+// MakeRecord takes over tup, which is not copied
+func MakeRecord(k Key, tup *Tuple) Record {
 	if *SysType == PARTITION {
-		pr := &PRecord{
-			key:     k,
-			recType: rt,
+		return &PRecord{
+			key:   k,
+			tuple: *tup,
 		}
-
-		// Initiate Value according to different types
-		switch rt {
-		case SINGLEINT:
-			if v != nil {
-				pr.intVal = v.(int64)
-			}
-		case STRINGLIST:
-			if v != nil {
-				var inputStrList = v.([]string)
-				pr.stringVal = make([]string, len(inputStrList))
-				for i, _ := range inputStrList {
-					pr.stringVal[i] = inputStrList[i]
-				}
-			}
-		}
-		return pr
 	} else if *SysType == OCC {
-		or := &ORecord{
-			key:     k,
-			recType: rt,
-			last:    wfmutex.WFMutex{},
+		return &ORecord{
+			key:   k,
+			tuple: *tup,
+			last:  wfmutex.WFMutex{},
 		}
-		// Initiate Value according to different types
-		switch rt {
-		case SINGLEINT:
-			if v != nil {
-				or.intVal = v.(int64)
-			}
-		case STRINGLIST:
-			if v != nil {
-				var inputStrList = v.([]string)
-				or.stringVal = make([]string, len(inputStrList))
-				for i, _ := range inputStrList {
-					or.stringVal[i] = inputStrList[i]
-				}
-			}
+	} else if *SysType == LOCKING {
+		return &LRecord{
+			key:   k,
+			tuple: *tup,
 		}
-		return or
 	} else {
 		clog.Error("System Type %v Not Supported Yet", *SysType)
 		return nil
 	}
 }
 
+// The TID of a partition record is only kept with a commit log.
+// With anti-caching, prev and next chain it in the LRU order of its
+// partition, and an evicted record keeps the place of its values in
+// the block file instead of them.
 type PRecord struct {
-	padding1  [64]byte
-	key       Key
-	intVal    int64
-	stringVal []string
-	recType   RecType
-	padding2  [64]byte
+	padding1 [64]byte
+	key      Key
+	tuple    Tuple
+	absent   bool
+	last     TID
+	prev     *PRecord
+	next     *PRecord
+	cached   bool
+	evicted  bool
+	off      int64
+	size     int32
+	padding2 [64]byte
 }
 
 func (pr *PRecord) GetKey() Key {
@@ -112,58 +104,44 @@ func (pr *PRecord) IsUnlocked() (bool, TID) {
 	return false, 0
 }
 
-func (pr *PRecord) Value() Value {
-	//return nil
-	switch pr.recType {
-	case SINGLEINT:
-		return &pr.intVal
-	case STRINGLIST:
-		return &pr.stringVal
-	}
-	return nil
+func (pr *PRecord) Tuple() *Tuple {
+	return &pr.tuple
 }
 
-func (pr *PRecord) UpdateValue(val Value) bool {
-	//intVal := val.(int64)
-	if val == nil {
-		return false
-	}
-	switch pr.recType {
-	case SINGLEINT:
-		pr.intVal = *val.(*int64)
-		//intVal := val.(int64)
-		//pr.intVal = intVal
-	case STRINGLIST:
-		strAttr := val.(*StrAttr)
-		if strAttr.index >= len(pr.stringVal) {
-			clog.Error("Index %v out of range array length %v",
-				strAttr.index, len(pr.stringVal))
-		}
-		pr.stringVal[strAttr.index] = strAttr.value
-	}
-	return true
+func (pr *PRecord) SetColumn(col int, val Value) {
+	pr.tuple.Set(col, val)
 }
 
 func (pr *PRecord) GetTID() TID {
-	clog.Error("Partition mode does not support GetTID Operation")
-	return 0
+	return pr.last
 }
 
 func (pr *PRecord) SetTID(tid TID) {
-	clog.Error("Partition mode does not support SetTID Operation")
+	pr.last = tid
 }
 
 func (pr *PRecord) DoNothing() {
 }
 
+func (pr *PRecord) IsAbsent() bool {
+	return pr.absent
+}
+
+func (pr *PRecord) SetAbsent(absent bool) {
+	pr.absent = absent
+}
+
+func (pr *PRecord) SetTuple(tup *Tuple) {
+	pr.tuple.CopyFrom(tup)
+}
+
 type ORecord struct {
-	padding1  [64]byte
-	key       Key
-	intVal    int64
-	stringVal []string
-	recType   RecType
-	last      wfmutex.WFMutex
-	padding2  [64]byte
+	padding1 [64]byte
+	key      Key
+	tuple    Tuple
+	absent   bool
+	last     wfmutex.WFMutex
+	padding2 [64]byte
 }
 
 func (or *ORecord) Lock() (bool, TID) {
@@ -183,54 +161,135 @@ func (or *ORecord) IsUnlocked() (bool, TID) {
 	return true, TID(x)
 }
 
-func (or *ORecord) Value() Value {
-	switch or.recType {
-	case SINGLEINT:
-		return &or.intVal
-	case STRINGLIST:
-		return &or.stringVal
-	}
-	return nil
+func (or *ORecord) Tuple() *Tuple {
+	return &or.tuple
 }
 
 func (or *ORecord) GetKey() Key {
 	return or.key
 }
 
-func (or *ORecord) UpdateValue(val Value) bool {
-	if val == nil {
-		return false
-	}
-	switch or.recType {
-	case SINGLEINT:
-		or.intVal = *val.(*int64)
-	case STRINGLIST:
-		strAttr := val.(*StrAttr)
-		if strAttr.index >= len(or.stringVal) {
-			clog.Error("Index %v out of range array length %v",
-				strAttr.index, len(or.stringVal))
-		}
-		or.stringVal[strAttr.index] = strAttr.value
-	}
-	return true
+func (or *ORecord) SetColumn(col int, val Value) {
+	or.tuple.Set(col, val)
 }
 
 func (or *ORecord) GetTID() TID {
 	return TID(or.last.Read())
 }
 
+// SetTID is only for records nobody else can reach, e.g. during
+// loading; transactions set TIDs through Unlock
 func (or *ORecord) SetTID(tid TID) {
-	clog.Error("OCC mode does not support SetTID Operation")
+	or.last.Lock()
+	or.last.Unlock(uint64(tid))
 }
 
 func (or *ORecord) DoNothing() {
 }
 
+// The absent flag and value change only with the record locked,
+// so readers validate them through the TID
+func (or *ORecord) IsAbsent() bool {
+	return or.absent
+}
+
+func (or *ORecord) SetAbsent(absent bool) {
+	or.absent = absent
+}
+
+func (or *ORecord) SetTuple(tup *Tuple) {
+	or.tuple.CopyFrom(tup)
+}
+
+// 2PL Record
+type LRecord struct {
+	padding1 [64]byte
+	key      Key
+	tuple    Tuple
+	absent   bool
+	rwLock   spinlock.RWSpinlock
+	last     TID
+	dep      CommitDep
+	padding2 [64]byte
+}
+
+func (lr *LRecord) GetKey() Key {
+	return lr.key
+}
+
+func (lr *LRecord) Lock() (bool, TID) {
+	clog.Error("2PL mode does not support Lock Operation")
+	return false, 0
+}
+
+func (lr *LRecord) Unlock(tid TID) {
+	clog.Error("2PL mode does not support Unlock Operation")
+}
+
+func (lr *LRecord) IsUnlocked() (bool, TID) {
+	clog.Error("2PL mode does not support IsUnlocked Operation")
+	return false, 0
+}
+
+// RLock, WLock and Upgrade never block; they return false
+// if the lock is held in a conflicting mode
+func (lr *LRecord) RLock() bool {
+	return lr.rwLock.TryRLock()
+}
+
+func (lr *LRecord) RUnlock() {
+	lr.rwLock.RUnlock()
+}
+
+func (lr *LRecord) WLock() bool {
+	return lr.rwLock.TryLock()
+}
+
+func (lr *LRecord) WUnlock() {
+	lr.rwLock.Unlock()
+}
+
+func (lr *LRecord) Upgrade() bool {
+	return lr.rwLock.TryUpgrade()
+}
+
+func (lr *LRecord) Tuple() *Tuple {
+	return &lr.tuple
+}
+
+func (lr *LRecord) SetColumn(col int, val Value) {
+	lr.tuple.Set(col, val)
+}
+
+// GetTID and SetTID must be called with the lock held
+func (lr *LRecord) GetTID() TID {
+	return lr.last
+}
+
+func (lr *LRecord) SetTID(tid TID) {
+	lr.last = tid
+}
+
+func (lr *LRecord) DoNothing() {
+}
+
+func (lr *LRecord) IsAbsent() bool {
+	return lr.absent
+}
+
+func (lr *LRecord) SetAbsent(absent bool) {
+	lr.absent = absent
+}
+
+func (lr *LRecord) SetTuple(tup *Tuple) {
+	lr.tuple.CopyFrom(tup)
+}
+
 // Dummy Record
 type DRecord struct {
 	padding1 [128]byte
 	key      Key
-	value    Value
+	tuple    *Tuple
 	padding2 [128]byte
 }
 
@@ -253,13 +312,12 @@ func (dr *DRecord) IsUnlocked() (bool, TID) {
 	return false, 0
 }
 
-func (dr *DRecord) Value() Value {
-	return dr.value
+func (dr *DRecord) Tuple() *Tuple {
+	return dr.tuple
 }
 
-func (dr *DRecord) UpdateValue(val Value) bool {
-	dr.value = val
-	return true
+func (dr *DRecord) SetColumn(col int, val Value) {
+	dr.tuple.Set(col, val)
 }
 
 func (dr *DRecord) GetTID() TID {
@@ -273,3 +331,16 @@ func (dr *DRecord) SetTID(tid TID) {
 
 func (dr *DRecord) DoNothing() {
 }
+
+func (dr *DRecord) IsAbsent() bool {
+	return false
+}
+
+func (dr *DRecord) SetAbsent(absent bool) {
+	clog.Error("Dummy Record does not support SetAbsent Operation")
+}
+
+// A dummy record shares tup instead of copying it
+func (dr *DRecord) SetTuple(tup *Tuple) {
+	dr.tuple = tup
+}
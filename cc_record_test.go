@@ -1,6 +1,7 @@
 package testbed
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 )
@@ -13,14 +14,32 @@ func TestRecord(t *testing.T) {
 	// test MakeBR
 	var k Key
 	var intValue int64 = 10
-	var r = MakeRecord(k, intValue, SINGLEINT)
-	fmt.Printf("Int Value is %v \n", r.Value())
+	var r = MakeRecord(k, intSchema.MakeTuple(intValue))
+	fmt.Printf("Int Value is %v \n", r.Tuple())
 
-	var stringList = []string{"Hello", "World"}
-	r = MakeRecord(k, stringList, STRINGLIST)
-	fmt.Printf("String Value is %v \n", r.Value())
+	r = MakeRecord(k, GenTuple(SchemaOf(STRINGLIST)))
+	fmt.Printf("String Value is %v \n", r.Tuple())
+
+	// Every column type keeps its own value
+	sch := NewSchema(Column{Name: "id", Type: INT64}, Column{Name: "price", Type: FLOAT64},
+		Column{Name: "name", Type: STRING, Size: 8}, Column{Name: "data", Type: BYTES},
+		Column{Name: "qty", Type: INT64})
+	data := []byte{1, 2, 3}
+	r = MakeRecord(k, sch.MakeTuple(int64(1), 2.5, "abc", data, int64(-4)))
+	data[0] = 9
+	r.SetColumn(sch.Column("qty"), int64(5))
+	tup := r.Tuple()
+	if tup.GetInt64(0) != 1 || tup.GetFloat64(1) != 2.5 || tup.GetString(2) != "abc" ||
+		!bytes.Equal(tup.GetBytes(3), []byte{1, 2, 3}) || tup.GetInt64(4) != 5 {
+		t.Errorf("Tuple holds %v", tup)
+	}
+	cp := tup.Copy()
+	r.SetColumn(2, "xyz")
+	if cp.GetString(2) != "abc" || sch.Column("none") != -1 {
+		t.Errorf("Copy of tuple changes to %v", cp)
+	}
 
 	fmt.Println("===============")
 	fmt.Println("Test Record End")
-	fmt.Println("===============\n")
+	fmt.Printf("===============\n\n")
 }
@@ -0,0 +1,331 @@
+package testbed
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+var Replica = flag.String("replica", "", "Address of the backup commit logs are shipped to, unix:<path> or <host>:<port>; empty disables replication")
+var SyncRep = flag.Bool("syncrep", false, "Commits wait until the backup has applied them")
+
+const (
+	REPHEADER = 14 // [worker][lsn][len]
+	REPACK    = 10 // [worker][lsn]
+)
+
+// A unix:<path> address is a Unix socket, others are TCP
+func splitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
+
+func checkReplica() {
+	if *LogDir == "" {
+		clog.Error("Replication Ships Commit Logs; Needs -logdir")
+	}
+	if *CmdLog {
+		clog.Error("Replication Cannot Ship Command Logs")
+	}
+}
+
+type shipped struct {
+	lsn uint64
+	tm  time.Time
+}
+
+// The replicator ships the records of each commit log to a backup
+// once they are flushed, as a frame of [worker uint16][lsn uint64]
+// [len uint32] and the records. The backup acknowledges a frame with
+// [worker uint16][lsn uint64] once it has applied it. With -syncrep,
+// Flush only makes records durable after their acknowledgement, so
+// commits and early released locks wait on the backup as well.
+type Replicator struct {
+	padding1 [64]byte
+	conn     net.Conn
+	wmu      sync.Mutex // Serializes frames
+	mu       sync.Mutex // Guards the acknowledgements and stats
+	cond     *sync.Cond
+	acked    []uint64
+	inflight [][]shipped
+	closed   bool // The backup has disconnected
+	done     chan bool
+	NFrames  int64
+	NRecords int64
+	NBytes   int64
+	NLag     time.Duration // Sum of the times from shipping to acknowledgement
+	NAckWait time.Duration // Time commits waited for acknowledgements
+	padding2 [64]byte
+}
+
+func NewReplicator(addr string, nLogs int) *Replicator {
+	network, address := splitAddr(addr)
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		clog.Error("Connect Backup Error %s\n", err.Error())
+	}
+	rep := &Replicator{
+		conn:     conn,
+		acked:    make([]uint64, nLogs),
+		inflight: make([][]shipped, nLogs),
+		done:     make(chan bool),
+	}
+	rep.cond = sync.NewCond(&rep.mu)
+	go rep.readAcks()
+	return rep
+}
+
+// Sends the records of log id up to lsn; n of them are in buf
+func (rep *Replicator) ship(id int, lsn uint64, n int64, buf []byte) {
+	var h [REPHEADER]byte
+	hdr := appendUint16(h[:0], uint16(id))
+	hdr = appendUint64(hdr, lsn)
+	hdr = appendUint32(hdr, uint32(len(buf)))
+
+	rep.mu.Lock()
+	rep.inflight[id] = append(rep.inflight[id], shipped{lsn: lsn, tm: time.Now()})
+	rep.NFrames++
+	rep.NRecords += n
+	rep.NBytes += int64(len(buf))
+	rep.mu.Unlock()
+
+	rep.wmu.Lock()
+	if _, err := rep.conn.Write(hdr); err != nil {
+		clog.Error("Ship Log Error %s\n", err.Error())
+	}
+	if _, err := rep.conn.Write(buf); err != nil {
+		clog.Error("Ship Log Error %s\n", err.Error())
+	}
+	rep.wmu.Unlock()
+}
+
+// WaitAcked blocks until the backup has applied log id up to lsn
+func (rep *Replicator) WaitAcked(id int, lsn uint64) {
+	tm := time.Now()
+	rep.mu.Lock()
+	for rep.acked[id] < lsn {
+		if rep.closed {
+			clog.Error("Backup Disconnected before Acknowledging LSN %v of Worker %v", lsn, id)
+		}
+		rep.cond.Wait()
+	}
+	rep.NAckWait += time.Since(tm)
+	rep.mu.Unlock()
+}
+
+func (rep *Replicator) readAcks() {
+	r := bufio.NewReader(rep.conn)
+	var b [REPACK]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			break
+		}
+		lr := &logReader{b: b[:]}
+		id, lsn := int(lr.uint16()), lr.uint64()
+		now := time.Now()
+		rep.mu.Lock()
+		q := rep.inflight[id]
+		for len(q) > 0 && q[0].lsn <= lsn {
+			rep.NLag += now.Sub(q[0].tm)
+			q = q[1:]
+		}
+		rep.inflight[id] = q
+		rep.acked[id] = lsn
+		rep.cond.Broadcast()
+		rep.mu.Unlock()
+	}
+	rep.mu.Lock()
+	rep.closed = true
+	rep.cond.Broadcast()
+	rep.mu.Unlock()
+	close(rep.done)
+}
+
+// Close waits until all frames shipped are acknowledged; the commit
+// logs must be closed
+func (rep *Replicator) Close() {
+	rep.mu.Lock()
+	for id := range rep.inflight {
+		for len(rep.inflight[id]) > 0 && !rep.closed {
+			rep.cond.Wait()
+		}
+	}
+	rep.mu.Unlock()
+	rep.conn.Close()
+	<-rep.done
+}
+
+// The backup applies the frames of one primary to its store. Frames
+// of different workers come in any order, so a record takes no TID
+// order as given: the backup keeps the TID of the last write to each
+// column of a record and to its absent flag, and an entry only
+// changes those it is newer than. Each then ends up as the newest
+// write left it, as if all were applied in TID order. The store must
+// hold the dataset the primary started with. Secondary indexes of
+// the backup are not maintained.
+type Backup struct {
+	padding1 [64]byte
+	s        *Store
+	ln       net.Listener
+	applied  map[recordID]*appliedTIDs
+	NFrames  int64
+	NRecords int64
+	NEntries int64
+	NApply   time.Duration
+	padding2 [64]byte
+}
+
+// NewBackup listens on addr at once, so a primary can connect
+// before Serve runs
+func NewBackup(s *Store, addr string) *Backup {
+	network, address := splitAddr(addr)
+	if network == "unix" {
+		os.Remove(address)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		clog.Error("Listen Error %s\n", err.Error())
+	}
+	return &Backup{
+		s:       s,
+		ln:      ln,
+		applied: make(map[recordID]*appliedTIDs),
+	}
+}
+
+type recordID struct {
+	table int
+	part  int
+	k     Key
+}
+
+// TIDs of the last writes the backup applied to a record
+type appliedTIDs struct {
+	cols   []TID
+	absent TID
+}
+
+// Applies the entries of rec to the columns and absent flags they
+// are newer than
+func (b *Backup) apply(rec *logRecord) {
+	for i := range rec.entries {
+		e := &rec.entries[i]
+		t := b.s.tables[e.table]
+		index := t.parts[e.part].index
+		r := index.Get(e.k)
+		id := recordID{e.table, e.part, e.k}
+		at := b.applied[id]
+		if at == nil {
+			var tid TID
+			if r != nil {
+				tid = r.GetTID()
+			}
+			at = &appliedTIDs{
+				cols:   make([]TID, t.Schema.NCols()),
+				absent: tid,
+			}
+			for c := range at.cols {
+				at.cols[c] = tid
+			}
+			b.applied[id] = at
+		}
+		if r == nil {
+			// Newer entries of a key may come before its insert
+			r = MakeRecord(e.k, t.Schema.NewTuple())
+			r.SetAbsent(true)
+			index.Put(e.k, r)
+		}
+		switch e.kind {
+		case LOGINSERT:
+			for c := range at.cols {
+				if at.cols[c] < rec.tid {
+					r.SetColumn(c, e.tup.Get(c))
+					at.cols[c] = rec.tid
+				}
+			}
+			if at.absent < rec.tid {
+				r.SetAbsent(false)
+				at.absent = rec.tid
+			}
+		case LOGUPDATE:
+			if at.cols[e.col] < rec.tid {
+				r.SetColumn(e.col, e.v)
+				at.cols[e.col] = rec.tid
+			}
+		case LOGDELETE:
+			if at.absent < rec.tid {
+				r.SetAbsent(true)
+				at.absent = rec.tid
+			}
+		default:
+			clog.Error("Log Entry Kind %v Not Supported", e.kind)
+		}
+		if r.GetTID() < rec.tid {
+			r.SetTID(rec.tid)
+		}
+	}
+}
+
+// Serve applies the frames of the first primary to connect until it
+// disconnects, then recounts the keys of the store
+func (b *Backup) Serve() {
+	conn, err := b.ln.Accept()
+	b.ln.Close()
+	if err != nil {
+		clog.Error("Accept Error %s\n", err.Error())
+	}
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, LOGBUFSIZE)
+	var hdr [REPHEADER]byte
+	var buf, ack []byte
+	var recs []logRecord
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+		lr := &logReader{b: hdr[:]}
+		id, lsn, n := lr.uint16(), lr.uint64(), int(lr.uint32())
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			clog.Error("Backup Reads a Short Frame %s\n", err.Error())
+		}
+
+		tm := time.Now()
+		recs = recs[:0]
+		lr = &logReader{b: buf}
+		for lr.pos < len(buf) {
+			rec, _ := lr.record(b.s)
+			if lr.short {
+				clog.Error("Backup Reads a Short Record of Worker %v", id)
+			}
+			recs = append(recs, rec)
+		}
+		for i := range recs {
+			b.apply(&recs[i])
+			b.NEntries += int64(len(recs[i].entries))
+		}
+		b.NApply += time.Since(tm)
+		b.NRecords += int64(len(recs))
+		b.NFrames++
+
+		ack = appendUint16(ack[:0], id)
+		ack = appendUint64(ack, lsn)
+		if _, err := conn.Write(ack); err != nil {
+			clog.Error("Acknowledge Error %s\n", err.Error())
+		}
+	}
+	scanTables(b.s, false)
+}
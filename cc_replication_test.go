@@ -0,0 +1,226 @@
+package testbed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	fmt.Println("===============================")
+	fmt.Println("Test Replication Begin")
+	fmt.Println("===============================")
+
+	defer func() {
+		*SysType = PARTITION
+		*LogDir = ""
+		*LogEpoch = 0
+		*Replica = ""
+		*SyncRep = false
+		*IndexType = ""
+	}()
+
+	nKeys := int64(8)
+	insKeys := make([]Key, 4)
+	insVals := make([]int64, len(insKeys))
+	for i := range insKeys {
+		insKeys[i] = CKey(nKeys + int64(i))
+		insVals[i] = int64(i)
+	}
+
+	nWorkers := 3
+	for _, sys := range []int{PARTITION, OCC, LOCKING} {
+		for _, syncRep := range []bool{false, true} {
+			for _, epoch := range []time.Duration{0, time.Millisecond} {
+				*SysType = sys
+				*NumPart = 1
+				if sys == PARTITION {
+					// Workers spinning on a partition whose holder
+					// waits for the backup would starve it on one core
+					*NumPart = nWorkers
+				}
+				dir, err := ioutil.TempDir("", "ccrep")
+				if err != nil {
+					t.Fatalf("Create Temp Dir Error %s", err.Error())
+				}
+				defer os.RemoveAll(dir)
+				*LogDir = dir
+				*LogEpoch = epoch
+				*Replica = "unix:" + filepath.Join(dir, "backup.sock")
+				*SyncRep = syncRep
+
+				create := func() (*Store, *Table) {
+					s := NewStore()
+					table := s.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+					for p := 0; p < *NumPart; p++ {
+						for i := int64(0); i < nKeys; i++ {
+							table.CreateKV(CKey(i), table.Schema.MakeTuple(int64(0)), p)
+						}
+						for i, k := range insKeys {
+							table.CreateKV(k, table.Schema.MakeTuple(insVals[i]), p)
+						}
+					}
+					return s, table
+				}
+				backupStore, backupTable := create()
+				backup := NewBackup(backupStore, *Replica)
+				served := make(chan bool)
+				go func() {
+					backup.Serve()
+					close(served)
+				}()
+
+				store, table := create()
+				coord := NewCoordinator(nWorkers, store)
+				var wg sync.WaitGroup
+				for i := 0; i < nWorkers; i++ {
+					wg.Add(1)
+					go func(n int) {
+						w := coord.Workers[n]
+						part := 0
+						if sys == PARTITION {
+							part = n
+						}
+						q := &Query{
+							TXN:         ADD_ONE,
+							accessParts: []int{part},
+							wKeys:       []Key{CKey(int64(n) % nKeys), CKey(int64(n+3) % nKeys)},
+						}
+						if n == nWorkers-1 {
+							q = &Query{
+								TXN:         INSERT_DELETE_INT,
+								accessParts: []int{part},
+								wKeys:       insKeys,
+								wValue:      &SingleIntValue{intVals: insVals},
+							}
+						}
+						for j := 0; j < 301; j++ {
+							w.One(q)
+							if syncRep {
+								// Whatever is durable has been applied
+								rep := w.log.rep
+								rep.mu.Lock()
+								acked := rep.acked[n]
+								rep.mu.Unlock()
+								if d := w.log.Durable(); acked < d {
+									t.Errorf("Mode %v epoch %v: worker %v durable at %v, acknowledged at %v", sys, epoch, n, d, acked)
+								}
+							}
+							time.Sleep(10 * time.Microsecond)
+						}
+						wg.Done()
+					}(i)
+				}
+				wg.Wait()
+				coord.Close()
+				<-served
+
+				var logged int64
+				for _, w := range coord.Workers {
+					logged += w.log.NRecords
+				}
+				if backup.NRecords != logged || coord.rep.NRecords != logged {
+					t.Errorf("Mode %v sync %v epoch %v: backup applied %v records, %v shipped; %v logged",
+						sys, syncRep, epoch, backup.NRecords, coord.rep.NRecords, logged)
+				}
+				var nPresent int64
+				for p := 0; p < *NumPart; p++ {
+					for i := int64(0); i < nKeys+int64(len(insKeys)); i++ {
+						k := CKey(i)
+						r, rb := table.GetRecord(k, p), backupTable.GetRecord(k, p)
+						present := r != nil && !r.IsAbsent()
+						if present {
+							nPresent++
+						}
+						if (rb != nil && !rb.IsAbsent()) != present {
+							t.Errorf("Mode %v sync %v epoch %v: key %v present %v on backup", sys, syncRep, epoch, i, !present)
+						} else if present && r.Tuple().GetInt64(0) != rb.Tuple().GetInt64(0) {
+							t.Errorf("Mode %v sync %v epoch %v: key %v is %v on backup; expected %v", sys, syncRep, epoch, i,
+								rb.Tuple().GetInt64(0), r.Tuple().GetInt64(0))
+						}
+					}
+				}
+				if backupTable.NKeys() != nPresent {
+					t.Errorf("Mode %v sync %v epoch %v: backup has %v keys", sys, syncRep, epoch, backupTable.NKeys())
+				}
+			}
+		}
+	}
+
+	fmt.Println("=============================")
+	fmt.Println("Test Replication End")
+	fmt.Println("=============================")
+}
+
+func TestBackupOrder(t *testing.T) {
+	fmt.Println("===============================")
+	fmt.Println("Test Backup Order Begin")
+	fmt.Println("===============================")
+
+	*SysType = PARTITION
+	*NumPart = 1
+	dir, err := ioutil.TempDir("", "ccrep")
+	if err != nil {
+		t.Fatalf("Create Temp Dir Error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	addr := "unix:" + filepath.Join(dir, "backup.sock")
+
+	sch := NewSchema(Column{Name: "c0", Type: STRING}, Column{Name: "c1", Type: STRING})
+	s := NewStore()
+	table := s.CreateTable(RECORDS, sch, nil, "")
+	x, y, z := CKey(0), CKey(1), CKey(2)
+	table.CreateKV(x, sch.MakeTuple("x0", "x1"), 0)
+	table.CreateKV(z, sch.MakeTuple("z0", "z1"), 0)
+	backup := NewBackup(s, addr)
+	served := make(chan bool)
+	go func() {
+		backup.Serve()
+		close(served)
+	}()
+
+	// Worker 1 ships its frames before the older ones of worker 0
+	rep := NewReplicator(addr, 2)
+	logs := []*CommitLog{NewCommitLog(dir, 0), NewCommitLog(dir, 1)}
+	for _, l := range logs {
+		l.rep = rep
+	}
+	commit := func(l *CommitLog, tid TID, fn func()) {
+		l.Begin()
+		fn()
+		l.End(tid, 0)
+		l.Flush()
+	}
+	commit(logs[1], 11, func() { logs[1].AppendUpdate(table.ID, 0, x, 1, "b") })
+	commit(logs[1], 13, func() { logs[1].AppendUpdate(table.ID, 0, y, 0, "b") })
+	commit(logs[1], 15, func() { logs[1].AppendDelete(table.ID, 0, z) })
+	commit(logs[0], 10, func() { logs[0].AppendUpdate(table.ID, 0, x, 0, "a") })
+	commit(logs[0], 12, func() { logs[0].AppendInsert(table.ID, 0, y, sch.MakeTuple("a", "a")) })
+	commit(logs[0], 14, func() { logs[0].AppendUpdate(table.ID, 0, z, 0, "a") })
+	for _, l := range logs {
+		l.Close()
+	}
+	rep.Close()
+	<-served
+
+	if r := table.GetRecord(x, 0); r.Tuple().GetString(0) != "a" || r.Tuple().GetString(1) != "b" || r.GetTID() != 11 {
+		t.Errorf("Key x is %v at %v; expected [a b] at 11", r.Tuple(), r.GetTID())
+	}
+	if r := table.GetRecord(y, 0); r == nil || r.IsAbsent() || r.Tuple().GetString(0) != "b" || r.Tuple().GetString(1) != "a" {
+		t.Errorf("Key y is not [b a] after its insert comes late")
+	}
+	if r := table.GetRecord(z, 0); !r.IsAbsent() {
+		t.Errorf("Key z is revived by an older update")
+	}
+	if table.NKeys() != 2 {
+		t.Errorf("Backup has %v keys; expected 2", table.NKeys())
+	}
+
+	fmt.Println("=============================")
+	fmt.Println("Test Backup Order End")
+	fmt.Println("=============================")
+}
@@ -0,0 +1,238 @@
+package testbed
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+type ColType int
+
+// Go types of column values are int64, float64, string and []byte
+const (
+	INT64 ColType = iota
+	FLOAT64
+	STRING
+	BYTES
+)
+
+type Column struct {
+	Name string
+	Type ColType
+	Size int // Maximum length of a STRING column; 0 for no limit
+}
+
+// A schema lays the columns of a record out by type: int64 and
+// float64 columns share one slice of words, strings and bytes have
+// one slice each. slots[i] is the position of column i in its slice.
+type Schema struct {
+	Columns []Column
+	slots   []int
+	nNums   int
+	nStrs   int
+	nBytes  int
+}
+
+func NewSchema(cols ...Column) *Schema {
+	s := &Schema{
+		Columns: cols,
+		slots:   make([]int, len(cols)),
+	}
+	for i, c := range cols {
+		switch c.Type {
+		case INT64, FLOAT64:
+			s.slots[i] = s.nNums
+			s.nNums++
+		case STRING:
+			s.slots[i] = s.nStrs
+			s.nStrs++
+		case BYTES:
+			s.slots[i] = s.nBytes
+			s.nBytes++
+		default:
+			clog.Error("Column Type %v Not Supported", c.Type)
+		}
+	}
+	return s
+}
+
+func (s *Schema) NCols() int {
+	return len(s.Columns)
+}
+
+// Column returns the index of the column called name; -1 if none
+func (s *Schema) Column(name string) int {
+	for i := range s.Columns {
+		if s.Columns[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// NewTuple returns a tuple with zero values in all columns
+func (s *Schema) NewTuple() *Tuple {
+	tup := &Tuple{schema: s}
+	tup.init(s)
+	return tup
+}
+
+// MakeTuple returns a tuple holding vals in column order
+func (s *Schema) MakeTuple(vals ...Value) *Tuple {
+	if len(vals) != len(s.Columns) {
+		clog.Error("%v Values for %v Columns", len(vals), len(s.Columns))
+	}
+	tup := s.NewTuple()
+	for i, v := range vals {
+		tup.Set(i, v)
+	}
+	return tup
+}
+
+var intSchema = NewSchema(Column{Name: "value", Type: INT64})
+
+var stringListSchema = func() *Schema {
+	cols := make([]Column, FIELDS)
+	for i := range cols {
+		cols[i] = Column{Name: fmt.Sprintf("field%d", i), Type: STRING, Size: PERFIELD}
+	}
+	return NewSchema(cols...)
+}()
+
+// SchemaOf returns the schema of a built-in record type: SINGLEINT
+// is one int64 column, STRINGLIST FIELDS strings of PERFIELD bytes
+func SchemaOf(rt RecType) *Schema {
+	switch rt {
+	case SINGLEINT:
+		return intSchema
+	case STRINGLIST:
+		return stringListSchema
+	}
+	clog.Error("Record Type %v Not Supported", rt)
+	return nil
+}
+
+// The values of a record under its schema
+type Tuple struct {
+	schema *Schema
+	nums   []uint64
+	strs   []string
+	bytes  [][]byte
+}
+
+func (t *Tuple) init(s *Schema) {
+	t.schema = s
+	if s.nNums > 0 {
+		t.nums = make([]uint64, s.nNums)
+	}
+	if s.nStrs > 0 {
+		t.strs = make([]string, s.nStrs)
+	}
+	if s.nBytes > 0 {
+		t.bytes = make([][]byte, s.nBytes)
+	}
+}
+
+func (t *Tuple) Schema() *Schema {
+	return t.schema
+}
+
+func (t *Tuple) check(col int, ct ColType) int {
+	if t.schema.Columns[col].Type != ct {
+		clog.Error("Column %v is of Type %v, not %v", col, t.schema.Columns[col].Type, ct)
+	}
+	return t.schema.slots[col]
+}
+
+func (t *Tuple) GetInt64(col int) int64 {
+	return int64(t.nums[t.check(col, INT64)])
+}
+
+func (t *Tuple) GetFloat64(col int) float64 {
+	return math.Float64frombits(t.nums[t.check(col, FLOAT64)])
+}
+
+func (t *Tuple) GetString(col int) string {
+	return t.strs[t.check(col, STRING)]
+}
+
+// The returned slice is read only
+func (t *Tuple) GetBytes(col int) []byte {
+	return t.bytes[t.check(col, BYTES)]
+}
+
+// Get returns column col as a value of the Go type of the column
+func (t *Tuple) Get(col int) Value {
+	switch t.schema.Columns[col].Type {
+	case INT64:
+		return t.GetInt64(col)
+	case FLOAT64:
+		return t.GetFloat64(col)
+	case STRING:
+		return t.GetString(col)
+	default:
+		return t.GetBytes(col)
+	}
+}
+
+func (t *Tuple) SetInt64(col int, v int64) {
+	t.nums[t.check(col, INT64)] = uint64(v)
+}
+
+func (t *Tuple) SetFloat64(col int, v float64) {
+	t.nums[t.check(col, FLOAT64)] = math.Float64bits(v)
+}
+
+func (t *Tuple) SetString(col int, v string) {
+	slot := t.check(col, STRING)
+	if size := t.schema.Columns[col].Size; size > 0 && len(v) > size {
+		clog.Error("String of %v Bytes Exceeds Column %v of %v", len(v), col, size)
+	}
+	t.strs[slot] = v
+}
+
+// v is copied; the old slice is never written, as readers may hold it
+func (t *Tuple) SetBytes(col int, v []byte) {
+	t.bytes[t.check(col, BYTES)] = append([]byte(nil), v...)
+}
+
+// Set takes a value of the Go type of column col
+func (t *Tuple) Set(col int, v Value) {
+	switch t.schema.Columns[col].Type {
+	case INT64:
+		t.SetInt64(col, v.(int64))
+	case FLOAT64:
+		t.SetFloat64(col, v.(float64))
+	case STRING:
+		t.SetString(col, v.(string))
+	default:
+		t.SetBytes(col, v.([]byte))
+	}
+}
+
+// CopyFrom makes t a copy of src, reusing the slices of t
+func (t *Tuple) CopyFrom(src *Tuple) {
+	if t.schema != src.schema {
+		t.init(src.schema)
+	}
+	copy(t.nums, src.nums)
+	copy(t.strs, src.strs)
+	for i := range src.bytes {
+		t.bytes[i] = append([]byte(nil), src.bytes[i]...)
+	}
+}
+
+func (t *Tuple) Copy() *Tuple {
+	tup := &Tuple{}
+	tup.CopyFrom(t)
+	return tup
+}
+
+func (t *Tuple) String() string {
+	vals := make([]Value, len(t.schema.Columns))
+	for i := range vals {
+		vals[i] = t.Get(i)
+	}
+	return fmt.Sprint(vals)
+}
@@ -0,0 +1,171 @@
+package testbed
+
+import (
+	"sync/atomic"
+
+	"github.com/totemtang/cc-testbed/clog"
+	"github.com/totemtang/cc-testbed/spinlock"
+	"github.com/totemtang/cc-testbed/wfmutex"
+)
+
+// A secondary index maps the value of one STRING column of the
+// records of a table to their keys. Like the primary index it is
+// partitioned: a record is indexed in its own partition.
+type SecIndex struct {
+	padding1 [64]byte
+	ID       int
+	Field    int
+	Table    *Table
+	parts    []*secPart
+	padding2 [64]byte
+}
+
+type secPart struct {
+	padding1 [64]byte
+	lock     spinlock.RWSpinlock
+	entries  map[string]*SecEntry
+	padding2 [64]byte
+}
+
+// An entry is concurrency controlled like a record: OCC validates
+// its TID and 2PL locks it. Entries are created on first use and
+// stay, even empty, so that a lookup of a missing value can be
+// validated as well. The key list is replaced on every change.
+type SecEntry struct {
+	padding1 [64]byte
+	keys     atomic.Value // []Key
+	last     wfmutex.WFMutex
+	rwLock   spinlock.RWSpinlock
+	padding2 [64]byte
+}
+
+// CreateSecIndex adds an index over column field, which has to be
+// a STRING. It has to be created before records are loaded.
+func (t *Table) CreateSecIndex(field int) *SecIndex {
+	if field < 0 || field >= t.Schema.NCols() {
+		clog.Error("Field %v out of range %v", field, t.Schema.NCols())
+	}
+	if t.Schema.Columns[field].Type != STRING {
+		clog.Error("Column %v of Table %s is not a STRING", field, t.Name)
+	}
+	si := &SecIndex{
+		ID:    len(t.secIndexes),
+		Field: field,
+		Table: t,
+		parts: make([]*secPart, len(t.parts)),
+	}
+	for i := range si.parts {
+		si.parts[i] = &secPart{
+			entries: make(map[string]*SecEntry),
+		}
+	}
+	t.secIndexes = append(t.secIndexes, si)
+	return si
+}
+
+func (t *Table) SecIndex(id int) *SecIndex {
+	return t.secIndexes[id]
+}
+
+// Returns the entry of val, adding an empty one if there is none
+func (si *SecIndex) entry(val string, partNum int) *SecEntry {
+	p := si.parts[partNum]
+	p.lock.RLock()
+	e, ok := p.entries[val]
+	p.lock.RUnlock()
+	if ok {
+		return e
+	}
+
+	p.lock.Lock()
+	e, ok = p.entries[val]
+	if !ok {
+		e = &SecEntry{}
+		e.keys.Store([]Key(nil))
+		p.entries[val] = e
+	}
+	p.lock.Unlock()
+	return e
+}
+
+// Calls fn on every entry k leaves (add false) or joins (add true)
+// when the record of k changes from oldVal to newVal; both return
+// column i of the record, nil standing for no record. Only
+// indexes over field are affected, or all of them if field < 0.
+func (t *Table) secChanges(k Key, partNum int, field int, oldVal func(i int) string, newVal func(i int) string, fn func(e *SecEntry, k Key, add bool) error) error {
+	for _, si := range t.secIndexes {
+		if field >= 0 && si.Field != field {
+			continue
+		}
+		var o, n string
+		if oldVal != nil {
+			o = oldVal(si.Field)
+		}
+		if newVal != nil {
+			n = newVal(si.Field)
+		}
+		if oldVal != nil && newVal != nil && o == n {
+			continue
+		}
+		if oldVal != nil {
+			if err := fn(si.entry(o, partNum), k, false); err != nil {
+				return err
+			}
+		}
+		if newVal != nil {
+			if err := fn(si.entry(n, partNum), k, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func attrOf(tup *Tuple) func(i int) string {
+	return tup.GetString
+}
+
+// Changes entries at once, for callers which own the partition
+func applySec(e *SecEntry, k Key, add bool) error {
+	e.apply(k, add)
+	return nil
+}
+
+func (e *SecEntry) Keys() []Key {
+	return e.keys.Load().([]Key)
+}
+
+func (e *SecEntry) apply(k Key, add bool) {
+	e.keys.Store(applyKey(e.Keys(), k, add))
+}
+
+// Returns a copy of keys without k, or with k added at the end
+func applyKey(keys []Key, k Key, add bool) []Key {
+	ret := make([]Key, 0, len(keys)+1)
+	for _, x := range keys {
+		if x != k {
+			ret = append(ret, x)
+		}
+	}
+	if add {
+		ret = append(ret, k)
+	}
+	return ret
+}
+
+func (e *SecEntry) Lock() (bool, TID) {
+	b, x := e.last.Lock()
+	return b, TID(x)
+}
+
+func (e *SecEntry) Unlock(tid TID) {
+	e.last.Unlock(uint64(tid))
+}
+
+func (e *SecEntry) IsUnlocked() (bool, TID) {
+	x := e.last.Read()
+	if x&wfmutex.LOCKED != 0 {
+		return false, TID(x & wfmutex.TIDMASK)
+	}
+	return true, TID(x)
+}
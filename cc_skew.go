@@ -0,0 +1,53 @@
+package testbed
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// Partition-level skew: each query of a generator goes to a home
+// partition drawn by Zipf, partition 0 the most often, instead of the
+// generator's own. Partitions then take uneven loads, which partition
+// mode serializes on the hot ones.
+
+// SetSkew draws the home partition of each query by Zipf with factor
+// s > 1; 0 goes back to the generator's own partition
+func (tg *TxnGen) SetSkew(s float64) {
+	if s == 0 {
+		tg.skew = nil
+		return
+	}
+	if !tg.isPartition {
+		clog.Error("Partition Skew Needs Partition Mode or Physical Partitions")
+	}
+	if s <= 1 {
+		clog.Error("Partition Skew Factor %v Should Be Greater Than 1", s)
+	}
+	tg.skew = rand.NewZipf(tg.rnd, s, 1, uint64(tg.nParts-1))
+}
+
+func (tg *TxnGen) home() int {
+	if tg.skew == nil {
+		return tg.partIndex
+	}
+	return int(tg.skew.Uint64())
+}
+
+// Transactions committed on each partition, and the most over the mean
+func (coord *Coordinator) printPartLoad(f *os.File) {
+	var total, max int64
+	for i, n := range coord.NPartTxn {
+		f.WriteString(fmt.Sprintf("Partition %v Runs %v Transactions\n", i, n))
+		total += n
+		if n > max {
+			max = n
+		}
+	}
+	if total != 0 {
+		mean := float64(total) / float64(len(coord.NPartTxn))
+		f.WriteString(fmt.Sprintf("Partition Load Imbalance %.4f\n", float64(max)/mean))
+	}
+}
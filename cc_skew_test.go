@@ -0,0 +1,79 @@
+package testbed
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSkew(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Skew Begin")
+	fmt.Println("=======================")
+
+	defer func() {
+		*CrossPercent = 0
+	}()
+
+	*SysType = PARTITION
+	*CrossPercent = 10
+	nParts := 4
+	*NumPart = nParts
+	nKeys := int64(1024)
+	hp := &HashPartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+	}
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), hp, "")
+	pKeysArray := LoadTable(table, nKeys, 1, 0)
+	coord := NewCoordinator(nParts, store)
+	nTxns := 2000
+	for i, w := range coord.Workers {
+		zk := NewZipfKey(i, nKeys, nParts, pKeysArray, 1, hp)
+		g := NewTxnGen(i, ADD_ONE, 0, 4, 2, zk)
+		g.SetSkew(2)
+		for j := 0; j < nTxns; j++ {
+			q := g.GenOneQuery()
+			for _, k := range q.wKeys {
+				part := hp.GetPartition(k)
+				found := false
+				for _, p := range q.accessParts {
+					found = found || p == part
+				}
+				if !found {
+					t.Errorf("Key %v of partition %v is outside %v", k, part, q.accessParts)
+				}
+			}
+			if _, err := w.One(q); err != nil {
+				t.Errorf("Worker %v: query fails with %v", i, err)
+			}
+		}
+	}
+	coord.Close()
+	coord.gatherStats()
+
+	// Each committed transaction counts once on each of its partitions
+	total := int64(nParts * nTxns)
+	var sum int64
+	for _, n := range coord.NPartTxn {
+		sum += n
+	}
+	if sum != coord.NStats[NTXN]+coord.NStats[NCROSSTXN] || coord.NStats[NTXN] != total {
+		t.Errorf("Partitions run %v transactions; %v committed, %v cross", sum, coord.NStats[NTXN], coord.NStats[NCROSSTXN])
+	}
+
+	// Partition 0 is the hottest, far above an even share
+	for p := 1; p < nParts; p++ {
+		if coord.NPartTxn[p] >= coord.NPartTxn[p-1] {
+			t.Errorf("Partition %v runs %v transactions; partition %v runs %v", p, coord.NPartTxn[p], p-1, coord.NPartTxn[p-1])
+		}
+	}
+	if coord.NPartTxn[0] < total/2 {
+		t.Errorf("Partition 0 runs %v of %v transactions", coord.NPartTxn[0], total)
+	}
+	fmt.Printf("Transactions of each partition %v\n", coord.NPartTxn)
+
+	fmt.Println("=====================")
+	fmt.Println("Test Skew End")
+	fmt.Println("=====================")
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"flag"
 	"sync"
+	"sync/atomic"
 
+	"github.com/totemtang/cc-testbed/clog"
+	"github.com/totemtang/cc-testbed/epoch"
 	"github.com/totemtang/cc-testbed/spinlock"
 )
 
@@ -19,12 +22,13 @@ const (
 )
 
 var (
-	EABORT = errors.New("abort")
-	ENOKEY = errors.New("no entry")
+	EABORT  = errors.New("abort")
+	ENOKEY  = errors.New("no entry")
+	EDUPKEY = errors.New("duplicate entry")
 )
 
 type TID uint64
-type Key int64
+type Key string
 type Value interface{}
 
 var NumPart = flag.Int("ncores", 2, "number of partitions; equals to the number of cores")
@@ -46,12 +50,23 @@ type Chunk struct {
 
 type Partition struct {
 	padding1  [64]byte
-	data      []*Chunk
+	index     Index
+	reclaimed uint64 // Largest TID of a tombstone unlinked from index
+	ac        *antiCache
 	mutexLock sync.RWMutex
 	spinLock  spinlock.RWSpinlock
 	padding2  [64]byte
 }
 
+func (p *Partition) noteReclaimed(tid TID) {
+	for {
+		old := atomic.LoadUint64(&p.reclaimed)
+		if uint64(tid) <= old || atomic.CompareAndSwapUint64(&p.reclaimed, old, uint64(tid)) {
+			return
+		}
+	}
+}
+
 func (p *Partition) Lock() {
 	if *SpinLock {
 		p.spinLock.Lock()
@@ -70,9 +85,11 @@ func (p *Partition) Unlock() {
 
 type Store struct {
 	padding1 [64]byte
-	store    []*Partition
+	tables   []*Table
+	names    map[string]*Table
 	locks    []*spinlock.Spinlock
-	nKeys    int64
+	epochs   *epoch.Manager
+	cmdSeq   uint64 // Commands logged so far
 	padding2 [64]byte
 }
 
@@ -81,59 +98,65 @@ func NewStore() *Store {
 		*NumPart = 1
 	}
 	s := &Store{
-		store: make([]*Partition, *NumPart),
-		locks: make([]*spinlock.Spinlock, *NumPart),
+		names:  make(map[string]*Table),
+		locks:  make([]*spinlock.Spinlock, *NumPart),
+		epochs: epoch.NewManager(),
 		//locks: make([]*spinlock.Spinlock, *NumPart)
 	}
 
-	var bb1 byte
-
 	for i := 0; i < *NumPart; i++ {
-		part := &Partition{
-			data: make([]*Chunk, CHUNKS),
-		}
-		for j := 0; j < CHUNKS; j++ {
-			chunk := &Chunk{
-				rows: make(map[Key]Record),
-			}
-			bb1 = byte(j)
-			part.data[bb1] = chunk
-		}
-		s.store[i] = part
-
 		//s.locks[i] = &CustLock{}
 		s.locks[i] = &spinlock.Spinlock{}
 	}
 	return s
 }
 
-func (s *Store) CreateKV(k Key, v Value, rt RecType, partNum int) Record {
-	s.nKeys++
-	chunk := s.store[partNum].data[byte(k)]
-	if _, ok := chunk.rows[k]; ok {
-		return nil // One record with that key has existed; return nil to notify this
+// CreateTable adds a table of records of schema sch, split into the
+// partitions of the store. p maps its keys to partitions and may be
+// nil if callers pick partitions themselves. index is the type of
+// its primary index; empty for the -index default.
+func (s *Store) CreateTable(name string, sch *Schema, p Partitioner, index string) *Table {
+	if _, ok := s.names[name]; ok {
+		clog.Error("Table %s Exists", name)
 	}
-
-	r := MakeRecord(k, v, rt)
-	chunk.rows[k] = r
-	return r
+	if index == "" {
+		index = *IndexType
+	}
+	// Workers of OCC and 2PL insert beside others, which the unlocked
+	// maps of the hash index do not allow
+	if index == "" {
+		index = "hash"
+		if *SysType != PARTITION {
+			index = "lfhash"
+		}
+	} else if index == "hash" && *SysType != PARTITION {
+		clog.Error("Table %s Cannot Use -index hash in OCC and 2PL; Use lfhash or btree", name)
+	}
+	t := &Table{
+		ID:          len(s.tables),
+		Name:        name,
+		Schema:      sch,
+		Partitioner: p,
+		parts:       make([]*Partition, len(s.locks)),
+	}
+	for i := range t.parts {
+		t.parts[i] = &Partition{
+			index: NewIndex(index),
+		}
+		if *AntiCacheDir != "" {
+			t.parts[i].ac = newAntiCache(*AntiCacheDir, t, i)
+		}
+	}
+	s.tables = append(s.tables, t)
+	s.names[name] = t
+	return t
 }
 
-func (s *Store) GetRecord(k Key, partNum int) Record {
-	chunk := s.store[partNum].data[byte(k)]
-	r, ok := chunk.rows[k]
-	if !ok {
-		return nil
-	}
-	return r
+// Table returns nil if there is no table called name
+func (s *Store) Table(name string) *Table {
+	return s.names[name]
 }
 
-// Update
-func (s *Store) SetRecord(k Key, val Value, partNum int) bool {
-	chunk := s.store[partNum].data[byte(k)]
-	r, ok := chunk.rows[k]
-	if !ok {
-		return false // No such record; Fail
-	}
-	return r.UpdateValue(val)
+func (s *Store) Tables() []*Table {
+	return s.tables
 }
@@ -13,45 +13,42 @@ func TestStore(t *testing.T) {
 	*NumPart = 10
 	*SysType = PARTITION
 	s := NewStore()
+	table := s.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
 	//Create Keys
 	for i := 0; i < 100; i++ {
-		k := Key(i)
+		k := CKey(int64(i))
 		p := i % *NumPart
-		s.CreateKV(k, int64(i*10), SINGLEINT, p)
+		table.CreateKV(k, table.Schema.MakeTuple(int64(i*10)), p)
 	}
-	key := Key(23)
+	key := CKey(23)
 	part := 23 % *NumPart
 	//Get Key 23
-	r := s.GetRecord(key, part)
-	fmt.Printf("Original Value is %v \n", r.Value())
+	r := table.GetRecord(key, part)
+	fmt.Printf("Original Value is %v \n", r.Tuple())
 	//Update it
-	s.SetRecord(key, int64(110), part)
+	table.SetRecord(key, 0, int64(110), part)
 	//Get it again
-	fmt.Printf("Updated value is %v \n", s.GetRecord(key, part).Value())
+	fmt.Printf("Updated value is %v \n", table.GetRecord(key, part).Tuple())
 
 	// Test string value
-	stringList := []string{"totem", "tang", "aaron", "amy"}
 	s = NewStore()
+	table = s.CreateTable(RECORDS, SchemaOf(STRINGLIST), nil, "")
 	for i := 0; i < 100; i++ {
-		k := Key(i)
+		k := CKey(int64(i))
 		p := i % *NumPart
-		s.CreateKV(k, stringList, STRINGLIST, p)
+		table.CreateKV(k, GenTuple(table.Schema), p)
 	}
-	key = Key(23)
+	key = CKey(23)
 	part = 23 % *NumPart
 	//Get Key 23
-	r = s.GetRecord(key, part)
-	fmt.Printf("Original Value is %v \n", r.Value())
+	r = table.GetRecord(key, part)
+	fmt.Printf("Original Value is %v \n", r.Tuple())
 	//Update it
-	strAttr := &StrAttr{
-		index: 0,
-		value: "totem-updated",
-	}
-	s.SetRecord(key, strAttr, part)
+	table.SetRecord(key, 0, "totem-updated", part)
 	//Get it again
-	fmt.Printf("Updated value is %v \n", s.GetRecord(key, part).Value())
+	fmt.Printf("Updated value is %v \n", table.GetRecord(key, part).Tuple())
 
 	fmt.Println("==============")
 	fmt.Println("Test Store End")
-	fmt.Println("==============\n")
+	fmt.Printf("==============\n\n")
 }
@@ -0,0 +1,108 @@
+package testbed
+
+import (
+	"sync/atomic"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
+// Name of the table the built-in transactions run on
+const RECORDS = "records"
+
+// A table holds records of one schema under its own primary and
+// secondary indexes. Partition i of every table belongs to
+// partition i of the store.
+type Table struct {
+	padding1    [64]byte
+	ID          int
+	Name        string
+	Schema      *Schema
+	Partitioner Partitioner
+	parts       []*Partition
+	secIndexes  []*SecIndex
+	hot         map[Key]bool // Keys copied into every partition
+	nKeys       int64
+	padding2    [64]byte
+}
+
+// Partition of k under the table's partitioner; 0 without one
+func (t *Table) GetPartition(k Key) int {
+	if t.Partitioner == nil {
+		return 0
+	}
+	return t.Partitioner.GetPartition(k)
+}
+
+// Number of records loaded by CreateKV or Recover
+func (t *Table) NKeys() int64 {
+	return atomic.LoadInt64(&t.nKeys)
+}
+
+// CreateKV takes over tup, which has to be of the table's schema
+func (t *Table) CreateKV(k Key, tup *Tuple, partNum int) Record {
+	if tup.Schema() != t.Schema {
+		clog.Error("Tuple of Table %s Has Another Schema", t.Name)
+	}
+	r := MakeRecord(k, tup)
+	if !t.parts[partNum].index.Put(k, r) {
+		return nil // One record with that key has existed; return nil to notify this
+	}
+	atomic.AddInt64(&t.nKeys, 1)
+	if len(t.secIndexes) > 0 {
+		t.secChanges(k, partNum, -1, nil, attrOf(r.Tuple()), applySec)
+	}
+	if ac := t.parts[partNum].ac; ac != nil {
+		ac.touch(r)
+		ac.evict()
+	}
+	return r
+}
+
+// Returns the record of k, adding an absent one if there is none;
+// then also its TID and true. nodeFn is passed on to PutNodes of
+// the index.
+func (t *Table) getOrInsert(k Key, partNum int, nodeFn PutNodeFunc) (Record, TID, bool) {
+	index := t.parts[partNum].index
+	for {
+		if r := index.Get(k); r != nil {
+			return r, 0, false
+		}
+		r := MakeRecord(k, t.Schema.NewTuple())
+		r.SetAbsent(true)
+		// Writers of k commit after the delete whose tombstone
+		// this record may replace
+		tid := TID(atomic.LoadUint64(&t.parts[partNum].reclaimed))
+		if tid != 0 {
+			r.SetTID(tid)
+		}
+		if index.PutNodes(k, r, nodeFn) {
+			return r, tid, true
+		}
+	}
+}
+
+func (t *Table) GetRecord(k Key, partNum int) Record {
+	return t.parts[partNum].index.Get(k)
+}
+
+// Update column col of k to val
+func (t *Table) SetRecord(k Key, col int, val Value, partNum int) bool {
+	r := t.parts[partNum].index.Get(k)
+	if r == nil || r.IsAbsent() {
+		return false // No such record; Fail
+	}
+	r.SetColumn(col, val)
+	return true
+}
+
+// Records with lo <= key <= hi in key order
+func (t *Table) Scan(lo Key, hi Key, partNum int) []Record {
+	var recs []Record
+	t.parts[partNum].index.Scan(lo, hi, func(k Key, r Record) bool {
+		if !r.IsAbsent() {
+			recs = append(recs, r)
+		}
+		return true
+	})
+	return recs
+}
@@ -1,9 +1,11 @@
 package testbed
 
 import (
+	"flag"
 	"math/rand"
+	"strconv"
 
-	//"github.com/totemtang/cc-testbed/clog"
+	"github.com/totemtang/cc-testbed/clog"
 )
 
 type WValue interface{}
@@ -12,16 +14,22 @@ const (
 	ADD_ONE = iota
 	RANDOM_UPDATE_INT
 	RANDOM_UPDATE_STRING
+	SCAN_INT
+	INSERT_DELETE_INT
+	LOOKUP_STRING
 
 	LAST_TXN
 )
 
+var ScanLen = flag.Int("scanlen", 10, "Length of the key range each scan covers")
+var SecValues = flag.Int("secvalues", 1000, "Number of distinct values LOOKUP_STRING writes to the indexed attribute")
+
 type RetIntValue struct {
 	intVals []int64
 }
 
-type RetStringValue struct {
-	strVals [][]string
+type RetTupleValue struct {
+	tuples []*Tuple
 }
 
 type SingleIntValue struct {
@@ -42,11 +50,14 @@ type Query struct {
 	T           TID
 	txnLen      int
 	isPartition bool
-	partitioner *HashPartitioner
+	partitioner Partitioner
 	accessParts []int
 	rKeys       []Key
 	wKeys       []Key
 	wValue      WValue
+	hot         map[Key]bool // Keys replicated into every partition
+	need        []bool       // Scratch of route
+	version     uint64       // Of the partitioner mapping accessParts follow
 	padding2    [64]byte
 }
 
@@ -54,9 +65,11 @@ func (q *Query) DoNothing() {
 
 }
 
+// Values are drawn here, not in the transactions, so that running
+// a query again makes the same writes, as command logging requires
 func (q *Query) GenValue(rnd *rand.Rand) {
 
-	if q.TXN == RANDOM_UPDATE_INT {
+	if q.TXN == RANDOM_UPDATE_INT || q.TXN == SCAN_INT || q.TXN == INSERT_DELETE_INT {
 		v := &SingleIntValue{
 			intVals: make([]int64, len(q.wKeys)),
 		}
@@ -74,7 +87,19 @@ func (q *Query) GenValue(rnd *rand.Rand) {
 		for i := range v.strVals {
 			v.strVals[i] = &StrAttr{
 				index: rnd.Intn(FIELDS),
-				//value: Randstr(int(PERFIELD)),
+				value: Randstr(int(PERFIELD)),
+			}
+		}
+
+		q.wValue = v
+	} else if q.TXN == LOOKUP_STRING {
+		v := &StringListValue{
+			strVals: make([]*StrAttr, len(q.wKeys)),
+		}
+
+		for i := range v.strVals {
+			v.strVals[i] = &StrAttr{
+				value: strconv.Itoa(rnd.Intn(*SecValues)),
 			}
 		}
 
@@ -82,72 +107,114 @@ func (q *Query) GenValue(rnd *rand.Rand) {
 	}
 }
 
+// The built-in transactions below run their declared pieces, the
+// writes and then the reads, so that chopped or not they do the same
 func AddOneTXN(q *Query, tx ETransaction) (*Result, error) {
+	return pieceTxn(AddOnePiece, q, tx)
+}
+
+func UpdateIntTXN(q *Query, tx ETransaction) (*Result, error) {
+	return pieceTxn(UpdateIntPiece, q, tx)
+}
+
+func UpdateStringTXN(q *Query, tx ETransaction) (*Result, error) {
+	return pieceTxn(UpdateStringPiece, q, tx)
+}
+
+// Both pieces as one transaction, aborted by the caller on errors
+func pieceTxn(fn PieceFunc, q *Query, tx ETransaction) (*Result, error) {
+	for piece := 0; piece < 2; piece++ {
+		if err := fn(q, tx, piece); err != nil {
+			return nil, err
+		}
+	}
+	if tx.Commit() == 0 {
+		return nil, EABORT
+	}
+	return nil, nil
+}
+
+// The partitions holding keys from lo to hi, each once
+func scanParts(p Partitioner, lo int64, hi int64, parts []int) []int {
+	parts = parts[:0]
+	for x := lo; x <= hi; x++ {
+		part := p.GetPartition(CKey(x))
+		found := false
+		for _, y := range parts {
+			found = found || y == part
+		}
+		if !found {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// Update write keys, then scan ScanLen keys from each read key, in
+// every partition they fall in
+func ScanIntTXN(q *Query, tx ETransaction) (*Result, error) {
 	var partNum int
+	t := tx.Store().Table(RECORDS)
 	// Apply Writes
-	for _, wk := range q.wKeys {
+	updateVals := q.wValue.(*SingleIntValue)
+	for i, wk := range q.wKeys {
 		if q.partitioner != nil {
 			partNum = q.partitioner.GetPartition(wk)
 		}
-		v, err := tx.Read(wk, partNum, false)
-		if err != nil {
-			return nil, err
-		}
-
-		newVal := *(v.Value().(*int64)) + 1
-		//*(v.Value().(*int64))++
-
-		err = tx.WriteInt64(wk, newVal, partNum)
+		err := tx.WriteColumn(t, wk, 0, updateVals.intVals[i], partNum)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// Read Results
-	//var r Result
-	//rValue := &RetIntValue{
-	//	intVals: make([]int64, len(q.rKeys)),
-	//}
-	//for i, rk := range q.rKeys {
-	//for _, rk := range q.rKeys {
-	var val Value
-	for i := 0; i < len(q.rKeys); i++ {
+	// Scan Results
+	var r Result
+	rValue := &RetIntValue{
+		intVals: make([]int64, 0, len(q.rKeys)*(*ScanLen)),
+	}
+	parts := []int{0}
+	for _, rk := range q.rKeys {
+		lo, hi := ParseKey(rk), ParseKey(rk)+int64(*ScanLen-1)
 		if q.partitioner != nil {
-			partNum = q.partitioner.GetPartition(q.rKeys[i])
+			parts = scanParts(q.partitioner, lo, hi, parts)
 		}
-
-		v, err := tx.Read(q.rKeys[i], partNum, false)
-		if err != nil {
-			return nil, err
+		for _, partNum := range parts {
+			recs, err := tx.Scan(t, rk, CKey(hi), partNum)
+			if err != nil {
+				return nil, err
+			}
+			for _, rec := range recs {
+				rValue.intVals = append(rValue.intVals, rec.Tuple().GetInt64(0))
+			}
 		}
-
-		//rValue.intVals[i] = v.Value().(int64)
-		val = v.Value()
-		intVal := *(val.(*int64))
-		intVal++
 	}
 
+	r.V = rValue
+
 	if tx.Commit() == 0 {
 		return nil, EABORT
 	}
 
-	if val == nil {
-		return nil, nil
-	}
-
-	//return &r, nil
-	return nil, nil
+	return &r, nil
 }
 
-func UpdateIntTXN(q *Query, tx ETransaction) (*Result, error) {
+// Delete each write key which exists and insert the others, then
+// read the read keys which exist
+func InsertDeleteTXN(q *Query, tx ETransaction) (*Result, error) {
 	var partNum int
+	t := tx.Store().Table(RECORDS)
 	// Apply Writes
-	updateVals := q.wValue.(*SingleIntValue)
+	insertVals := q.wValue.(*SingleIntValue)
 	for i, wk := range q.wKeys {
 		if q.partitioner != nil {
 			partNum = q.partitioner.GetPartition(wk)
 		}
-		err := tx.WriteInt64(wk, updateVals.intVals[i], partNum)
+		_, err := tx.Read(t, wk, partNum, false)
+		if err == ENOKEY {
+			err = tx.Insert(t, wk, t.Schema.MakeTuple(insertVals.intVals[i]), partNum)
+		} else if err == nil {
+			err = tx.Delete(t, wk, partNum)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -156,17 +223,19 @@ func UpdateIntTXN(q *Query, tx ETransaction) (*Result, error) {
 	// Read Results
 	var r Result
 	rValue := &RetIntValue{
-		intVals: make([]int64, len(q.rKeys)),
+		intVals: make([]int64, 0, len(q.rKeys)),
 	}
-	for i, rk := range q.rKeys {
+	for _, rk := range q.rKeys {
 		if q.partitioner != nil {
 			partNum = q.partitioner.GetPartition(rk)
 		}
-		v, err := tx.Read(rk, partNum, false)
-		if err != nil {
+		v, err := tx.Read(t, rk, partNum, false)
+		if err == ENOKEY {
+			continue
+		} else if err != nil {
 			return nil, err
 		}
-		rValue.intVals[i] = v.Value().(int64)
+		rValue.intVals = append(rValue.intVals, v.Tuple().GetInt64(0))
 	}
 
 	r.V = rValue
@@ -176,55 +245,198 @@ func UpdateIntTXN(q *Query, tx ETransaction) (*Result, error) {
 	}
 
 	return &r, nil
-
 }
 
-func UpdateStringTXN(q *Query, tx ETransaction) (*Result, error) {
+// Look each read key up by the column secondary index 0 covers,
+// then change that column of the write keys
+func LookupStringTXN(q *Query, tx ETransaction) (*Result, error) {
 	var partNum int
+	t := tx.Store().Table(RECORDS)
+	si := t.SecIndex(0)
+
+	// Read Results
+	var r Result
+	rValue := &RetTupleValue{
+		tuples: make([]*Tuple, len(q.rKeys)),
+	}
+	found := true
+	for i, rk := range q.rKeys {
+		if q.partitioner != nil {
+			partNum = q.partitioner.GetPartition(rk)
+		}
+		v, err := tx.Read(t, rk, partNum, false)
+		if err != nil {
+			return nil, err
+		}
+		rValue.tuples[i] = v.Tuple().Copy()
+		keys, err := tx.LookupSec(si, rValue.tuples[i].GetString(si.Field), partNum)
+		if err != nil {
+			return nil, err
+		}
+		found = found && containsKey(keys, rk)
+	}
+
 	// Apply Writes
 	updateVals := q.wValue.(*StringListValue)
 	for i, wk := range q.wKeys {
 		if q.partitioner != nil {
 			partNum = q.partitioner.GetPartition(wk)
 		}
-		updateVals.strVals[i].value = Randstr(int(PERFIELD))
-		err := tx.WriteString(wk, updateVals.strVals[i], partNum)
+		err := tx.WriteColumn(t, wk, si.Field, updateVals.strVals[i].value, partNum)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// Read Results
-	var r Result
-	var ok bool
-	rValue := &RetStringValue{
-		strVals: make([][]string, len(q.rKeys)),
+	r.V = rValue
+
+	if tx.Commit() == 0 {
+		return nil, EABORT
 	}
-	for i, rk := range q.rKeys {
+
+	// Only a committed lookup is consistent with the record
+	if !found {
+		clog.Error("Secondary index misses a key")
+	}
+
+	return &r, nil
+}
+
+func containsKey(keys []Key, k Key) bool {
+	for _, x := range keys {
+		if x == k {
+			return true
+		}
+	}
+	return false
+}
+
+// The built-in transactions do their writes, then their reads, of
+// records loaded before the run, so neither piece rolls back but for
+// concurrency control. Where reads may touch any record, two instances
+// of one transaction conflict on both pieces and chopping is never
+// safe; with -rokeys the reads go to records nobody writes, and the
+// read piece chops off.
+func builtinDecls() []*TxnDecl {
+	reads := "records"
+	if *ROKeys > 0 {
+		reads = "rokeys"
+	}
+	return []*TxnDecl{
+		&TxnDecl{
+			TXN:  ADD_ONE,
+			Name: "AddOne",
+			Pieces: []PieceDecl{
+				{Name: "write", ReadSet: []string{"records"}, WriteSet: []string{"records"}},
+				{Name: "read", ReadSet: []string{reads}},
+			},
+			Piece: AddOnePiece,
+		},
+		&TxnDecl{
+			TXN:  RANDOM_UPDATE_INT,
+			Name: "UpdateInt",
+			Pieces: []PieceDecl{
+				{Name: "write", WriteSet: []string{"records"}},
+				{Name: "read", ReadSet: []string{reads}},
+			},
+			Piece: UpdateIntPiece,
+		},
+		&TxnDecl{
+			TXN:  RANDOM_UPDATE_STRING,
+			Name: "UpdateString",
+			Pieces: []PieceDecl{
+				{Name: "write", WriteSet: []string{"records"}},
+				{Name: "read", ReadSet: []string{reads}},
+			},
+			Piece: UpdateStringPiece,
+		},
+	}
+}
+
+func AddOnePiece(q *Query, tx ETransaction, piece int) error {
+	var partNum int
+	t := tx.Store().Table(RECORDS)
+	if piece == 0 {
+		for _, wk := range q.wKeys {
+			if q.partitioner != nil {
+				partNum = q.partitioner.GetPartition(wk)
+			}
+			v, err := tx.Read(t, wk, partNum, false)
+			if err != nil {
+				return err
+			}
+			err = tx.WriteColumn(t, wk, 0, v.Tuple().GetInt64(0)+1, partNum)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, rk := range q.rKeys {
 		if q.partitioner != nil {
 			partNum = q.partitioner.GetPartition(rk)
 		}
-		v, err := tx.Read(rk, partNum, false)
-		if err != nil {
-			return nil, err
+		if _, err := tx.Read(t, rk, partNum, false); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if rValue.strVals[i], ok = v.Value().([]string); !ok {
-			tmpVal := v.Value().(*StrAttr)
-			v, err = tx.Read(rk, partNum, true)
+func UpdateIntPiece(q *Query, tx ETransaction, piece int) error {
+	var partNum int
+	t := tx.Store().Table(RECORDS)
+	if piece == 0 {
+		updateVals := q.wValue.(*SingleIntValue)
+		for i, wk := range q.wKeys {
+			if q.partitioner != nil {
+				partNum = q.partitioner.GetPartition(wk)
+			}
+			err := tx.WriteColumn(t, wk, 0, updateVals.intVals[i], partNum)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			rValue.strVals[i] = v.Value().([]string)
-			rValue.strVals[i][tmpVal.index] = tmpVal.value
 		}
+		return nil
 	}
 
-	r.V = rValue
+	for _, rk := range q.rKeys {
+		if q.partitioner != nil {
+			partNum = q.partitioner.GetPartition(rk)
+		}
+		if _, err := tx.Read(t, rk, partNum, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if tx.Commit() == 0 {
-		return nil, EABORT
+func UpdateStringPiece(q *Query, tx ETransaction, piece int) error {
+	var partNum int
+	t := tx.Store().Table(RECORDS)
+	if piece == 0 {
+		updateVals := q.wValue.(*StringListValue)
+		for i, wk := range q.wKeys {
+			if q.partitioner != nil {
+				partNum = q.partitioner.GetPartition(wk)
+			}
+			sa := updateVals.strVals[i]
+			err := tx.WriteColumn(t, wk, sa.index, sa.value, partNum)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	return &r, nil
+	for _, rk := range q.rKeys {
+		if q.partitioner != nil {
+			partNum = q.partitioner.GetPartition(rk)
+		}
+		if _, err := tx.Read(t, rk, partNum, false); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -28,27 +28,28 @@ func TestTransactions(t *testing.T) {
 	}
 
 	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), p, "")
 	//Create Keys
 	for i := int64(0); i < nKeys; i++ {
-		k := Key(i)
+		k := CKey(i)
 		partNum := p.GetPartition(k)
-		store.CreateKV(k, int64(0), SINGLEINT, partNum)
+		table.CreateKV(k, table.Schema.MakeTuple(int64(0)), partNum)
 	}
 
 	pKeysArray = make([]int64, nParts)
 	for i := int64(0); i < nKeys; i++ {
-		key := Key(i)
+		key := CKey(i)
 		pKeysArray[p.GetPartition(key)]++
 	}
 
-	zk := NewZipfKey(3, nKeys, nParts, pKeysArray, s, p)
+	zk := NewZipfKey(3, nKeys, nParts, pKeysArray, s, p.(*HashPartitioner))
 
 	rr := float64(0)
 	txnLen := 5
 	*CrossPercent = float64(0)
 	maxParts := 5
 
-	generator := NewTxnGen(ADD_ONE, rr, txnLen, maxParts, zk)
+	generator := NewTxnGen(3, ADD_ONE, rr, txnLen, maxParts, zk)
 
 	//New worker
 	worker := NewWorker(3, store)
@@ -71,14 +72,426 @@ func TestTransactions(t *testing.T) {
 
 func PrintPartition(s *Store, nKeys int64, p Partitioner, partNum int) {
 	for i := int64(0); i < nKeys; i++ {
-		k := Key(i)
+		k := CKey(i)
 		if p.GetPartition(k) != partNum {
 			continue
 		}
-		r := s.GetRecord(k, partNum)
+		r := s.Table(RECORDS).GetRecord(k, partNum)
 		if r == nil {
 			clog.Error("Error No Key")
 		}
-		clog.Info("Key %v: %v", r.GetKey(), r.Value())
+		clog.Info("Key %v: %v", r.GetKey(), r.Tuple())
 	}
 }
+
+func TestInsertDelete(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Insert Delete Begin")
+	fmt.Println("=======================")
+
+	defer func() {
+		*SysType = PARTITION
+		*IndexType = ""
+	}()
+
+	for _, sys := range []int{PARTITION, OCC, LOCKING} {
+		*SysType = sys
+		*NumPart = 1
+		store := NewStore()
+		table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+		if _, ok := table.parts[0].index.(*HashIndex); ok != (sys == PARTITION) {
+			t.Errorf("Mode %v: default index is %T", sys, table.parts[0].index)
+		}
+		table.CreateKV(CKey(1), table.Schema.MakeTuple(int64(1)), 0)
+		if table.CreateKV(CKey(1), table.Schema.MakeTuple(int64(1)), 0) != nil || table.NKeys() != 1 {
+			t.Errorf("Mode %v: duplicate CreateKV counts %v keys", sys, table.NKeys())
+		}
+		w := NewWorker(0, store)
+		tx := w.E
+
+		tx.Reset(nil)
+		if err := tx.Insert(table, CKey(1), table.Schema.MakeTuple(int64(5)), 0); err != EDUPKEY {
+			t.Errorf("Mode %v: insert of existing key returns %v", sys, err)
+		}
+		tx.Abort()
+
+		tx.Reset(nil)
+		if err := tx.Insert(table, CKey(2), table.Schema.MakeTuple(int64(2)), 0); err != nil {
+			t.Errorf("Mode %v: insert returns %v", sys, err)
+		}
+		if err := tx.Delete(table, CKey(1), 0); err != nil {
+			t.Errorf("Mode %v: delete returns %v", sys, err)
+		}
+		if _, err := tx.Read(table, CKey(1), 0, false); err != ENOKEY {
+			t.Errorf("Mode %v: read of deleted key returns %v", sys, err)
+		}
+		if tx.Commit() == 0 {
+			t.Errorf("Mode %v: commit fails", sys)
+		}
+
+		tx.Reset(nil)
+		r, err := tx.Read(table, CKey(2), 0, false)
+		if err != nil || r.Tuple().GetInt64(0) != 2 {
+			t.Errorf("Mode %v: read of inserted key returns %v", sys, err)
+		}
+		if _, err := tx.Read(table, CKey(1), 0, false); err != ENOKEY {
+			t.Errorf("Mode %v: read of deleted key returns %v", sys, err)
+		}
+		// Re-inserting revives the tombstone
+		if err := tx.Insert(table, CKey(1), table.Schema.MakeTuple(int64(7)), 0); err != nil {
+			t.Errorf("Mode %v: reinsert returns %v", sys, err)
+		}
+		tx.Commit()
+		if r := table.GetRecord(CKey(1), 0); r.IsAbsent() || r.Tuple().GetInt64(0) != 7 {
+			t.Errorf("Mode %v: reinsert does not revive the record", sys)
+		}
+
+		// Aborted insert and delete leave no trace
+		if sys != PARTITION {
+			tx.Reset(nil)
+			tx.Insert(table, CKey(3), table.Schema.MakeTuple(int64(3)), 0)
+			tx.Delete(table, CKey(2), 0)
+			tx.Abort()
+			if r := table.GetRecord(CKey(3), 0); r == nil || !r.IsAbsent() {
+				t.Errorf("Mode %v: aborted insert is visible", sys)
+			}
+			if table.GetRecord(CKey(2), 0).IsAbsent() {
+				t.Errorf("Mode %v: aborted delete is visible", sys)
+			}
+		}
+	}
+
+	// An OCC insert into a range the transaction scanned itself
+	// is no phantom
+	*SysType = OCC
+	*IndexType = "btree"
+	store := NewStore()
+	table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, "")
+	for i := int64(0); i < 1000; i++ {
+		table.CreateKV(CKey(i*2), table.Schema.MakeTuple(int64(i)), 0)
+	}
+	w := NewWorker(0, store)
+	tx := w.E
+	tx.Reset(nil)
+	tx.Scan(table, CKey(10), CKey(20), 0)
+	if err := tx.Insert(table, CKey(15), table.Schema.MakeTuple(int64(0)), 0); err != nil {
+		t.Errorf("Insert returns %v", err)
+	}
+	if tx.Commit() == 0 {
+		t.Errorf("Commit fails on own insert")
+	}
+	tx.Reset(nil)
+	recs, _ := tx.Scan(table, CKey(10), CKey(20), 0)
+	if len(recs) != 7 {
+		t.Errorf("Scan returns %v records after insert; expected 7", len(recs))
+	}
+	tx.Commit()
+
+	fmt.Println("=====================")
+	fmt.Println("Test Insert Delete End")
+	fmt.Println("=====================")
+}
+
+func TestSecIndex(t *testing.T) {
+	fmt.Println("=====================")
+	fmt.Println("Test SecIndex Begin")
+	fmt.Println("=====================")
+
+	defer func() {
+		*SysType = PARTITION
+		*IndexType = ""
+	}()
+
+	sch := NewSchema(Column{Name: "c0", Type: STRING}, Column{Name: "c1", Type: STRING},
+		Column{Name: "c2", Type: STRING})
+	lookup := func(tx ETransaction, si *SecIndex, val string) []Key {
+		tx.Reset(nil)
+		keys, err := tx.LookupSec(si, val, 0)
+		if err != nil {
+			t.Fatalf("Lookup of %v returns %v", val, err)
+		}
+		tx.Commit()
+		return keys
+	}
+
+	for _, sys := range []int{PARTITION, OCC, LOCKING} {
+		*SysType = sys
+		*NumPart = 1
+		store := NewStore()
+		table := store.CreateTable(RECORDS, sch, nil, "")
+		si := table.CreateSecIndex(1)
+		for i := 0; i < 3; i++ {
+			table.CreateKV(CKey(int64(i)), sch.MakeTuple("x", "a", "y"), 0)
+		}
+		w := NewWorker(0, store)
+		tx := w.E
+
+		if keys := lookup(tx, si, "a"); len(keys) != 3 {
+			t.Errorf("Mode %v: lookup after load returns %v", sys, keys)
+		}
+
+		tx.Reset(nil)
+		tx.WriteColumn(table, CKey(0), 1, "b", 0)
+		tx.Delete(table, CKey(1), 0)
+		tx.Insert(table, CKey(5), sch.MakeTuple("x", "b", "y"), 0)
+		// Writes of other columns leave the index alone
+		tx.WriteColumn(table, CKey(2), 0, "b", 0)
+		if keys, _ := tx.LookupSec(si, "b", 0); len(keys) != 2 {
+			t.Errorf("Mode %v: lookup of own writes returns %v", sys, keys)
+		}
+		if tx.Commit() == 0 {
+			t.Errorf("Mode %v: commit fails", sys)
+		}
+
+		if keys := lookup(tx, si, "a"); len(keys) != 1 || keys[0] != CKey(2) {
+			t.Errorf("Mode %v: lookup of a returns %v", sys, keys)
+		}
+		if keys := lookup(tx, si, "b"); len(keys) != 2 || !containsKey(keys, CKey(0)) || !containsKey(keys, CKey(5)) {
+			t.Errorf("Mode %v: lookup of b returns %v", sys, keys)
+		}
+
+		if sys != PARTITION {
+			tx.Reset(nil)
+			tx.WriteColumn(table, CKey(2), 1, "c", 0)
+			tx.Delete(table, CKey(0), 0)
+			tx.Abort()
+			if keys := lookup(tx, si, "a"); len(keys) != 1 {
+				t.Errorf("Mode %v: aborted update changes the index: %v", sys, keys)
+			}
+			if keys := lookup(tx, si, "b"); len(keys) != 2 {
+				t.Errorf("Mode %v: aborted delete changes the index: %v", sys, keys)
+			}
+		}
+	}
+
+	// A lookup is invalidated by a concurrent change of its entry
+	*SysType = OCC
+	store := NewStore()
+	table := store.CreateTable(RECORDS, sch, nil, "")
+	si := table.CreateSecIndex(1)
+	table.CreateKV(CKey(0), sch.MakeTuple("x", "a", "y"), 0)
+	tx1 := NewWorker(0, store).E
+	tx2 := NewWorker(1, store).E
+	tx1.Reset(nil)
+	tx1.LookupSec(si, "b", 0)
+	tx2.Reset(nil)
+	tx2.WriteColumn(table, CKey(0), 1, "b", 0)
+	if tx2.Commit() == 0 {
+		t.Errorf("Commit of update fails")
+	}
+	if tx1.Commit() != 0 {
+		t.Errorf("Commit succeeds after the looked up entry changed")
+	}
+
+	fmt.Println("===================")
+	fmt.Println("Test SecIndex End")
+	fmt.Println("===================")
+}
+
+func TestTables(t *testing.T) {
+	fmt.Println("===================")
+	fmt.Println("Test Tables Begin")
+	fmt.Println("===================")
+
+	defer func() {
+		*SysType = PARTITION
+	}()
+
+	for _, sys := range []int{PARTITION, OCC, LOCKING} {
+		*SysType = sys
+		*NumPart = 1
+		store := NewStore()
+		ints := store.CreateTable("ints", SchemaOf(SINGLEINT), nil, "")
+		sch := NewSchema(Column{Name: "a", Type: STRING}, Column{Name: "b", Type: STRING})
+		strs := store.CreateTable("strs", sch, nil, "btree")
+		if store.Table("ints") != ints || store.Table("none") != nil {
+			t.Errorf("Mode %v: table lookup by name fails", sys)
+		}
+		ints.CreateKV(CKey(1), ints.Schema.MakeTuple(int64(1)), 0)
+		strs.CreateKV(CKey(1), sch.MakeTuple("a", "b"), 0)
+
+		// One key in two tables stands for two records
+		tx := NewWorker(0, store).E
+		tx.Reset(nil)
+		if err := tx.WriteColumn(ints, CKey(1), 0, int64(2), 0); err != nil {
+			t.Errorf("Mode %v: write returns %v", sys, err)
+		}
+		r, err := tx.Read(strs, CKey(1), 0, false)
+		if err != nil {
+			t.Fatalf("Mode %v: read returns %v", sys, err)
+		}
+		if v := r.Tuple().GetString(0); v != "a" {
+			t.Errorf("Mode %v: read of strs returns %v", sys, r.Tuple())
+		}
+		if err := tx.Insert(strs, CKey(2), sch.MakeTuple("c", "d"), 0); err != nil {
+			t.Errorf("Mode %v: insert returns %v", sys, err)
+		}
+		if tx.Commit() == 0 {
+			t.Errorf("Mode %v: commit fails", sys)
+		}
+
+		if v := ints.GetRecord(CKey(1), 0).Tuple().GetInt64(0); v != 2 {
+			t.Errorf("Mode %v: ints holds %v", sys, v)
+		}
+		if ints.GetRecord(CKey(2), 0) != nil || len(strs.Scan(CKey(0), CKey(10), 0)) != 2 {
+			t.Errorf("Mode %v: insert goes to the wrong table", sys)
+		}
+	}
+
+	fmt.Println("=================")
+	fmt.Println("Test Tables End")
+	fmt.Println("=================")
+}
+
+func TestColumns(t *testing.T) {
+	fmt.Println("===================")
+	fmt.Println("Test Columns Begin")
+	fmt.Println("===================")
+
+	defer func() {
+		*SysType = PARTITION
+	}()
+
+	sch := NewSchema(Column{Name: "qty", Type: INT64}, Column{Name: "price", Type: FLOAT64},
+		Column{Name: "name", Type: STRING, Size: 16}, Column{Name: "data", Type: BYTES})
+
+	for _, sys := range []int{PARTITION, OCC, LOCKING} {
+		*SysType = sys
+		*NumPart = 1
+		store := NewStore()
+		table := store.CreateTable(RECORDS, sch, nil, "")
+		table.CreateKV(CKey(1), sch.MakeTuple(int64(1), 1.5, "one", []byte("a")), 0)
+		tx := NewWorker(0, store).E
+
+		// A transaction sees the columns it wrote and keeps the rest
+		tx.Reset(nil)
+		tx.WriteColumn(table, CKey(1), 1, 2.5, 0)
+		tx.WriteColumn(table, CKey(1), 2, "two", 0)
+		tx.WriteColumn(table, CKey(1), 2, "three", 0)
+		r, err := tx.Read(table, CKey(1), 0, false)
+		if err != nil {
+			t.Fatalf("Mode %v: read returns %v", sys, err)
+		}
+		if tup := r.Tuple(); tup.GetInt64(0) != 1 || tup.GetFloat64(1) != 2.5 || tup.GetString(2) != "three" {
+			t.Errorf("Mode %v: read of own writes returns %v", sys, tup)
+		}
+		if tx.Commit() == 0 {
+			t.Errorf("Mode %v: commit fails", sys)
+		}
+		tup := table.GetRecord(CKey(1), 0).Tuple()
+		if tup.GetInt64(0) != 1 || tup.GetFloat64(1) != 2.5 || tup.GetString(2) != "three" || string(tup.GetBytes(3)) != "a" {
+			t.Errorf("Mode %v: record holds %v", sys, tup)
+		}
+
+		if sys != PARTITION {
+			tx.Reset(nil)
+			tx.WriteColumn(table, CKey(1), 0, int64(7), 0)
+			tx.WriteColumn(table, CKey(1), 3, []byte("b"), 0)
+			tx.Abort()
+			if tup.GetInt64(0) != 1 || string(tup.GetBytes(3)) != "a" {
+				t.Errorf("Mode %v: aborted writes leave %v", sys, tup)
+			}
+		}
+	}
+
+	fmt.Println("=================")
+	fmt.Println("Test Columns End")
+	fmt.Println("=================")
+}
+
+func TestReclaim(t *testing.T) {
+	fmt.Println("=======================")
+	fmt.Println("Test Reclaim Begin")
+	fmt.Println("=======================")
+
+	defer func() {
+		*SysType = PARTITION
+	}()
+
+	keys := make([]Key, 10)
+	vals := make([]int64, len(keys))
+	for i := range keys {
+		keys[i] = CKey(int64(i))
+		vals[i] = int64(i)
+	}
+	insdel := &Query{
+		TXN:         INSERT_DELETE_INT,
+		accessParts: []int{0},
+		wKeys:       keys,
+		wValue:      &SingleIntValue{intVals: vals},
+	}
+	empty := &Query{
+		TXN:         INSERT_DELETE_INT,
+		accessParts: []int{0},
+		wValue:      &SingleIntValue{},
+	}
+
+	for _, sys := range []int{PARTITION, OCC, LOCKING} {
+		for _, index := range []string{"hash", "lfhash", "btree"} {
+			// The hash index takes no inserts or deletes in OCC and 2PL
+			if index == "hash" && sys != PARTITION {
+				continue
+			}
+			*SysType = sys
+			*NumPart = 1
+			store := NewStore()
+			table := store.CreateTable(RECORDS, SchemaOf(SINGLEINT), nil, index)
+			for i, k := range keys {
+				table.CreateKV(k, table.Schema.MakeTuple(vals[i]), 0)
+			}
+			w := NewWorker(0, store)
+
+			// Deletes all keys
+			if _, err := w.One(insdel); err != nil {
+				t.Errorf("Mode %v %v: delete returns %v", sys, index, err)
+			}
+			if table.GetRecord(keys[0], 0) == nil {
+				t.Errorf("Mode %v %v: tombstone unlinked within its epoch", sys, index)
+			}
+			for i := 0; i < 2; i++ {
+				w.One(empty)
+			}
+			for _, k := range keys {
+				if table.GetRecord(k, 0) != nil {
+					t.Errorf("Mode %v %v: tombstone of %v not unlinked", sys, index, k)
+				}
+			}
+			if w.ebr.NRetired != 10 || w.ebr.NReclaimed != 10 {
+				t.Errorf("Mode %v %v: retired %v, reclaimed %v; expected 10", sys, index, w.ebr.NRetired, w.ebr.NReclaimed)
+			}
+
+			// Inserts them again into fresh records
+			if _, err := w.One(insdel); err != nil {
+				t.Errorf("Mode %v %v: insert returns %v", sys, index, err)
+			}
+			for i, k := range keys {
+				r := table.GetRecord(k, 0)
+				if r == nil || r.IsAbsent() || r.Tuple().GetInt64(0) != vals[i] {
+					t.Errorf("Mode %v %v: key %v not inserted again", sys, index, k)
+				}
+			}
+
+			// The record an aborted insert added is reclaimed too
+			if sys != PARTITION {
+				k := CKey(int64(len(keys)))
+				w.ebr.Enter()
+				w.E.Reset(nil)
+				if err := w.E.Insert(table, k, table.Schema.MakeTuple(int64(0)), 0); err != nil {
+					t.Errorf("Mode %v %v: insert returns %v", sys, index, err)
+				}
+				w.E.Abort()
+				w.ebr.Exit()
+				for i := 0; i < 2; i++ {
+					w.One(empty)
+				}
+				if table.GetRecord(k, 0) != nil {
+					t.Errorf("Mode %v %v: record of aborted insert not unlinked", sys, index)
+				}
+			}
+		}
+	}
+
+	fmt.Println("=======================")
+	fmt.Println("Test Reclaim End")
+	fmt.Println("=======================")
+}
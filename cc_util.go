@@ -56,20 +56,31 @@ func printOneQuery(q *Query) {
 
 func PrintStore(s *Store, nKeys int64, p Partitioner) {
 	for i := int64(0); i < nKeys; i++ {
-		k := Key(i)
+		k := CKey(i)
 		partNum := p.GetPartition(k)
-		r := s.GetRecord(k, partNum)
+		r := s.Table(RECORDS).GetRecord(k, partNum)
 		if r == nil {
 			clog.Error("Error No Key")
 		}
-		clog.Info("Key %v: %v", k, r.Value())
+		clog.Info("Key %v: %v", k, r.Tuple())
 	}
 }
 
-func GenStringList() []string {
-	ret := make([]string, FIELDS)
-	for i := 0; i < FIELDS; i++ {
-		ret[i] = Randstr(PERFIELD)
+// GenTuple returns a tuple of s with zero numbers and random
+// strings and bytes of the column size, or PERFIELD without one
+func GenTuple(s *Schema) *Tuple {
+	tup := s.NewTuple()
+	for i, c := range s.Columns {
+		n := c.Size
+		if n == 0 {
+			n = PERFIELD
+		}
+		switch c.Type {
+		case STRING:
+			tup.SetString(i, Randstr(n))
+		case BYTES:
+			tup.SetBytes(i, []byte(Randstr(n)))
+		}
 	}
-	return ret
+	return tup
 }
@@ -1,12 +1,17 @@
 package testbed
 
 import (
+	"flag"
 	"runtime/debug"
 	"time"
 
 	"github.com/totemtang/cc-testbed/clog"
+	"github.com/totemtang/cc-testbed/epoch"
 )
 
+// Timing every transaction costs, so it is off unless asked for
+var WaitStats = flag.Bool("waitstats", false, "Time waits for partition locks in partition mode")
+
 const (
 	NABORTS = iota
 	NREADABORTS
@@ -18,6 +23,17 @@ const (
 	NCROSSTXN
 	NREADKEYS
 	NWRITEKEYS
+	NDEPTXN
+	NDEPCHAIN
+	NPIECES
+	NPIECEABORTS
+	NPHANTOMABORTS
+	NDUPKEY
+	NRETIRED
+	NRECLAIMED
+	NEVICTRESTARTS
+	NPULLS
+	NREROUTES
 	LAST_STAT
 )
 
@@ -31,12 +47,21 @@ type Worker struct {
 	store        *Store
 	E            ETransaction
 	txns         []TransactionFunc
+	decls        []*TxnDecl
+	chops        []*Chopping
 	NStats       []int64
+	NPartTxn     []int64 // Transactions committed on each partition
 	NGen         time.Duration
 	NExecute     time.Duration
 	NWait        time.Duration
 	NCrossWait   time.Duration
 	NLockAcquire int64
+	NFlush       time.Duration
+	NDepWait     time.Duration
+	MaxDepChain  int64
+	log          *CommitLog
+	logs         []*CommitLog
+	ebr          *epoch.Participant
 	padding2     [64]byte
 }
 
@@ -44,25 +69,66 @@ func (w *Worker) Register(fn int, transaction TransactionFunc) {
 	w.txns[fn] = transaction
 }
 
+// Declare describes the pieces of a registered transaction.
+// With -chop it runs as the finest safe chopping of its pieces.
+func (w *Worker) Declare(decl *TxnDecl) {
+	w.decls[decl.TXN] = decl
+	w.chops = nil
+}
+
+func (w *Worker) Decls() []*TxnDecl {
+	decls := make([]*TxnDecl, 0, LAST_TXN)
+	for _, d := range w.decls {
+		if d != nil {
+			decls = append(decls, d)
+		}
+	}
+	return decls
+}
+
+func (w *Worker) chopping(txn int) *Chopping {
+	if w.chops == nil {
+		decls := w.Decls()
+		finest := FinestChopping(decls)
+		w.chops = make([]*Chopping, LAST_TXN)
+		for i, d := range decls {
+			w.chops[d.TXN] = finest[i]
+		}
+	}
+	return w.chops[txn]
+}
+
 func NewWorker(id int, s *Store) *Worker {
 	w := &Worker{
-		ID:     id,
-		store:  s,
-		txns:   make([]TransactionFunc, LAST_TXN),
-		NStats: make([]int64, LAST_STAT),
+		ID:       id,
+		store:    s,
+		txns:     make([]TransactionFunc, LAST_TXN),
+		decls:    make([]*TxnDecl, LAST_TXN),
+		NStats:   make([]int64, LAST_STAT),
+		NPartTxn: make([]int64, len(s.locks)),
+		ebr:      s.epochs.Register(),
 	}
 
 	if *SysType == PARTITION {
 		w.E = StartPTransaction(w)
 	} else if *SysType == OCC {
 		w.E = StartOTransaction(w)
+	} else if *SysType == LOCKING {
+		w.E = StartLTransaction(w)
 	} else {
-		clog.Error("OCC and 2PL not supported yet")
+		clog.Error("System Type %v Not Supported Yet", *SysType)
 	}
 
 	w.Register(ADD_ONE, AddOneTXN)
 	w.Register(RANDOM_UPDATE_INT, UpdateIntTXN)
 	w.Register(RANDOM_UPDATE_STRING, UpdateStringTXN)
+	w.Register(SCAN_INT, ScanIntTXN)
+	w.Register(INSERT_DELETE_INT, InsertDeleteTXN)
+	w.Register(LOOKUP_STRING, LookupStringTXN)
+
+	for _, d := range builtinDecls() {
+		w.Declare(d)
+	}
 
 	return w
 }
@@ -80,7 +146,16 @@ func (w *Worker) doTxn(q *Query) (*Result, error) {
 
 	w.E.Reset(q)
 
-	x, err := w.txns[q.TXN](q, w.E)
+	var x *Result
+	var err error
+	if *ChopTxn && w.decls[q.TXN] != nil && w.chopping(q.TXN).NGroups() > 1 {
+		err = w.doPieces(q)
+	} else {
+		x, err = w.txns[q.TXN](q, w.E)
+		if err != nil {
+			w.E.Abort()
+		}
+	}
 
 	if err == EABORT {
 		w.NStats[NABORTS]++
@@ -88,6 +163,17 @@ func (w *Worker) doTxn(q *Query) (*Result, error) {
 	} else if err == ENOKEY {
 		w.NStats[NENOKEY]++
 		return nil, err
+	} else if err == EDUPKEY {
+		w.NStats[NDUPKEY]++
+		return nil, err
+	} else if err == EEVICTED {
+		// Counted once, when it runs again
+		w.NStats[NTXN]--
+		if len(q.accessParts) > 1 {
+			w.NStats[NCROSSTXN]--
+		}
+		w.NStats[NEVICTRESTARTS]++
+		return nil, err
 	}
 
 	w.NStats[NREADKEYS] += int64(len(q.rKeys))
@@ -97,39 +183,180 @@ func (w *Worker) doTxn(q *Query) (*Result, error) {
 	//return nil, nil
 }
 
-func (w *Worker) One(q *Query) (*Result, error) {
-	if *SysType == PARTITION {
-		s := w.store
-		w.NLockAcquire += int64(len(q.accessParts))
-		//tm := time.Now()
-		// Acquire all locks
+// Run each group of pieces as a transaction of its own. Only the
+// first group may give up; later ones are retried until they commit.
+func (w *Worker) doPieces(q *Query) error {
+	d := w.decls[q.TXN]
+	c := w.chopping(q.TXN)
+	for i := 0; i < c.NGroups(); i++ {
+		lo, hi := c.Group(i)
+		for {
+			err := runPieces(d, q, w.E, lo, hi)
+			if err == nil {
+				w.NStats[NPIECES]++
+				break
+			}
+			if i == 0 {
+				return err
+			}
+			if err != EABORT {
+				// Group 0 has committed; only pieces declared
+				// MayAbort, which stay in it, may give up
+				clog.Error("Piece %v of %s Fails with %v after Its First Group Committed", lo, d.Name, err)
+			}
+			w.NStats[NPIECEABORTS]++
+			w.E.Reset(q)
+		}
+		w.E.Reset(q)
+	}
+	return nil
+}
 
-		for _, p := range q.accessParts {
-			//s.store[p].Lock()
-			s.locks[p].Lock()
-			//s.locks[p].custLock.Lock()
+func runPieces(d *TxnDecl, q *Query, tx ETransaction, lo int, hi int) error {
+	for p := lo; p < hi; p++ {
+		if err := d.Piece(q, tx, p); err != nil {
+			tx.Abort()
+			return err
 		}
+	}
+	if tx.Commit() == 0 {
+		return EABORT
+	}
+	return nil
+}
 
-		//w.NWait += time.Since(tm)
-		//if len(q.accessParts) > 1 {
-		//	w.NCrossWait += time.Since(tm)
-		//}
+// A transaction runs inside an epoch; tombstones it retired are
+// unlinked in a later One, after it has released its partitions.
+// In partition mode, one which touched evicted records restarts
+// once they are fetched without the partition locks, and one routed
+// before a migration changed the mapping is routed again.
+func (w *Worker) One(q *Query) (*Result, error) {
+	w.ebr.Enter()
+	if w.log != nil {
+		w.log.enter()
 	}
+	var r *Result
+	var err error
+	for {
+		if *SysType == PARTITION {
+			s := w.store
+			w.NLockAcquire += int64(len(q.accessParts))
+			var tm time.Time
+			if *WaitStats {
+				tm = time.Now()
+			}
+			// Acquire all locks
 
-	r, err := w.doTxn(q)
+			for _, p := range q.accessParts {
+				//s.store[p].Lock()
+				s.locks[p].Lock()
+				//s.locks[p].custLock.Lock()
+			}
+			if q.partitioner != nil && q.version != mappingVersion(q.partitioner) {
+				// A migration changed the mapping since q was routed
+				for _, p := range q.accessParts {
+					s.locks[p].Unlock()
+				}
+				q.route(-1)
+				w.NStats[NREROUTES]++
+				continue
+			}
+			s.mergeFetched(q.accessParts)
 
-	if *SysType == PARTITION {
-		s := w.store
+			if *WaitStats {
+				// Time spent on partitions others hold, e.g. hot ones
+				wait := time.Since(tm)
+				w.NWait += wait
+				if len(q.accessParts) > 1 {
+					w.NCrossWait += wait
+				}
+			}
+		}
+
+		r, err = w.doTxn(q)
+
+		if *SysType == PARTITION {
+			s := w.store
+			if err != EEVICTED {
+				s.evictCold(q.accessParts)
+			}
+			for _, p := range q.accessParts {
+				//s.store[p].Unlock()
+				s.locks[p].Unlock()
+				//s.locks[p].custLock.Unlock()
+			}
+		}
+		if err != EEVICTED {
+			break
+		}
+		w.E.(*PTransaction).fetchEvicted()
+	}
+	if err == nil {
 		for _, p := range q.accessParts {
-			//s.store[p].Unlock()
-			s.locks[p].Unlock()
-			//s.locks[p].custLock.Unlock()
+			w.NPartTxn[p]++
 		}
 	}
+	if w.log != nil {
+		w.log.exit()
+	}
+	w.ebr.Exit()
+	w.ebr.Reclaim()
 
 	return r, err
 }
 
+// Retire the tombstone r left by a delete of k committed at tid
+func (w *Worker) retire(t *Table, k Key, partNum int, r Record, tid TID) {
+	w.ebr.Retire(func() bool {
+		return w.unlink(t, k, partNum, r, tid)
+	})
+}
+
+// Remove the tombstone r from the index unless k was inserted again
+// since. It returns false if r is busy, to be tried again later.
+// In OCC and 2PL r stays locked, so that transactions which found r
+// before it was removed abort.
+func (w *Worker) unlink(t *Table, k Key, partNum int, r Record, tid TID) bool {
+	part := t.parts[partNum]
+	index := part.index
+	if index.Get(k) != r {
+		return true
+	}
+	switch *SysType {
+	case PARTITION:
+		lock := w.store.locks[partNum]
+		lock.Lock()
+		if r.IsAbsent() {
+			index.Remove(k, r)
+			part.noteReclaimed(r.GetTID())
+		}
+		lock.Unlock()
+	case OCC:
+		ok, former := r.Lock()
+		if !ok {
+			return false
+		}
+		if !r.IsAbsent() || former != tid {
+			r.Unlock(former)
+			return true
+		}
+		index.Remove(k, r)
+		part.noteReclaimed(tid)
+	case LOCKING:
+		lr := r.(*LRecord)
+		if !lr.WLock() {
+			return false
+		}
+		if !lr.absent || lr.last != tid {
+			lr.WUnlock()
+			return true
+		}
+		index.Remove(k, r)
+		part.noteReclaimed(tid)
+	}
+	return true
+}
+
 func (w *Worker) Store() *Store {
 	return w.store
 }
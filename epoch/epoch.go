@@ -0,0 +1,137 @@
+// Package epoch implements epoch-based reclamation. Participants
+// announce the global epoch while they may hold references to shared
+// objects, and quiesce in between. An object retired in epoch e is
+// freed once the global epoch reaches e+2: the epoch only advances
+// when every active participant has announced the current one, so by
+// then nobody active in epoch e or before is left.
+package epoch
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Manager holds the global epoch and its participants
+type Manager struct {
+	padding1 [64]byte
+	global   uint64
+	mu       sync.Mutex   // serializes Register
+	parts    atomic.Value // []*Participant
+	padding2 [64]byte
+}
+
+func NewManager() *Manager {
+	m := &Manager{
+		global: 1,
+	}
+	m.parts.Store([]*Participant(nil))
+	return m
+}
+
+func (m *Manager) Epoch() uint64 {
+	return atomic.LoadUint64(&m.global)
+}
+
+// Register adds a participant, quiescent until it calls Enter
+func (m *Manager) Register() *Participant {
+	p := &Participant{
+		m: m,
+	}
+	m.mu.Lock()
+	old := m.parts.Load().([]*Participant)
+	parts := make([]*Participant, len(old), len(old)+1)
+	copy(parts, old)
+	m.parts.Store(append(parts, p))
+	m.mu.Unlock()
+	return p
+}
+
+// Advance moves the global epoch on by one if every active
+// participant has announced it; it returns false otherwise
+func (m *Manager) Advance() bool {
+	g := atomic.LoadUint64(&m.global)
+	for _, p := range m.parts.Load().([]*Participant) {
+		if l := atomic.LoadUint64(&p.local); l != 0 && l != g {
+			return false
+		}
+	}
+	return atomic.CompareAndSwapUint64(&m.global, g, g+1)
+}
+
+// A participant is used by one goroutine only. Its counters are
+// meant to be read once that goroutine is done.
+type Participant struct {
+	padding1   [64]byte
+	m          *Manager
+	local      uint64 // Announced epoch; 0 when quiescent
+	limbo      []retired
+	NRetired   int64
+	NReclaimed int64
+	NLag       time.Duration // Sum of the times reclaimed objects spent retired
+	padding2   [64]byte
+}
+
+type retired struct {
+	epoch uint64
+	at    time.Time
+	free  func() bool
+}
+
+// Enter announces the current epoch; shared objects may be
+// referenced until Exit
+func (p *Participant) Enter() {
+	atomic.StoreUint64(&p.local, atomic.LoadUint64(&p.m.global))
+}
+
+func (p *Participant) Exit() {
+	atomic.StoreUint64(&p.local, 0)
+}
+
+// Retire hands over an object no longer reachable by new references.
+// free runs in a later Reclaim; if it returns false, it is run
+// again in the next one.
+func (p *Participant) Retire(free func() bool) {
+	p.limbo = append(p.limbo, retired{
+		epoch: atomic.LoadUint64(&p.m.global),
+		at:    time.Now(),
+		free:  free,
+	})
+	p.NRetired++
+}
+
+// Reclaim tries to advance the epoch and frees the retired objects
+// no participant can still reference. It must be called quiescent.
+func (p *Participant) Reclaim() {
+	if len(p.limbo) == 0 {
+		return
+	}
+	p.m.Advance()
+	g := atomic.LoadUint64(&p.m.global)
+	if p.limbo[0].epoch+2 > g {
+		return
+	}
+	var now time.Time
+	n := 0
+	for _, r := range p.limbo {
+		if r.epoch+2 <= g && r.free() {
+			if now.IsZero() {
+				now = time.Now()
+			}
+			p.NReclaimed++
+			p.NLag += now.Sub(r.at)
+			continue
+		}
+		p.limbo[n] = r
+		n++
+	}
+	for i := n; i < len(p.limbo); i++ {
+		p.limbo[i] = retired{}
+	}
+	p.limbo = p.limbo[:n]
+}
+
+// Pending returns the number of objects retired but not freed
+func (p *Participant) Pending() int {
+	return len(p.limbo)
+}
@@ -0,0 +1,94 @@
+package epoch
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEpoch(t *testing.T) {
+	m := NewManager()
+	p := m.Register()
+	q := m.Register()
+
+	freed := 0
+	p.Retire(func() bool {
+		freed++
+		return true
+	})
+
+	// q stays in the epoch p retired in
+	q.Enter()
+	for i := 0; i < 4; i++ {
+		p.Reclaim()
+	}
+	if freed != 0 || p.Pending() != 1 {
+		t.Errorf("Freed %v while a participant may still reference it", freed)
+	}
+	q.Exit()
+
+	p.Reclaim()
+	p.Reclaim()
+	if freed != 1 || p.NReclaimed != 1 || p.Pending() != 0 {
+		t.Errorf("Freed %v, reclaimed %v; expected 1", freed, p.NReclaimed)
+	}
+
+	// A free which fails is retried later
+	tries := 0
+	p.Retire(func() bool {
+		tries++
+		return tries > 1
+	})
+	for i := 0; i < 4; i++ {
+		p.Reclaim()
+	}
+	if tries != 2 || p.NRetired != 2 || p.NReclaimed != 2 {
+		t.Errorf("Tried %v times, retired %v, reclaimed %v", tries, p.NRetired, p.NReclaimed)
+	}
+
+	fmt.Printf("Passed TestEpoch\n")
+}
+
+// An object is never freed while a participant which saw it
+// before it was retired is still inside
+func TestEpochConcurrent(t *testing.T) {
+	m := NewManager()
+	var shared int64 = 1
+	var live [1 << 12]int32
+	live[1] = 1
+
+	var wg sync.WaitGroup
+	var bad int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(writer bool) {
+			defer wg.Done()
+			p := m.Register()
+			for j := 0; j < 10000; j++ {
+				p.Enter()
+				obj := atomic.LoadInt64(&shared)
+				if writer && obj+1 < int64(len(live)) {
+					atomic.StoreInt32(&live[obj+1], 1)
+					if atomic.CompareAndSwapInt64(&shared, obj, obj+1) {
+						p.Retire(func() bool {
+							atomic.StoreInt32(&live[obj], 0)
+							return true
+						})
+					}
+				}
+				if atomic.LoadInt32(&live[obj]) == 0 {
+					atomic.StoreInt32(&bad, 1)
+				}
+				p.Exit()
+				p.Reclaim()
+			}
+		}(i == 0)
+	}
+	wg.Wait()
+	if bad != 0 {
+		t.Errorf("An object was freed while referenced")
+	}
+
+	fmt.Printf("Passed TestEpochConcurrent\n")
+}
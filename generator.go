@@ -25,6 +25,9 @@ type TxnGen struct {
 	zk          *ZipfKey
 	q           *Query
 	numAccess   int
+	replicated  *Table
+	bases       []int
+	skew        *rand.Zipf // Of the home partition of each query; see SetSkew
 	padding2    [64]byte
 }
 
@@ -88,6 +91,7 @@ func (tg *TxnGen) GenOneQuery() *Query {
 	q.wKeys = q.wKeys[:0]
 
 	// Generate keys for different CC
+	home := tg.home()
 	if tg.isPartition {
 		//x := float64(RandN(&tg.local_seed, 100))
 		x := float64(tg.rnd.Int63n(100))
@@ -101,13 +105,13 @@ func (tg *TxnGen) GenOneQuery() *Query {
 
 			// Generate partitions this txn will touch
 			var remotePart int
-			remotePart = (tg.partIndex + tg.rnd.Intn(tg.nParts-1) + 1) % tg.nParts
-			if remotePart > tg.partIndex {
-				q.accessParts[0] = tg.partIndex
+			remotePart = (home + tg.rnd.Intn(tg.nParts-1) + 1) % tg.nParts
+			if remotePart > home {
+				q.accessParts[0] = home
 				q.accessParts[1] = remotePart
 			} else {
 				q.accessParts[0] = remotePart
-				q.accessParts[1] = tg.partIndex
+				q.accessParts[1] = home
 			}
 
 			/*
@@ -148,10 +152,10 @@ func (tg *TxnGen) GenOneQuery() *Query {
 		} else {
 			//q.accessParts = make([]int, 1)
 			q.accessParts = q.accessParts[:1]
-			q.accessParts[0] = tg.partIndex
+			q.accessParts[0] = home
 
 			for i := 0; i < tg.txnLen; i++ {
-				insertRWKey(q, tg.zk.GetSelfKey(), tg.rr, tg.rnd)
+				insertRWKey(q, tg.selfKey(home), tg.rr, tg.rnd)
 			}
 		}
 
@@ -162,6 +166,17 @@ func (tg *TxnGen) GenOneQuery() *Query {
 		}
 	}
 
+	// Reads go to keys nobody writes, if there are any
+	if tg.zk.roKeys > 0 {
+		for i, k := range q.rKeys {
+			q.rKeys[i] = tg.zk.GetReadKey(k)
+		}
+	}
+
+	if tg.isPartition && q.partitioner != nil && (tg.replicated != nil || mappingVersion(q.partitioner) > 0 || q.TXN == SCAN_INT) {
+		q.route(home)
+	}
+
 	// Generate values according to the transaction type
 	q.GenValue(tg.rnd)
 
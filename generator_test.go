@@ -25,7 +25,7 @@ func TestGenerator(t *testing.T) {
 	rr := float64(50)
 	txnLen := 16
 
-	generator := NewTxnGen(RANDOM_UPDATE_INT, rr, txnLen, -1, zk)
+	generator := NewTxnGen(0, RANDOM_UPDATE_INT, rr, txnLen, -1, zk)
 
 	// Generator 3 queries
 	for i := 0; i < 3; i++ {
@@ -46,12 +46,12 @@ func TestGenerator(t *testing.T) {
 
 	pKeysArray = make([]int64, nParts)
 	for i := int64(0); i < nKeys; i++ {
-		key := Key(i)
+		key := CKey(i)
 		pKeysArray[p.GetPartition(key)]++
 	}
 
 	// Only Test Partition 0
-	zk = NewZipfKey(3, nKeys, nParts, pKeysArray, s, p)
+	zk = NewZipfKey(3, nKeys, nParts, pKeysArray, s, p.(*HashPartitioner))
 
 	rr = float64(50)
 	txnLen = 5
@@ -59,7 +59,7 @@ func TestGenerator(t *testing.T) {
 	*CrossPercent = float64(50)
 	maxParts := 5
 
-	generator = NewTxnGen(RANDOM_UPDATE_STRING, rr, txnLen, maxParts, zk)
+	generator = NewTxnGen(3, RANDOM_UPDATE_STRING, rr, txnLen, maxParts, zk)
 
 	// Generator 3 queries
 	for i := 0; i < 3; i++ {
@@ -1,5 +1,13 @@
 package testbed
 
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"github.com/totemtang/cc-testbed/clog"
+)
+
 type Partitioner interface {
 	GetPartition(key Key) int
 	GetPartitionN(key Key) int
@@ -11,27 +19,207 @@ type HashPartitioner struct {
 	padding1 [64]byte
 	NParts   int64
 	NKeys    int64
+	IntLed   bool         // Composite keys start with an int part
+	moves    atomic.Value // *keyMoves, the ranges Migrate moved
 	padding2 [64]byte
 }
 
+// A range of int keys moved from one partition to another, only those
+// hashed to base unless it is negative. While it moves, its keys
+// belong to the new one but may still be in the old. Keys without an
+// int part only move with all ints.
+type keyMove struct {
+	lo     int64
+	hi     int64
+	base   int
+	from   int
+	to     int
+	moving bool
+}
+
+// Replaced as a whole whenever a migration starts or ends. Moves of
+// all keys, of one base or all, fold into owner once finished and
+// first in line, so only moves of narrower ranges and those after
+// them, e.g. the one in flight, are left to walk.
+type keyMoves struct {
+	version uint64
+	owner   []int // Partition of the keys of each base; nil as hashed
+	moves   []keyMove
+}
+
+func (m *keyMoves) fold(nParts int) {
+	copied := false
+	for len(m.moves) > 0 {
+		mv := &m.moves[0]
+		if mv.moving || mv.lo != math.MinInt64 || mv.hi != math.MaxInt64 {
+			return
+		}
+		if !copied {
+			owner := make([]int, nParts)
+			for b := range owner {
+				owner[b] = b
+				if m.owner != nil {
+					owner[b] = m.owner[b]
+				}
+			}
+			m.owner = owner
+			copied = true
+		}
+		for b := range m.owner {
+			if m.owner[b] == mv.from && (mv.base < 0 || mv.base == b) {
+				m.owner[b] = mv.to
+			}
+		}
+		m.moves = m.moves[1:]
+	}
+}
+
+func (hp *HashPartitioner) mapping() *keyMoves {
+	m, _ := hp.moves.Load().(*keyMoves)
+	return m
+}
+
+// The version of the mapping, bumped by every change
+func (hp *HashPartitioner) version() uint64 {
+	if m := hp.mapping(); m != nil {
+		return m.version
+	}
+	return 0
+}
+
+// Int keys go by their int. With IntLed, so do composite keys by
+// their leading int part, so that those which start with e.g. a
+// warehouse id keep each warehouse in one partition. Other keys go
+// by hash.
 func (hp *HashPartitioner) GetPartition(key Key) int {
-	k := int64(key)
-	ret := k % hp.NParts
-	return int(ret)
+	part, _ := hp.locate(key)
+	return part
+}
+
+// Partitioners other than HashPartitioner are never migrated
+func locate(p Partitioner, key Key) (int, int) {
+	if hp, ok := p.(*HashPartitioner); ok {
+		return hp.locate(key)
+	}
+	return p.GetPartition(key), -1
+}
+
+func mappingVersion(p Partitioner) uint64 {
+	if hp, ok := p.(*HashPartitioner); ok {
+		return hp.version()
+	}
+	return 0
+}
+
+// Returns the partition of key and, if it is still moving there, the
+// one it moves from; -1 otherwise. Moves apply in the order made.
+func (hp *HashPartitioner) locate(key Key) (int, int) {
+	var k int64
+	var base int
+	isInt := len(key) == INTKEYLEN || (hp.IntLed && len(key) > INTKEYLEN)
+	if isInt {
+		k = ParseKey(key)
+		base = int(uint64(k) % uint64(hp.NParts))
+	} else {
+		base = int(key.Hash() % uint64(hp.NParts))
+	}
+	part, from := base, -1
+	if m := hp.mapping(); m != nil {
+		if m.owner != nil {
+			part = m.owner[base]
+		}
+		for i := range m.moves {
+			mv := &m.moves[i]
+			inRange := k >= mv.lo && k <= mv.hi
+			if !isInt {
+				inRange = mv.lo == math.MinInt64 && mv.hi == math.MaxInt64
+			}
+			if inRange && part == mv.from && (mv.base < 0 || mv.base == base) {
+				part, from = mv.to, -1
+				if mv.moving {
+					from = mv.from
+				}
+			}
+		}
+	}
+	return part, from
 }
 
+// Ranks follow the hash layout; migrated keys keep theirs
 func (hp *HashPartitioner) GetKey(partIndex int, rank int64) Key {
 	p := int64(partIndex)
-	return Key(rank*hp.NParts + p)
+	return CKey(rank*hp.NParts + p)
 }
 
 func (hp *HashPartitioner) GetPartitionN(key Key) int {
-	k := int64(key)
-	ret := k % hp.NParts
-	return int(ret)
+	return hp.GetPartition(key)
 }
 
 func (hp *HashPartitioner) GetRank(key Key) int64 {
-	k := int64(key)
+	k := ParseKey(key)
 	return k / hp.NParts
 }
+
+// RangePartitioner puts the keys below Splits[0] in partition 0,
+// those from Splits[i-1] below Splits[i] in partition i, and the rest
+// in the last partition. Ranks count from the start of a partition.
+type RangePartitioner struct {
+	padding1 [64]byte
+	NParts   int64
+	NKeys    int64
+	Splits   []int64
+	padding2 [64]byte
+}
+
+// NewRangePartitioner checks that splits ascend within the keys; nil
+// splits the keys evenly among nParts
+func NewRangePartitioner(nParts int, nKeys int64, splits []int64) *RangePartitioner {
+	if splits == nil {
+		for i := 1; i < nParts; i++ {
+			splits = append(splits, nKeys*int64(i)/int64(nParts))
+		}
+	}
+	if len(splits) != nParts-1 {
+		clog.Error("%v Partitions Need %v Split Points; Got %v", nParts, nParts-1, len(splits))
+	}
+	for i, x := range splits {
+		if x <= 0 || x >= nKeys || (i > 0 && x <= splits[i-1]) {
+			clog.Error("Invalid Split Points %v of %v Keys", splits, nKeys)
+		}
+	}
+	return &RangePartitioner{
+		NParts: int64(nParts),
+		NKeys:  nKeys,
+		Splits: splits,
+	}
+}
+
+// Keys too short for an int part go by hash, as with HashPartitioner
+func (rp *RangePartitioner) GetPartition(key Key) int {
+	if len(key) < INTKEYLEN {
+		return int(key.Hash() % uint64(rp.NParts))
+	}
+	k := ParseKey(key)
+	return sort.Search(len(rp.Splits), func(i int) bool {
+		return rp.Splits[i] > k
+	})
+}
+
+func (rp *RangePartitioner) GetPartitionN(key Key) int {
+	return rp.GetPartition(key)
+}
+
+func (rp *RangePartitioner) GetKey(partIndex int, rank int64) Key {
+	return CKey(rp.start(partIndex) + rank)
+}
+
+func (rp *RangePartitioner) GetRank(key Key) int64 {
+	return ParseKey(key) - rp.start(rp.GetPartition(key))
+}
+
+func (rp *RangePartitioner) start(partIndex int) int64 {
+	if partIndex == 0 {
+		return 0
+	}
+	return rp.Splits[partIndex-1]
+}
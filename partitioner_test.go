@@ -2,6 +2,10 @@ package testbed
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -16,7 +20,7 @@ func TestHashPartitioner(t *testing.T) {
 	}
 
 	for i := int64(0); i < nKeys; i++ {
-		k := Key(i)
+		k := CKey(i)
 		p := i % nParts
 		testP := hp.GetPartition(k)
 		if testP != int(p) {
@@ -27,5 +31,123 @@ func TestHashPartitioner(t *testing.T) {
 	fmt.Printf("%v tests passed \n", nKeys)
 	fmt.Println("====================")
 	fmt.Println("Test Partitioner End")
-	fmt.Println("====================\n")
+	fmt.Printf("====================\n\n")
+}
+
+func TestRangePartitioner(t *testing.T) {
+	fmt.Println("============================")
+	fmt.Println("Test Range Partitioner Begin")
+	fmt.Println("============================")
+
+	*SysType = PARTITION
+	nKeys := int64(1000)
+	splits := []int64{100, 250, 700}
+	rp := NewRangePartitioner(len(splits)+1, nKeys, splits)
+	pKeysArray := make([]int64, len(splits)+1)
+	for i := int64(0); i < nKeys; i++ {
+		k := CKey(i)
+		p := 0
+		for p < len(splits) && i >= splits[p] {
+			p++
+		}
+		if testP := rp.GetPartition(k); testP != p {
+			t.Errorf("Key %v in partition %v; expected %v", i, testP, p)
+		}
+		if rk := rp.GetKey(p, rp.GetRank(k)); rk != k {
+			t.Errorf("Key %v has rank %v, which gives key %v", i, rp.GetRank(k), ParseKey(rk))
+		}
+		pKeysArray[p]++
+	}
+	if even := NewRangePartitioner(4, nKeys, nil); even.GetPartition(CKey(249)) != 0 || even.GetPartition(CKey(250)) != 1 {
+		t.Errorf("Even splits are %v", even.Splits)
+	}
+
+	// Generated keys stay in their range
+	for _, s := range []float64{1, 1.5} {
+		zk := NewZipfKey(2, nKeys, len(splits)+1, pKeysArray, s, rp)
+		for i := 0; i < 1000; i++ {
+			if k := ParseKey(zk.GetSelfKey()); k < 250 || k >= 700 {
+				t.Errorf("Key %v generated for partition 2", k)
+			}
+			if k := ParseKey(zk.GetOtherKey(3)); k < 700 || k >= nKeys {
+				t.Errorf("Key %v generated for partition 3", k)
+			}
+		}
+	}
+
+	fmt.Println("==========================")
+	fmt.Println("Test Range Partitioner End")
+	fmt.Printf("==========================\n\n")
+}
+
+func TestLookupPartitioner(t *testing.T) {
+	fmt.Println("=============================")
+	fmt.Println("Test Lookup Partitioner Begin")
+	fmt.Println("=============================")
+
+	*SysType = PARTITION
+	nParts := 3
+	nKeys := int64(1000)
+	// Keys below 900 go to partition k/300; those above by hash
+	parts := make([]uint8, 900)
+	for i := range parts {
+		parts[i] = uint8(i / 300)
+	}
+	parts[5] = NOPART
+	lp := NewLookupPartitioner(nParts, nKeys, parts)
+
+	dir, err := ioutil.TempDir("", "cclookup")
+	if err != nil {
+		t.Fatalf("Create Temp Dir Error %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lookup")
+	lp.Save(path)
+	loaded := LoadLookupPartitioner(path, nParts, nKeys)
+
+	pKeysArray := make([]int64, nParts)
+	for i := int64(0); i < nKeys+10; i++ {
+		k := CKey(i)
+		p := int(i % int64(nParts))
+		if i < 900 && i != 5 {
+			p = int(i / 300)
+		}
+		for _, x := range []*LookupPartitioner{lp, loaded} {
+			if testP := x.GetPartition(k); testP != p {
+				t.Errorf("Key %v in partition %v; expected %v", i, testP, p)
+			}
+		}
+		if i >= nKeys {
+			if r := lp.GetRank(k); r != -1 {
+				t.Errorf("Key %v beyond the table has rank %v", i, r)
+			}
+			continue
+		}
+		if rk := lp.GetKey(p, lp.GetRank(k)); rk != k {
+			t.Errorf("Key %v has rank %v, which gives key %v", i, lp.GetRank(k), ParseKey(rk))
+		}
+		pKeysArray[p]++
+	}
+
+	// Keys outside the table go by hash, never below partition 0
+	for _, k := range []Key{CKey(-7), CKey(math.MinInt64), BytesKey([]byte("customer-0001")), CompositeKey("warehouse", 3)} {
+		if p := lp.GetPartition(k); p < 0 || p >= nParts {
+			t.Errorf("Key %v in partition %v", k, p)
+		}
+		if r := lp.GetRank(k); r != -1 {
+			t.Errorf("Key %v outside the table has rank %v", k, r)
+		}
+	}
+
+	// Generated keys stay in their partition
+	zk := NewZipfKey(1, nKeys, nParts, pKeysArray, 1.5, lp)
+	for i := 0; i < 1000; i++ {
+		if k := zk.GetSelfKey(); lp.GetPartition(k) != 1 {
+			t.Errorf("Key %v generated for partition 1", ParseKey(k))
+		}
+	}
+
+	fmt.Println("===========================")
+	fmt.Println("Test Lookup Partitioner End")
+	fmt.Printf("===========================\n\n")
 }
@@ -39,6 +39,12 @@ func (s *Spinlock) Lock() {
 	}
 }
 
+// TryLock tries to lock s without spinning.
+// It returns true if s has been locked by this call.
+func (s *Spinlock) TryLock() bool {
+	return atomic.CompareAndSwapInt32(&s.state, 0, mutexLocked)
+}
+
 // Unlock unlocks s.
 //
 // A locked Spinlock is not associated with a particular goroutine.
@@ -58,9 +64,12 @@ type RWSpinlock struct {
 
 const spinlockMaxReaders = 1 << 30
 
+// RLock locks l for reading. A reader which finds a writer backs
+// out its count, so that the writer does not wait for it.
 func (l *RWSpinlock) RLock() {
-	if atomic.AddInt32(&l.readerCount, 1) < 0 {
-		i := PREEMPT
+	i := PREEMPT
+	for atomic.AddInt32(&l.readerCount, 1) < 0 {
+		atomic.AddInt32(&l.readerCount, -1)
 		for atomic.LoadInt32(&l.readerCount) < 0 {
 			if i == 0 {
 				runtime.Gosched()
@@ -84,11 +93,52 @@ func (l *RWSpinlock) Lock() {
 			runtime.Gosched()
 			i = PREEMPT
 		}
-		r = atomic.LoadInt32(&l.readerCount)
+		r = atomic.LoadInt32(&l.readerCount) + spinlockMaxReaders
 		i--
 	}
 }
 
+// TryRLock tries to lock l for reading without spinning.
+// It fails if a writer holds l.
+func (l *RWSpinlock) TryRLock() bool {
+	for {
+		r := atomic.LoadInt32(&l.readerCount)
+		if r < 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&l.readerCount, r, r+1) {
+			return true
+		}
+	}
+}
+
+// TryLock tries to lock l for writing without spinning.
+// It fails if l is held by either a reader or a writer.
+func (l *RWSpinlock) TryLock() bool {
+	if !l.w.TryLock() {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&l.readerCount, 0, -spinlockMaxReaders) {
+		l.w.Unlock()
+		return false
+	}
+	return true
+}
+
+// TryUpgrade tries to turn a read lock held by the caller into a
+// write lock. It fails if any other reader or writer holds l, in
+// which case the caller keeps its read lock.
+func (l *RWSpinlock) TryUpgrade() bool {
+	if !l.w.TryLock() {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&l.readerCount, 1, -spinlockMaxReaders) {
+		l.w.Unlock()
+		return false
+	}
+	return true
+}
+
 func (l *RWSpinlock) Unlock() {
 	atomic.AddInt32(&l.readerCount, spinlockMaxReaders)
 	l.w.Unlock()
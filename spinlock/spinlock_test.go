@@ -64,7 +64,7 @@ func TestRWSpinlock(t *testing.T) {
 		go func() {
 			s.RLock()
 			if x+y != 0 {
-				t.Fatalf("Bad read %v %v\n", x, y)
+				t.Errorf("Bad read %v %v\n", x, y)
 			}
 			s.RUnlock()
 			wg.Done()
@@ -76,3 +76,39 @@ func TestRWSpinlock(t *testing.T) {
 	}
 	fmt.Printf("Passed TestRWSpinlock\n")
 }
+
+func TestRWSpinlockTry(t *testing.T) {
+	s := new(RWSpinlock)
+
+	if !s.TryRLock() || !s.TryRLock() {
+		t.Fatalf("Could not share read lock\n")
+	}
+	if s.TryLock() {
+		t.Fatalf("Write lock granted while readers hold it\n")
+	}
+	s.RUnlock()
+	s.RUnlock()
+
+	if !s.TryLock() {
+		t.Fatalf("Could not lock\n")
+	}
+	if s.TryRLock() || s.TryLock() {
+		t.Fatalf("Lock granted while writer holds it\n")
+	}
+	s.Unlock()
+
+	s.TryRLock()
+	s.TryRLock()
+	if s.TryUpgrade() {
+		t.Fatalf("Upgrade granted while another reader holds it\n")
+	}
+	s.RUnlock()
+	if !s.TryUpgrade() {
+		t.Fatalf("Could not upgrade\n")
+	}
+	if s.TryRLock() {
+		t.Fatalf("Read lock granted after upgrade\n")
+	}
+	s.Unlock()
+	fmt.Printf("Passed TestRWSpinlockTry\n")
+}
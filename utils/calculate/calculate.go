@@ -27,7 +27,7 @@ func main() {
 
 	o, outErr := os.OpenFile(*out, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
 	if outErr != nil {
-		fmt.Printf("Open File %s Error\n", *o)
+		fmt.Printf("Open File %s Error\n", *out)
 		return
 	}
 	defer o.Close()
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/totemtang/cc-testbed"
+)
+
+// Print the SC-graph and the safe choppings of the transactions
+// a worker registers
+func main() {
+	flag.Parse()
+
+	w := testbed.NewWorker(0, testbed.NewStore())
+	testbed.PrintChopping(os.Stdout, w.Decls())
+}